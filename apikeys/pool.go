@@ -0,0 +1,223 @@
+package apikeys
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// Key selection strategies.
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyLeastUsed  = "least-used"
+	StrategySticky     = "sticky"
+)
+
+// Key states as reported by Snapshot.
+const (
+	StateActive  = "active"
+	StateCooling = "cooling"
+)
+
+// keyState holds the usage of one key.
+type keyState struct {
+	key          string
+	uses         int64
+	quotaErrors  int64
+	lastUsed     time.Time
+	coolingUntil time.Time
+}
+
+// Pool hands out the proxy's upstream API keys. A key that hits its quota cools down
+// and is skipped until the cooldown has passed.
+type Pool struct {
+	strategy string
+	cooldown time.Duration
+
+	mu   sync.Mutex
+	keys []*keyState
+	rr   int
+}
+
+// NewPool creates a pool, or returns nil when keys is empty so callers can treat a nil
+// pool as "forward the client's own credentials".
+func NewPool(keys []string, strategy string, cooldown time.Duration) *Pool {
+	if len(keys) == 0 {
+		return nil
+	}
+	p := &Pool{strategy: strings.ToLower(strategy), cooldown: cooldown}
+	for _, key := range keys {
+		p.keys = append(p.keys, &keyState{key: key})
+	}
+	return p
+}
+
+// Size returns the number of keys in the pool.
+func (p *Pool) Size() int {
+	return len(p.keys)
+}
+
+// Acquire picks a key for a request. client identifies the caller for the sticky
+// strategy. Cooling keys are skipped; when every key is cooling, the one whose
+// cooldown ends first is used rather than failing the request.
+func (p *Pool) Acquire(client string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	i := p.pick(client, "", now)
+	p.use(i, now)
+	return p.keys[i].key
+}
+
+// Rotate marks key as out of quota for retryAfter (the pool's cooldown when zero) and
+// picks another key. ok is false when no other key is available, in which case the
+// caller should surface the quota error and no use is counted.
+func (p *Pool) Rotate(key, client string, retryAfter time.Duration) (next string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if s := p.find(key); s != nil {
+		if retryAfter <= 0 {
+			retryAfter = p.cooldown
+		}
+		s.quotaErrors++
+		s.coolingUntil = now.Add(retryAfter)
+		logger.LogError(fmt.Sprintf("API key %s is out of quota; cooling down for %v", Mask(key), retryAfter))
+	}
+
+	i := p.pick(client, key, now)
+	next = p.keys[i].key
+	if next == key || now.Before(p.keys[i].coolingUntil) {
+		return next, false
+	}
+	p.use(i, now)
+	logger.LogInfo(fmt.Sprintf("Rotating upstream API key %s -> %s", Mask(key), Mask(next)))
+	return next, true
+}
+
+// pick returns the index of the key the strategy selects, without recording a use. The
+// caller holds p.mu.
+func (p *Pool) pick(client, exclude string, now time.Time) int {
+	var candidates []int
+	for i, s := range p.keys {
+		if s.key != exclude && !now.Before(s.coolingUntil) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	chosen := -1
+	switch {
+	case len(candidates) == 0:
+		for i, s := range p.keys {
+			if chosen == -1 || s.coolingUntil.Before(p.keys[chosen].coolingUntil) {
+				chosen = i
+			}
+		}
+	case p.strategy == StrategyLeastUsed:
+		for _, i := range candidates {
+			if chosen == -1 || p.keys[i].uses < p.keys[chosen].uses {
+				chosen = i
+			}
+		}
+	case p.strategy == StrategySticky && client != "":
+		// Hash over every key so a client keeps its key while that key is available.
+		h := fnv.New32a()
+		h.Write([]byte(client))
+		preferred := int(h.Sum32() % uint32(len(p.keys)))
+		chosen = p.firstCandidate(preferred, candidates)
+	default:
+		chosen = p.firstCandidate(p.rr, candidates)
+	}
+	return chosen
+}
+
+// firstCandidate returns the first candidate at or after start, wrapping around.
+func (p *Pool) firstCandidate(start int, candidates []int) int {
+	for offset := 0; offset < len(p.keys); offset++ {
+		i := (start + offset) % len(p.keys)
+		for _, c := range candidates {
+			if c == i {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// use records that the key at index i was handed out; round robin continues after it.
+// The caller holds p.mu.
+func (p *Pool) use(i int, now time.Time) {
+	s := p.keys[i]
+	s.uses++
+	s.lastUsed = now.UTC()
+	p.rr = (i + 1) % len(p.keys)
+}
+
+// find returns the state of key. The caller holds p.mu.
+func (p *Pool) find(key string) *keyState {
+	for _, s := range p.keys {
+		if s.key == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// Status is the JSON view of one key, as shown on the logs dashboard. Owner names the
+// client a key is reserved for and is empty for the shared pool.
+type Status struct {
+	Index        int        `json:"index"`
+	Key          string     `json:"key"`
+	Owner        string     `json:"owner,omitempty"`
+	State        string     `json:"state"`
+	Uses         int64      `json:"uses"`
+	QuotaErrors  int64      `json:"quotaErrors"`
+	LastUsed     *time.Time `json:"lastUsed,omitempty"`
+	CoolingUntil *time.Time `json:"coolingUntil,omitempty"`
+}
+
+// Snapshot returns the state of every key, with the keys masked.
+func (p *Pool) Snapshot() []Status {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	result := make([]Status, 0, len(p.keys))
+	for i, s := range p.keys {
+		status := Status{
+			Index:       i,
+			Key:         Mask(s.key),
+			State:       StateActive,
+			Uses:        s.uses,
+			QuotaErrors: s.quotaErrors,
+		}
+		if !s.lastUsed.IsZero() {
+			lastUsed := s.lastUsed
+			status.LastUsed = &lastUsed
+		}
+		if now.Before(s.coolingUntil) {
+			until := s.coolingUntil.UTC()
+			status.State = StateCooling
+			status.CoolingUntil = &until
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// Mask shortens a key to its last four characters for logs and the dashboard.
+func Mask(key string) string {
+	if len(key) <= 4 {
+		return "…" + key
+	}
+	return "…" + key[len(key)-4:]
+}
@@ -0,0 +1,144 @@
+package apikeys
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// acquireN returns the keys of n consecutive Acquire calls.
+func acquireN(p *Pool, client string, n int) []string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		keys = append(keys, p.Acquire(client))
+	}
+	return keys
+}
+
+// uses returns the use count of every key.
+func uses(p *Pool) []int64 {
+	var counts []int64
+	for _, s := range p.Snapshot() {
+		counts = append(counts, s.Uses)
+	}
+	return counts
+}
+
+func TestNewPoolWithoutKeys(t *testing.T) {
+	if p := NewPool(nil, StrategyRoundRobin, time.Minute); p != nil {
+		t.Errorf("NewPool(nil) = %v; want nil", p)
+	}
+}
+
+func TestAcquireRoundRobin(t *testing.T) {
+	p := NewPool([]string{"a", "b", "c"}, StrategyRoundRobin, time.Minute)
+	if got, want := acquireN(p, "", 4), []string{"a", "b", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Acquire sequence = %v; want %v", got, want)
+	}
+}
+
+func TestAcquireLeastUsed(t *testing.T) {
+	p := NewPool([]string{"a", "b", "c"}, StrategyLeastUsed, time.Minute)
+	// a cools down only briefly; the rotation hands out b.
+	if next, ok := p.Rotate("a", "", time.Nanosecond); next != "b" || !ok {
+		t.Fatalf("Rotate(a) = %q, %v; want b, true", next, ok)
+	}
+	time.Sleep(time.Millisecond)
+	if got, want := acquireN(p, "", 3), []string{"a", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Acquire sequence = %v; want %v", got, want)
+	}
+}
+
+func TestAcquireSticky(t *testing.T) {
+	p := NewPool([]string{"a", "b", "c", "d"}, StrategySticky, time.Minute)
+	key := p.Acquire("alice")
+	for i := 0; i < 3; i++ {
+		if got := p.Acquire("alice"); got != key {
+			t.Fatalf("Acquire(alice) = %q; want the sticky key %q", got, key)
+		}
+	}
+
+	// While the key is cooling the client moves on, and keeps the replacement.
+	next, ok := p.Rotate(key, "alice", time.Minute)
+	if !ok || next == key {
+		t.Fatalf("Rotate(%q) = %q, %v; want another key", key, next, ok)
+	}
+	if got := p.Acquire("alice"); got != next {
+		t.Errorf("Acquire(alice) after rotation = %q; want %q", got, next)
+	}
+
+	// Without a client identity the sticky strategy falls back to round robin.
+	anonymous := NewPool([]string{"a", "b"}, StrategySticky, time.Minute)
+	if got, want := acquireN(anonymous, "", 3), []string{"a", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("anonymous Acquire sequence = %v; want %v", got, want)
+	}
+}
+
+func TestAcquireSkipsCoolingKeys(t *testing.T) {
+	p := NewPool([]string{"a", "b", "c"}, StrategyRoundRobin, time.Minute)
+	if next, ok := p.Rotate("b", "", 0); next != "a" || !ok {
+		t.Fatalf("Rotate(b) = %q, %v; want a, true", next, ok)
+	}
+	if got, want := acquireN(p, "", 4), []string{"c", "a", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Acquire sequence = %v; want %v", got, want)
+	}
+
+	status := p.Snapshot()[1]
+	if status.State != StateCooling || status.QuotaErrors != 1 || status.CoolingUntil == nil {
+		t.Errorf("cooling key status = %+v", status)
+	}
+	if until := time.Until(*status.CoolingUntil); until <= 0 || until > time.Minute {
+		t.Errorf("cooldown ends in %v; want the pool cooldown", until)
+	}
+}
+
+func TestAllKeysCooling(t *testing.T) {
+	p := NewPool([]string{"a", "b"}, StrategyRoundRobin, time.Minute)
+	if next, ok := p.Rotate("a", "", 2*time.Minute); next != "b" || !ok {
+		t.Fatalf("Rotate(a) = %q, %v; want b, true", next, ok)
+	}
+
+	// No key is left: the rotation fails without counting a use.
+	if next, ok := p.Rotate("b", "", time.Minute); ok {
+		t.Errorf("Rotate(b) = %q, true; want a failed rotation", next)
+	}
+	if got, want := uses(p), []int64{0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uses after the failed rotation = %v; want %v", got, want)
+	}
+
+	// Requests still get the key whose cooldown ends first.
+	if got := p.Acquire(""); got != "b" {
+		t.Errorf("Acquire() with every key cooling = %q; want b", got)
+	}
+	if got, want := uses(p), []int64{0, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uses = %v; want %v", got, want)
+	}
+}
+
+func TestRotateSingleKey(t *testing.T) {
+	p := NewPool([]string{"only"}, StrategyRoundRobin, time.Minute)
+	p.Acquire("")
+	if next, ok := p.Rotate("only", "", 0); next != "only" || ok {
+		t.Errorf("Rotate(only) = %q, %v; want only, false", next, ok)
+	}
+	if got := uses(p); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("uses = %v; want [1]", got)
+	}
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"AIzaSyExample1234", "…1234"},
+		{"abcd", "…abcd"},
+		{"ab", "…ab"},
+		{"", "…"},
+	}
+	for _, tt := range tests {
+		if got := Mask(tt.key); got != tt.want {
+			t.Errorf("Mask(%q) = %q; want %q", tt.key, got, tt.want)
+		}
+	}
+}
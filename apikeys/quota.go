@@ -0,0 +1,52 @@
+package apikeys
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithKey returns a copy of headers that carries key as the upstream credential in
+// place of whatever the client sent.
+func WithKey(headers http.Header, key string) http.Header {
+	result := headers.Clone()
+	if result == nil {
+		result = make(http.Header)
+	}
+	result.Del("Authorization")
+	result.Set("X-Goog-Api-Key", key)
+	return result
+}
+
+// QuotaExceeded reports whether an upstream error response means the key ran out of
+// quota: a 429, or an error whose status is RESOURCE_EXHAUSTED. retryAfter is the delay
+// the upstream asked for, from the Retry-After header or a RetryInfo detail, or zero.
+func QuotaExceeded(status int, header http.Header, body []byte) (exceeded bool, retryAfter time.Duration) {
+	var parsed struct {
+		Error struct {
+			Status  string `json:"status"`
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &parsed)
+	if status != http.StatusTooManyRequests && parsed.Error.Status != "RESOURCE_EXHAUSTED" {
+		return false, 0
+	}
+
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header.Get("Retry-After"))); err == nil && seconds > 0 {
+		return true, time.Duration(seconds) * time.Second
+	}
+	for _, detail := range parsed.Error.Details {
+		if strings.HasSuffix(detail.Type, "RetryInfo") {
+			if delay, err := time.ParseDuration(detail.RetryDelay); err == nil && delay > 0 {
+				return true, delay
+			}
+		}
+	}
+	return true, 0
+}
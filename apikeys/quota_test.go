@@ -0,0 +1,59 @@
+package apikeys
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQuotaExceeded(t *testing.T) {
+	const exhausted = `{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED", "details": [
+		{"@type": "type.googleapis.com/google.rpc.QuotaFailure"},
+		{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "17s"}
+	]}}`
+
+	tests := []struct {
+		name           string
+		status         int
+		retryAfter     string
+		body           string
+		wantExceeded   bool
+		wantRetryAfter time.Duration
+	}{
+		{"429 without details", http.StatusTooManyRequests, "", "", true, 0},
+		{"429 with Retry-After", http.StatusTooManyRequests, "30", "", true, 30 * time.Second},
+		{"RetryInfo delay", http.StatusTooManyRequests, "", exhausted, true, 17 * time.Second},
+		{"Retry-After wins over RetryInfo", http.StatusTooManyRequests, "5", exhausted, true, 5 * time.Second},
+		{"invalid Retry-After falls back to RetryInfo", http.StatusTooManyRequests, "soon", exhausted, true, 17 * time.Second},
+		{"RESOURCE_EXHAUSTED with another status", http.StatusServiceUnavailable, "", `{"error": {"status": "RESOURCE_EXHAUSTED"}}`, true, 0},
+		{"other error", http.StatusBadRequest, "", `{"error": {"status": "INVALID_ARGUMENT"}}`, false, 0},
+		{"server error", http.StatusInternalServerError, "30", "not json", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.retryAfter != "" {
+				header.Set("Retry-After", tt.retryAfter)
+			}
+			exceeded, retryAfter := QuotaExceeded(tt.status, header, []byte(tt.body))
+			if exceeded != tt.wantExceeded || retryAfter != tt.wantRetryAfter {
+				t.Errorf("QuotaExceeded() = %v, %v; want %v, %v", exceeded, retryAfter, tt.wantExceeded, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestWithKey(t *testing.T) {
+	headers := http.Header{"Authorization": {"Bearer client"}, "Content-Type": {"application/json"}}
+	got := WithKey(headers, "pool-key")
+	if got.Get("X-Goog-Api-Key") != "pool-key" || got.Get("Authorization") != "" || got.Get("Content-Type") != "application/json" {
+		t.Errorf("WithKey() = %v", got)
+	}
+	if headers.Get("Authorization") == "" {
+		t.Error("WithKey modified the original headers")
+	}
+	if got := WithKey(nil, "pool-key"); got.Get("X-Goog-Api-Key") != "pool-key" {
+		t.Errorf("WithKey(nil) = %v", got)
+	}
+}
@@ -1,12 +1,66 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// DefaultCompletionSentinel is the token the sentinel detector asks models to end with.
+const DefaultCompletionSentinel = "[done]"
+
+// DefaultUpstreamGroup is the upstream group requests use when no routing rule matches.
+const DefaultUpstreamGroup = "default"
+
+// UpstreamMember is one base of an upstream group with its relative share of the traffic.
+type UpstreamMember struct {
+	Base   string
+	Weight int
+}
+
+// PrefixRule maps a model identifier prefix to a setting value.
+type PrefixRule struct {
+	Prefix string
+	Value  string
+}
+
+// RetryPolicy controls how many times, and how quickly, one kind of interruption is retried.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxDelay    time.Duration
+}
+
+// Safety block handling actions.
+const (
+	BlockActionFail  = "fail"
+	BlockActionRetry = "retry"
+	BlockActionPass  = "pass"
+)
+
+// BlockPolicy controls how one category of safety block is handled: fail the request
+// with an error, retry up to Retries times, or pass the block through to the client.
+type BlockPolicy struct {
+	Action  string
+	Retries int
+}
+
+// ClientToken is a proxy-issued client credential. Requests made with Token use Keys
+// as their upstream keys, or the shared UPSTREAM_API_KEYS pool when Keys is empty.
+// A zero Expires never expires.
+type ClientToken struct {
+	Name    string
+	Token   string
+	Keys    []string
+	Enabled bool
+	Expires time.Time
+}
+
 // Config holds all configuration values
 type Config struct {
 	UpstreamURLBase            string
@@ -24,6 +78,49 @@ type Config struct {
 	RateLimitCount             int
 	RateLimitWindowSeconds     int
 	EnablePunctuationHeuristic bool
+	CompletionDetector         string
+	CompletionDetectorRules    []PrefixRule
+	CompletionSentinel         string
+	DefaultRetryPolicy         RetryPolicy
+	RetryPolicies              map[string]RetryPolicy
+	RetryUpstreamStrategy      string
+	EnableSeamDedup            bool
+	SeamDedupWindow            int
+	SeamDedupMinOverlap        int
+	UsageBreakdown             bool
+	RetryThoughtHistory        string
+	RetryThoughtHistoryRules   []PrefixRule
+	ContinuationStrategy       string
+	ContinuationStrategyRules  []PrefixRule
+	ContinuationPromptRules    []PrefixRule
+	AllowClientOverrides       bool
+	ClientMaxRetries           int
+	KeepAliveInterval          time.Duration
+	StallFirstByteTimeout      time.Duration
+	StallIdleTimeout           time.Duration
+	HedgeDelay                 time.Duration
+	HedgeMaxParallel           int
+	SSEMaxEventBytes           int
+	BlockPolicies              map[string]BlockPolicy
+	UpstreamBreakerThreshold   int
+	UpstreamBreakerCooldown    time.Duration
+	UpstreamHealthInterval     time.Duration
+	UpstreamHealthPath         string
+	UpstreamHealthTimeout      time.Duration
+	UpstreamGroups             map[string][]UpstreamMember
+	UpstreamRoutes             []PrefixRule
+	UpstreamAPIKeys            []string
+	UpstreamAPIKeyStrategy     string
+	UpstreamAPIKeyCooldown     time.Duration
+	ClientTokens               []ClientToken
+	UpstreamDialTimeout        time.Duration
+	UpstreamTCPKeepAlive       time.Duration
+	UpstreamTLSTimeout         time.Duration
+	UpstreamHeaderTimeout      time.Duration
+	UpstreamIdleConnTimeout    time.Duration
+	UpstreamMaxIdleConns       int
+	UpstreamMaxConns           int
+	UpstreamHTTP2              bool
 }
 
 // LoadConfig loads configuration from environment variables
@@ -64,6 +161,71 @@ func LoadConfig() *Config {
 		RateLimitCount:             getEnvInt("RATE_LIMIT_COUNT", 10),
 		RateLimitWindowSeconds:     getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 60),
 		EnablePunctuationHeuristic: getEnvBool("ENABLE_PUNCTUATION_HEURISTIC", true),
+		CompletionDetector:         getEnvString("COMPLETION_DETECTOR", "sentinel"),
+		CompletionDetectorRules:    getEnvPrefixRules("COMPLETION_DETECTOR_RULES"),
+		CompletionSentinel:         getEnvString("COMPLETION_SENTINEL", DefaultCompletionSentinel),
+		RetryUpstreamStrategy:      strings.ToLower(getEnvString("RETRY_UPSTREAM_STRATEGY", "same")),
+		EnableSeamDedup:            getEnvBool("ENABLE_SEAM_DEDUP", true),
+		SeamDedupWindow:            getEnvInt("SEAM_DEDUP_WINDOW", 200),
+		SeamDedupMinOverlap:        getEnvInt("SEAM_DEDUP_MIN_OVERLAP", 6),
+		UsageBreakdown:             getEnvBool("USAGE_BREAKDOWN", false),
+		RetryThoughtHistory:        getEnvString("RETRY_THOUGHT_HISTORY", "none"),
+		RetryThoughtHistoryRules:   getEnvPrefixRules("RETRY_THOUGHT_HISTORY_RULES"),
+		ContinuationStrategy:       getEnvString("CONTINUATION_STRATEGY", "user"),
+		ContinuationStrategyRules:  getEnvPrefixRules("CONTINUATION_STRATEGY_RULES"),
+		ContinuationPromptRules:    getEnvTemplateRules("CONTINUATION_PROMPT_RULES"),
+		KeepAliveInterval:          time.Duration(getEnvInt("KEEPALIVE_INTERVAL_MS", 0)) * time.Millisecond,
+		StallFirstByteTimeout:      time.Duration(getEnvInt("STALL_FIRST_BYTE_TIMEOUT_MS", 0)) * time.Millisecond,
+		StallIdleTimeout:           time.Duration(getEnvInt("STALL_IDLE_TIMEOUT_MS", 0)) * time.Millisecond,
+		HedgeDelay:                 time.Duration(getEnvInt("HEDGE_DELAY_MS", 0)) * time.Millisecond,
+		HedgeMaxParallel:           getEnvInt("HEDGE_MAX_PARALLEL", 2),
+		SSEMaxEventBytes:           getEnvInt("SSE_MAX_EVENT_BYTES", 16<<20),
+		UpstreamBreakerThreshold:   getEnvInt("UPSTREAM_BREAKER_THRESHOLD", 5),
+		UpstreamBreakerCooldown:    time.Duration(getEnvInt("UPSTREAM_BREAKER_COOLDOWN_MS", 30000)) * time.Millisecond,
+		UpstreamHealthInterval:     time.Duration(getEnvInt("UPSTREAM_HEALTH_CHECK_INTERVAL_MS", 0)) * time.Millisecond,
+		UpstreamHealthPath:         getEnvString("UPSTREAM_HEALTH_CHECK_PATH", "/"),
+		UpstreamHealthTimeout:      time.Duration(getEnvInt("UPSTREAM_HEALTH_CHECK_TIMEOUT_MS", 5000)) * time.Millisecond,
+		UpstreamGroups:             parseUpstreamGroups(os.Getenv("UPSTREAM_GROUPS")),
+		UpstreamRoutes:             getEnvPrefixRules("UPSTREAM_ROUTES"),
+		UpstreamAPIKeys:            getEnvStringSliceFlexible(os.Getenv("UPSTREAM_API_KEYS")),
+		UpstreamAPIKeyStrategy:     strings.ToLower(getEnvString("UPSTREAM_API_KEY_STRATEGY", "round-robin")),
+		UpstreamAPIKeyCooldown:     time.Duration(getEnvInt("UPSTREAM_API_KEY_COOLDOWN_MS", 60000)) * time.Millisecond,
+		ClientTokens:               parseClientTokens(os.Getenv("CLIENT_TOKENS")),
+		UpstreamDialTimeout:        time.Duration(getEnvInt("UPSTREAM_DIAL_TIMEOUT_MS", 10000)) * time.Millisecond,
+		UpstreamTCPKeepAlive:       time.Duration(getEnvInt("UPSTREAM_TCP_KEEPALIVE_MS", 30000)) * time.Millisecond,
+		UpstreamTLSTimeout:         time.Duration(getEnvInt("UPSTREAM_TLS_HANDSHAKE_TIMEOUT_MS", 10000)) * time.Millisecond,
+		UpstreamHeaderTimeout:      time.Duration(getEnvInt("UPSTREAM_RESPONSE_HEADER_TIMEOUT_MS", 0)) * time.Millisecond,
+		UpstreamIdleConnTimeout:    time.Duration(getEnvInt("UPSTREAM_IDLE_CONN_TIMEOUT_MS", 90000)) * time.Millisecond,
+		UpstreamMaxIdleConns:       getEnvInt("UPSTREAM_MAX_IDLE_CONNS", 32),
+		UpstreamMaxConns:           getEnvInt("UPSTREAM_MAX_CONNS", 0),
+		UpstreamHTTP2:              getEnvBool("UPSTREAM_HTTP2", true),
+	}
+
+	cfg.AllowClientOverrides = getEnvBool("ALLOW_CLIENT_OVERRIDES", false)
+	cfg.ClientMaxRetries = getEnvInt("CLIENT_MAX_RETRIES", 10)
+
+	cfg.DefaultRetryPolicy = RetryPolicy{
+		MaxAttempts: cfg.MaxConsecutiveRetries,
+		BaseDelay:   cfg.RetryDelayMs,
+		Multiplier:  1,
+	}
+	cfg.RetryPolicies = defaultRetryPolicies(cfg.DefaultRetryPolicy)
+	parseRetryPolicies(os.Getenv("RETRY_POLICIES"), cfg.DefaultRetryPolicy, cfg.RetryPolicies)
+
+	cfg.BlockPolicies = defaultBlockPolicies()
+	parseBlockPolicies(os.Getenv("BLOCK_POLICIES"), cfg.BlockPolicies)
+
+	// Without an explicit default group, the flat upstream list is the default group.
+	if len(cfg.UpstreamGroups[DefaultUpstreamGroup]) == 0 {
+		bases := upstreamBases
+		if len(bases) == 0 {
+			bases = []string{upstreamBase}
+		}
+		members := make([]UpstreamMember, 0, len(bases))
+		for _, base := range bases {
+			members = append(members, UpstreamMember{Base: base, Weight: 1})
+		}
+		cfg.UpstreamGroups[DefaultUpstreamGroup] = members
 	}
 
 	// Retain legacy single worker URL for backward compatibility/access
@@ -74,6 +236,25 @@ func LoadConfig() *Config {
 	return cfg
 }
 
+// Validate reports configuration that cannot work. A client token without its own keys
+// falls back to UPSTREAM_API_KEYS, so that pool must not be empty; the client's token is
+// stripped from its requests, which would otherwise reach the upstream unauthenticated.
+func (c *Config) Validate() error {
+	if len(c.UpstreamAPIKeys) > 0 {
+		return nil
+	}
+	var keyless []string
+	for _, token := range c.ClientTokens {
+		if token.Enabled && len(token.Keys) == 0 {
+			keyless = append(keyless, token.Name)
+		}
+	}
+	if len(keyless) > 0 {
+		return fmt.Errorf("CLIENT_TOKENS entries without keys (%s) need UPSTREAM_API_KEYS to be set", strings.Join(keyless, ", "))
+	}
+	return nil
+}
+
 func getEnvString(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -116,6 +297,314 @@ func getEnvStringSlice(key string, defaultValue []string) []string {
 	return defaultValue
 }
 
+// RetryPolicyFor returns the policy for an interruption reason. HTTP status reasons such
+// as "HTTP_503" fall back to "HTTP_5XX" before the default policy.
+func (c *Config) RetryPolicyFor(reason string) RetryPolicy {
+	if policy, ok := c.RetryPolicies[reason]; ok {
+		return policy
+	}
+	if strings.HasPrefix(reason, "HTTP_") && len(reason) == len("HTTP_503") {
+		if policy, ok := c.RetryPolicies[reason[:len("HTTP_5")]+"XX"]; ok {
+			return policy
+		}
+	}
+	return c.DefaultRetryPolicy
+}
+
+// defaultRetryPolicies resumes dropped and stalled streams immediately and backs off
+// exponentially on upstream 5xx responses and connection failures.
+func defaultRetryPolicies(base RetryPolicy) map[string]RetryPolicy {
+	backoff := base
+	backoff.Multiplier = 2
+	backoff.Jitter = 0.2
+	backoff.MaxDelay = 30 * time.Second
+
+	instant := base
+	instant.BaseDelay = 0
+
+	return map[string]RetryPolicy{
+		"DROP":          instant,
+		"STALL":         instant,
+		"HTTP_5XX":      backoff,
+		"NETWORK_ERROR": backoff,
+		// A 429 is only retried after rotating to another pool key, which can go at once.
+		"HTTP_429": instant,
+	}
+}
+
+// parseRetryPolicies applies RETRY_POLICIES overrides of the form
+// "DROP=attempts:50,delay:0;HTTP_503=delay:1000,multiplier:2,jitter:0.2,max:30000".
+// Entries are separated by semicolons or newlines; delays are in milliseconds.
+// Fields that are not given keep the reason's built-in (or the default) values.
+func parseRetryPolicies(raw string, base RetryPolicy, policies map[string]RetryPolicy) {
+	entries := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		reason, spec, ok := strings.Cut(entry, "=")
+		reason = strings.ToUpper(strings.TrimSpace(reason))
+		if !ok || reason == "" {
+			continue
+		}
+		policy, exists := policies[reason]
+		if !exists {
+			policy = base
+		}
+		for _, field := range strings.Split(spec, ",") {
+			key, value, ok := strings.Cut(field, ":")
+			if !ok {
+				continue
+			}
+			key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+			switch key {
+			case "attempts":
+				if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+					policy.MaxAttempts = n
+				}
+			case "delay":
+				if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+					policy.BaseDelay = time.Duration(n) * time.Millisecond
+				}
+			case "multiplier":
+				if f, err := strconv.ParseFloat(value, 64); err == nil && f >= 1 {
+					policy.Multiplier = f
+				}
+			case "jitter":
+				if f, err := strconv.ParseFloat(value, 64); err == nil && f >= 0 && f <= 1 {
+					policy.Jitter = f
+				}
+			case "max":
+				if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+					policy.MaxDelay = time.Duration(n) * time.Millisecond
+				}
+			}
+		}
+		policies[reason] = policy
+	}
+}
+
+// BlockPolicyFor returns the policy for a block category. Prompt-level categories such
+// as "PROMPT_SAFETY" fall back to "PROMPT", and every category falls back to "*".
+func (c *Config) BlockPolicyFor(category string) BlockPolicy {
+	if policy, ok := c.BlockPolicies[category]; ok {
+		return policy
+	}
+	if strings.HasPrefix(category, "PROMPT_") {
+		if policy, ok := c.BlockPolicies["PROMPT"]; ok {
+			return policy
+		}
+	}
+	return c.BlockPolicies["*"]
+}
+
+// defaultBlockPolicies fails fast on blocked prompts and on categories that do not change
+// between attempts, and retries the response-level SAFETY and RECITATION blocks a few times.
+func defaultBlockPolicies() map[string]BlockPolicy {
+	fail := BlockPolicy{Action: BlockActionFail}
+	retry := BlockPolicy{Action: BlockActionRetry, Retries: 3}
+
+	return map[string]BlockPolicy{
+		"PROMPT":             fail,
+		"PROHIBITED_CONTENT": fail,
+		"BLOCKLIST":          fail,
+		"SPII":               fail,
+		"SAFETY":             retry,
+		"RECITATION":         retry,
+		"*":                  retry,
+	}
+}
+
+// parseBlockPolicies applies BLOCK_POLICIES overrides of the form
+// "PROMPT=pass;SAFETY=retry:5;RECITATION=fail;*=fail". Entries are separated by
+// semicolons or newlines; "retry" without a count retries 3 times.
+func parseBlockPolicies(raw string, policies map[string]BlockPolicy) {
+	entries := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		category, spec, ok := strings.Cut(entry, "=")
+		category = strings.ToUpper(strings.TrimSpace(category))
+		if !ok || category == "" {
+			continue
+		}
+		action, count, hasCount := strings.Cut(strings.TrimSpace(spec), ":")
+		policy := BlockPolicy{Action: strings.ToLower(strings.TrimSpace(action))}
+		switch policy.Action {
+		case BlockActionFail, BlockActionPass:
+		case BlockActionRetry:
+			policy.Retries = 3
+			if hasCount {
+				n, err := strconv.Atoi(strings.TrimSpace(count))
+				if err != nil || n < 0 {
+					continue
+				}
+				policy.Retries = n
+			}
+		default:
+			continue
+		}
+		policies[category] = policy
+	}
+}
+
+// parseUpstreamGroups parses UPSTREAM_GROUPS entries of the form
+// "workers=https://a.example/t/gemini|3,https://b.example/t/gemini;official=https://generativelanguage.googleapis.com".
+// Entries are separated by semicolons or newlines and members by commas; "|N" gives a
+// member weight N (default 1). A group named "default" replaces the flat upstream list.
+func parseUpstreamGroups(raw string) map[string][]UpstreamMember {
+	groups := make(map[string][]UpstreamMember)
+	entries := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		name, spec, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			continue
+		}
+		var members []UpstreamMember
+		for _, field := range strings.Split(spec, ",") {
+			base, weightRaw, hasWeight := strings.Cut(strings.TrimSpace(field), "|")
+			base = strings.TrimRight(strings.TrimSpace(base), "/")
+			if base == "" {
+				continue
+			}
+			weight := 1
+			if hasWeight {
+				if n, err := strconv.Atoi(strings.TrimSpace(weightRaw)); err == nil && n > 0 {
+					weight = n
+				}
+			}
+			members = append(members, UpstreamMember{Base: base, Weight: weight})
+		}
+		if len(members) > 0 {
+			groups[name] = members
+		}
+	}
+	return groups
+}
+
+// parseClientTokens parses CLIENT_TOKENS entries of the form
+// "alice=token:tok-alice,keys:AIza...1|AIza...2,expires:2026-12-31;bob=token:tok-bob,enabled:false".
+// Entries are separated by semicolons or newlines. keys lists the client's upstream keys
+// separated by "|"; expires is an RFC 3339 time or a date, valid through the end of that
+// day (UTC). Entries without a token are skipped.
+func parseClientTokens(raw string) []ClientToken {
+	var tokens []ClientToken
+	entries := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		name, spec, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			continue
+		}
+		token := ClientToken{Name: name, Enabled: true}
+		for _, field := range strings.Split(spec, ",") {
+			key, value, ok := strings.Cut(field, ":")
+			if !ok {
+				continue
+			}
+			key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+			switch key {
+			case "token":
+				token.Token = value
+			case "keys":
+				for _, k := range strings.Split(value, "|") {
+					if k = strings.TrimSpace(k); k != "" {
+						token.Keys = append(token.Keys, k)
+					}
+				}
+			case "enabled":
+				if b, err := strconv.ParseBool(value); err == nil {
+					token.Enabled = b
+				}
+			case "expires":
+				if t, err := time.Parse(time.RFC3339, value); err == nil {
+					token.Expires = t
+				} else if d, err := time.Parse("2006-01-02", value); err == nil {
+					token.Expires = d.Add(24 * time.Hour)
+				}
+			}
+		}
+		if token.Token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// UpstreamGroupFor returns the upstream group a request is routed to. Rules whose key
+// starts with "/" are path patterns, matched in order against the request path with
+// path.Match (e.g. "/v1beta/models/*:embedContent") and taking precedence; other rules
+// match the model identifier by longest prefix. Without a match the default group is used.
+func (c *Config) UpstreamGroupFor(model, requestPath string) string {
+	var modelRules []PrefixRule
+	for _, rule := range c.UpstreamRoutes {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			modelRules = append(modelRules, rule)
+			continue
+		}
+		if matched, _ := path.Match(rule.Prefix, requestPath); matched {
+			return rule.Value
+		}
+	}
+	if group, ok := MatchPrefixRule(modelRules, model); ok {
+		return group
+	}
+	return DefaultUpstreamGroup
+}
+
+// getEnvPrefixRules parses "prefix=value" pairs separated by commas, semicolons or newlines.
+func getEnvPrefixRules(key string) []PrefixRule {
+	var rules []PrefixRule
+	for _, item := range getEnvStringSliceFlexible(os.Getenv(key)) {
+		prefix, value, ok := strings.Cut(item, "=")
+		prefix, value = strings.TrimSpace(prefix), strings.TrimSpace(value)
+		if !ok || prefix == "" || value == "" {
+			continue
+		}
+		rules = append(rules, PrefixRule{Prefix: prefix, Value: value})
+	}
+	return rules
+}
+
+// getEnvTemplateRules parses "prefix=template" pairs, one per line. Unlike
+// getEnvPrefixRules it does not split on commas or semicolons, which templates may contain.
+func getEnvTemplateRules(key string) []PrefixRule {
+	var rules []PrefixRule
+	for _, line := range strings.Split(os.Getenv(key), "\n") {
+		prefix, value, ok := strings.Cut(line, "=")
+		prefix, value = strings.TrimSpace(prefix), strings.TrimSpace(value)
+		if !ok || prefix == "" || value == "" {
+			continue
+		}
+		rules = append(rules, PrefixRule{Prefix: prefix, Value: value})
+	}
+	return rules
+}
+
+// MatchPrefixRule returns the value of the longest rule prefix matching the model.
+// A rule with prefix "*" matches any model with the lowest priority.
+func MatchPrefixRule(rules []PrefixRule, model string) (string, bool) {
+	best := -1
+	value := ""
+	for _, rule := range rules {
+		length := len(rule.Prefix)
+		if rule.Prefix == "*" {
+			length = 0
+		} else if model == "" || !strings.HasPrefix(model, rule.Prefix) {
+			continue
+		}
+		if length > best {
+			best = length
+			value = rule.Value
+		}
+	}
+	return value, best >= 0
+}
+
 func buildSpectreUpstream(worker, token string) string {
 	worker = strings.TrimSuffix(worker, "/")
 	token = strings.Trim(token, "/")
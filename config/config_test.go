@@ -0,0 +1,157 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBlockPolicyFor(t *testing.T) {
+	fail := BlockPolicy{Action: BlockActionFail}
+	pass := BlockPolicy{Action: BlockActionPass}
+	retry := BlockPolicy{Action: BlockActionRetry, Retries: 3}
+
+	tests := []struct {
+		name     string
+		raw      string
+		category string
+		want     BlockPolicy
+	}{
+		{"default for a listed category", "", "PROHIBITED_CONTENT", fail},
+		{"default wildcard", "", "IMAGE_SAFETY", retry},
+		{"prompt category falls back to PROMPT", "", "PROMPT_SAFETY", fail},
+		{"exact prompt category wins over PROMPT", "PROMPT_OTHER=pass", "PROMPT_OTHER", pass},
+		{"override with a retry count", "SAFETY=retry:5", "SAFETY", BlockPolicy{Action: BlockActionRetry, Retries: 5}},
+		{"overridden wildcard", "*=pass", "IMAGE_SAFETY", pass},
+		{"lowercase category and spacing", " safety = fail ", "SAFETY", fail},
+		{"unknown action is ignored", "SAFETY=ignore", "SAFETY", retry},
+		{"invalid retry count is ignored", "RECITATION=retry:-1", "RECITATION", retry},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{BlockPolicies: defaultBlockPolicies()}
+			parseBlockPolicies(tt.raw, cfg.BlockPolicies)
+			if got := cfg.BlockPolicyFor(tt.category); got != tt.want {
+				t.Errorf("BlockPolicyFor(%q) = %+v; want %+v", tt.category, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockPolicyForWithoutFallbacks(t *testing.T) {
+	cfg := &Config{BlockPolicies: map[string]BlockPolicy{"SAFETY": {Action: BlockActionPass}}}
+	if got := cfg.BlockPolicyFor("PROMPT_SAFETY"); !reflect.DeepEqual(got, BlockPolicy{}) {
+		t.Errorf("BlockPolicyFor(PROMPT_SAFETY) = %+v; want the zero policy", got)
+	}
+}
+
+func TestParseUpstreamGroups(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want map[string][]UpstreamMember
+	}{
+		{"empty", "", map[string][]UpstreamMember{}},
+		{
+			name: "weights and trailing slashes",
+			raw:  "workers=https://a.example/t/gemini|3, https://b.example/t/gemini/ ;official=https://generativelanguage.googleapis.com",
+			want: map[string][]UpstreamMember{
+				"workers":  {{Base: "https://a.example/t/gemini", Weight: 3}, {Base: "https://b.example/t/gemini", Weight: 1}},
+				"official": {{Base: "https://generativelanguage.googleapis.com", Weight: 1}},
+			},
+		},
+		{
+			name: "newline separated",
+			raw:  "a=https://a.example\nb=https://b.example|2",
+			want: map[string][]UpstreamMember{
+				"a": {{Base: "https://a.example", Weight: 1}},
+				"b": {{Base: "https://b.example", Weight: 2}},
+			},
+		},
+		{
+			name: "invalid weights fall back to 1",
+			raw:  "g=https://a.example|0,https://b.example|-2,https://c.example|heavy",
+			want: map[string][]UpstreamMember{
+				"g": {{Base: "https://a.example", Weight: 1}, {Base: "https://b.example", Weight: 1}, {Base: "https://c.example", Weight: 1}},
+			},
+		},
+		{
+			name: "malformed entries are skipped",
+			raw:  "no-equals-sign;=https://nameless.example;empty=;blank= , |3;ok=https://ok.example",
+			want: map[string][]UpstreamMember{
+				"ok": {{Base: "https://ok.example", Weight: 1}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUpstreamGroups(tt.raw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUpstreamGroups() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamGroupFor(t *testing.T) {
+	t.Setenv("UPSTREAM_ROUTES", "gemini-2.5=workers;gemini-2.5-flash=fast;/v1beta/models/*:embedContent=embeddings;/v1beta/models/gemini-2.5-pro:countTokens=official;broken=")
+	cfg := &Config{UpstreamRoutes: getEnvPrefixRules("UPSTREAM_ROUTES")}
+
+	tests := []struct {
+		name  string
+		model string
+		path  string
+		want  string
+	}{
+		{"no match", "gemini-1.5-pro", "/v1beta/models/gemini-1.5-pro:streamGenerateContent", DefaultUpstreamGroup},
+		{"model prefix", "gemini-2.5-pro", "/v1beta/models/gemini-2.5-pro:streamGenerateContent", "workers"},
+		{"longest model prefix", "gemini-2.5-flash-lite", "/v1beta/models/gemini-2.5-flash-lite:generateContent", "fast"},
+		{"path pattern", "text-embedding-004", "/v1beta/models/text-embedding-004:embedContent", "embeddings"},
+		{"path pattern wins over a model prefix", "gemini-2.5-pro", "/v1beta/models/gemini-2.5-pro:countTokens", "official"},
+		{"rule without a group is skipped", "broken-model", "/v1beta/models/broken-model:generateContent", DefaultUpstreamGroup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.UpstreamGroupFor(tt.model, tt.path); got != tt.want {
+				t.Errorf("UpstreamGroupFor(%q, %q) = %q; want %q", tt.model, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseClientTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []ClientToken
+	}{
+		{"empty", "", nil},
+		{
+			name: "keys, enabled and expiry",
+			raw:  "alice=token:tok-alice,keys:key-1| key-2 ,expires:2026-12-31;bob=token:tok-bob,enabled:false,expires:2026-06-01T12:00:00Z",
+			want: []ClientToken{
+				{Name: "alice", Token: "tok-alice", Keys: []string{"key-1", "key-2"}, Enabled: true, Expires: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+				{Name: "bob", Token: "tok-bob", Enabled: false, Expires: time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name: "invalid values are ignored",
+			raw:  "carol=token:tok-carol,enabled:maybe,expires:someday,unknown:x",
+			want: []ClientToken{{Name: "carol", Token: "tok-carol", Enabled: true}},
+		},
+		{
+			name: "entries without a name or token are skipped",
+			raw:  "=token:nameless\nnotoken=keys:key-1\ndave = token : tok-dave ",
+			want: []ClientToken{{Name: "dave", Token: "tok-dave", Enabled: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseClientTokens(tt.raw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseClientTokens() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
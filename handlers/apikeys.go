@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"gemini-antiblock/apikeys"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+)
+
+// ctxKeyClient carries the client identity used for sticky key selection.
+const ctxKeyClient contextKey = "gemini-client"
+
+// clientIdentity identifies the caller for sticky key selection: the credential it
+// sent, or its address when it sent none.
+func clientIdentity(r *http.Request) string {
+	if key := r.Header.Get("X-Goog-Api-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return auth
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		return key
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host := r.RemoteAddr
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	return host
+}
+
+// sendUpstream sends an upstream request. When the request has a key pool, it is sent
+// with a pool key instead of the client's credentials, and a quota error cools that
+// key down and resends the request with the next available key. It returns the
+// response of the last attempt and the headers it was sent with.
+func (h *ProxyHandler) sendUpstream(ctx context.Context, r *http.Request, method, upstreamURL string, body []byte, headers http.Header) (*http.Response, http.Header, error) {
+	client := clientIdentityFrom(r)
+	keys := h.keyPool(r)
+	if keys != nil {
+		headers = apikeys.WithKey(headers, keys.Acquire(client))
+	}
+
+	for attempt := 1; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		upstreamReq, err := http.NewRequestWithContext(ctx, method, upstreamURL, reader)
+		if err != nil {
+			return nil, headers, err
+		}
+		upstreamReq.Header = headers
+		if keys != nil {
+			if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
+				metrics.RecordAPIKey(rid, apikeys.Mask(headers.Get("X-Goog-Api-Key")))
+			}
+		}
+
+		resp, err := h.Clients.For(upstreamURL).Do(upstreamReq)
+		if err != nil || keys == nil || resp.StatusCode == http.StatusOK {
+			return resp, headers, err
+		}
+
+		errorBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(errorBody))
+		exceeded, retryAfter := apikeys.QuotaExceeded(resp.StatusCode, resp.Header, errorBody)
+		if !exceeded {
+			return resp, headers, nil
+		}
+		next, ok := keys.Rotate(headers.Get("X-Goog-Api-Key"), client, retryAfter)
+		if !ok || attempt >= keys.Size() {
+			logger.LogError("Every upstream API key is out of quota; returning the quota error")
+			return resp, headers, nil
+		}
+		headers = apikeys.WithKey(headers, next)
+	}
+}
+
+// clientIdentityFrom returns the identity ServeHTTP recorded for the request.
+func clientIdentityFrom(r *http.Request) string {
+	if client, ok := r.Context().Value(ctxKeyClient).(string); ok {
+		return client
+	}
+	return clientIdentity(r)
+}
+
+// stripClientKey removes the client's "key" query parameter, which would otherwise
+// reach the upstream alongside the pool key.
+func stripClientKey(r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("key") == "" {
+		return
+	}
+	query.Del("key")
+	r.URL.RawQuery = query.Encode()
+}
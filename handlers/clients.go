@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gemini-antiblock/apikeys"
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// ctxKeyAccount carries the client account a request authenticated as.
+const ctxKeyAccount contextKey = "gemini-client-account"
+
+// clientAccount is a proxy-issued client token together with the upstream key pool
+// its requests use, or nil to use the shared pool.
+type clientAccount struct {
+	config.ClientToken
+	keys *apikeys.Pool
+}
+
+// newClientAccounts indexes the configured client tokens by token.
+func newClientAccounts(cfg *config.Config) map[string]*clientAccount {
+	accounts := make(map[string]*clientAccount, len(cfg.ClientTokens))
+	for _, token := range cfg.ClientTokens {
+		if existing, ok := accounts[token.Token]; ok {
+			logger.LogError(fmt.Sprintf("Client %q reuses the token of client %q; ignoring it", token.Name, existing.Name))
+			continue
+		}
+		accounts[token.Token] = &clientAccount{
+			ClientToken: token,
+			keys:        apikeys.NewPool(token.Keys, cfg.UpstreamAPIKeyStrategy, cfg.UpstreamAPIKeyCooldown),
+		}
+	}
+	return accounts
+}
+
+// requestCredential returns the credential the client sent, looked up where Gemini
+// clients send their API key: X-Goog-Api-Key, a bearer token or the key query parameter.
+func requestCredential(r *http.Request) string {
+	if key := r.Header.Get("X-Goog-Api-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("key")
+}
+
+// rateLimitKey identifies the caller a request is rate limited as: its client account
+// when it authenticated with a client token, otherwise the credential it sent in any of
+// the forms requestCredential accepts. Requests without a credential are not limited.
+func rateLimitKey(r *http.Request, account *clientAccount) string {
+	if account != nil {
+		return "client:" + account.Name
+	}
+	return requestCredential(r)
+}
+
+// authenticate checks the client token of a request when client tokens are configured.
+// It returns the client's account, or nil when tokens are not in use. A missing,
+// unknown or expired token is answered with 401 and a disabled one with 403, in
+// which case ok is false.
+func (h *ProxyHandler) authenticate(w http.ResponseWriter, r *http.Request) (account *clientAccount, ok bool) {
+	if len(h.accounts) == 0 {
+		return nil, true
+	}
+
+	credential := requestCredential(r)
+	if credential == "" {
+		JSONError(w, http.StatusUnauthorized, "Missing client token", "Send the proxy-issued token as X-Goog-Api-Key, a bearer token or the key query parameter")
+		return nil, false
+	}
+	account, known := h.accounts[credential]
+	if !known {
+		logger.LogError("Rejected request with an unknown client token ending with:", apikeys.Mask(credential))
+		JSONError(w, http.StatusUnauthorized, "Invalid client token", nil)
+		return nil, false
+	}
+	if !account.Enabled {
+		logger.LogError(fmt.Sprintf("Rejected request from disabled client %q", account.Name))
+		JSONError(w, http.StatusForbidden, "Client token is disabled", nil)
+		return nil, false
+	}
+	if !account.Expires.IsZero() && time.Now().After(account.Expires) {
+		logger.LogError(fmt.Sprintf("Rejected request from client %q; token expired at %s", account.Name, account.Expires.Format(time.RFC3339)))
+		JSONError(w, http.StatusUnauthorized, "Client token has expired", nil)
+		return nil, false
+	}
+	return account, true
+}
+
+// dropClientCredentials removes the client token from a request so it never reaches
+// the upstream.
+func dropClientCredentials(r *http.Request) {
+	r.Header.Del("X-Goog-Api-Key")
+	r.Header.Del("Authorization")
+	stripClientKey(r)
+}
+
+// keyPool returns the upstream key pool for a request: the keys of its client token
+// when the token has any, otherwise the shared pool.
+func (h *ProxyHandler) keyPool(r *http.Request) *apikeys.Pool {
+	if account, ok := r.Context().Value(ctxKeyAccount).(*clientAccount); ok && account != nil && account.keys != nil {
+		return account.keys
+	}
+	return h.Keys
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gemini-antiblock/apikeys"
+	"gemini-antiblock/config"
+)
+
+// newTokenHandler returns a handler with a shared upstream key pool and the given
+// client tokens.
+func newTokenHandler(tokens ...config.ClientToken) *ProxyHandler {
+	cfg := &config.Config{
+		ClientTokens:           tokens,
+		UpstreamAPIKeys:        []string{"shared-key"},
+		UpstreamAPIKeyStrategy: apikeys.StrategyRoundRobin,
+		UpstreamAPIKeyCooldown: time.Minute,
+	}
+	return &ProxyHandler{
+		Config:   cfg,
+		Keys:     apikeys.NewPool(cfg.UpstreamAPIKeys, cfg.UpstreamAPIKeyStrategy, cfg.UpstreamAPIKeyCooldown),
+		accounts: newClientAccounts(cfg),
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := newTokenHandler(
+		config.ClientToken{Name: "alice", Token: "tok-alice", Enabled: true},
+		config.ClientToken{Name: "bob", Token: "tok-bob", Keys: []string{"bob-key"}, Enabled: true},
+		config.ClientToken{Name: "carol", Token: "tok-carol", Enabled: false},
+		config.ClientToken{Name: "dave", Token: "tok-dave", Enabled: true, Expires: time.Now().Add(-time.Hour)},
+	)
+	const path = "/v1beta/models/gemini-2.5-pro:streamGenerateContent"
+
+	tests := []struct {
+		name        string
+		target      string
+		header      string
+		value       string
+		wantAccount string
+		wantStatus  int
+	}{
+		{name: "X-Goog-Api-Key header", target: path, header: "X-Goog-Api-Key", value: "tok-alice", wantAccount: "alice"},
+		{name: "bearer token", target: path, header: "Authorization", value: "Bearer tok-bob", wantAccount: "bob"},
+		{name: "key query parameter", target: path + "?alt=sse&key=tok-alice", wantAccount: "alice"},
+		{name: "missing token", target: path, wantStatus: http.StatusUnauthorized},
+		{name: "non-bearer authorization", target: path, header: "Authorization", value: "Basic tok-alice", wantStatus: http.StatusUnauthorized},
+		{name: "unknown token", target: path, header: "X-Goog-Api-Key", value: "tok-mallory", wantStatus: http.StatusUnauthorized},
+		{name: "disabled token", target: path, header: "X-Goog-Api-Key", value: "tok-carol", wantStatus: http.StatusForbidden},
+		{name: "expired token", target: path, header: "X-Goog-Api-Key", value: "tok-dave", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+
+			account, ok := h.authenticate(w, r)
+			if tt.wantStatus != 0 {
+				if ok || account != nil {
+					t.Fatalf("authenticate() accepted the request as %+v", account)
+				}
+				if w.Code != tt.wantStatus {
+					t.Errorf("status = %d; want %d", w.Code, tt.wantStatus)
+				}
+				return
+			}
+			if !ok || account == nil || account.Name != tt.wantAccount {
+				t.Fatalf("authenticate() = %+v, %v; want %s", account, ok, tt.wantAccount)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithoutTokens(t *testing.T) {
+	h := newTokenHandler()
+	r := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	if account, ok := h.authenticate(httptest.NewRecorder(), r); account != nil || !ok {
+		t.Errorf("authenticate() = %+v, %v; want nil, true", account, ok)
+	}
+}
+
+func TestKeyPool(t *testing.T) {
+	h := newTokenHandler(
+		config.ClientToken{Name: "alice", Token: "tok-alice", Enabled: true},
+		config.ClientToken{Name: "bob", Token: "tok-bob", Keys: []string{"bob-key"}, Enabled: true},
+	)
+
+	tests := []struct {
+		name    string
+		account *clientAccount
+		wantKey string
+	}{
+		{"keyless token draws from the shared pool", h.accounts["tok-alice"], "shared-key"},
+		{"token with its own keys", h.accounts["tok-bob"], "bob-key"},
+		{"no token", nil, "shared-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyAccount, tt.account))
+			if got := h.keyPool(r).Acquire(""); got != tt.wantKey {
+				t.Errorf("keyPool().Acquire() = %q; want %q", got, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	alice := &clientAccount{ClientToken: config.ClientToken{Name: "alice", Token: "tok-alice"}}
+
+	tests := []struct {
+		name    string
+		target  string
+		header  string
+		value   string
+		account *clientAccount
+		want    string
+	}{
+		{name: "authenticated client", target: "/v1beta/models?key=tok-alice", account: alice, want: "client:alice"},
+		{name: "X-Goog-Api-Key header", target: "/v1beta/models", header: "X-Goog-Api-Key", value: "AIza-header", want: "AIza-header"},
+		{name: "bearer token", target: "/v1beta/models", header: "Authorization", value: "Bearer AIza-bearer", want: "AIza-bearer"},
+		{name: "key query parameter", target: "/v1beta/models?key=AIza-query", want: "AIza-query"},
+		{name: "anonymous", target: "/v1beta/models"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if got := rateLimitKey(r, tt.account); got != tt.want {
+				t.Errorf("rateLimitKey() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
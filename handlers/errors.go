@@ -64,6 +64,6 @@ func JSONError(w http.ResponseWriter, status int, message string, details interf
 func HandleCORS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Goog-Api-Key")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Goog-Api-Key, X-Antiblock-Enable, X-Antiblock-Max-Retries, X-Antiblock-Swallow-Thoughts, X-Antiblock-Heuristics, X-Antiblock-Events")
 	w.WriteHeader(http.StatusOK)
 }
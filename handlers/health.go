@@ -6,34 +6,76 @@ import (
 	"time"
 
 	"gemini-antiblock/logger"
+	"gemini-antiblock/upstream"
 )
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
-	Service   string    `json:"service"`
-	Version   string    `json:"version,omitempty"`
+	Status    string            `json:"status"`
+	Timestamp time.Time         `json:"timestamp"`
+	Service   string            `json:"service"`
+	Version   string            `json:"version,omitempty"`
+	Upstreams []upstream.Status `json:"upstreams,omitempty"`
 }
 
-// HealthHandler handles health check requests
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	logger.LogDebug("Health check endpoint accessed")
+// healthReport builds the health response from the upstream pool. The proxy reports
+// "degraded" while any upstream's circuit breaker is open and "unhealthy" once all of
+// them are; ready is false in the latter case.
+func (h *ProxyHandler) healthReport() (response HealthResponse, ready bool) {
+	upstreams := h.Upstreams.Snapshot()
+	open := 0
+	for _, u := range upstreams {
+		if u.State == upstream.StateOpen {
+			open++
+		}
+	}
+	status, ready := "healthy", true
+	switch {
+	case open > 0 && open == len(upstreams):
+		status, ready = "unhealthy", false
+	case open > 0:
+		status = "degraded"
+	}
 
-	response := HealthResponse{
-		Status:    "healthy",
+	return HealthResponse{
+		Status:    status,
 		Timestamp: time.Now().UTC(),
 		Service:   "gemini-antiblock-proxy",
 		Version:   "0.2.0",
+		Upstreams: upstreams,
+	}, ready
+}
+
+// HealthHandler handles liveness checks. It answers 200 as long as the proxy is running,
+// with the upstream pool state in the body, so open circuit breakers never get the
+// process restarted.
+func (h *ProxyHandler) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	logger.LogDebug("Health check endpoint accessed")
+
+	response, _ := h.healthReport()
+	writeHealthResponse(w, http.StatusOK, response)
+}
+
+// ReadyHandler handles readiness checks. It answers 503 while every upstream's circuit
+// breaker is open, so load balancers can route around the proxy until one recovers.
+func (h *ProxyHandler) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	logger.LogDebug("Readiness check endpoint accessed")
+
+	response, ready := h.healthReport()
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
 	}
+	writeHealthResponse(w, code, response)
+}
 
+func writeHealthResponse(w http.ResponseWriter, code int, response HealthResponse) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(code)
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		logger.LogError("Failed to encode health response:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
@@ -5,15 +5,46 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
+	"gemini-antiblock/apikeys"
 	"gemini-antiblock/logger"
 	"gemini-antiblock/metrics"
+	"gemini-antiblock/upstream"
 )
 
+// logsSnapshot is the polling payload of the logs UI: the metrics snapshot plus the
+// state of the upstream pool and the upstream API key pool.
+type logsSnapshot struct {
+	metrics.Snapshot
+	Upstreams []upstream.Status `json:"upstreams"`
+	Keys      []apikeys.Status  `json:"keys"`
+}
+
+// keySnapshot lists the shared key pool followed by the keys of each client token,
+// ordered by client name.
+func (h *ProxyHandler) keySnapshot() []apikeys.Status {
+	keys := h.Keys.Snapshot()
+	accounts := make([]*clientAccount, 0, len(h.accounts))
+	for _, account := range h.accounts {
+		if account.keys != nil {
+			accounts = append(accounts, account)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	for _, account := range accounts {
+		for _, status := range account.keys.Snapshot() {
+			status.Owner = account.Name
+			keys = append(keys, status)
+		}
+	}
+	return keys
+}
+
 // LogsJSONHandler returns the current snapshot for UI polling.
-func LogsJSONHandler(w http.ResponseWriter, r *http.Request) {
+func (h *ProxyHandler) LogsJSONHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -30,7 +61,7 @@ func LogsJSONHandler(w http.ResponseWriter, r *http.Request) {
 	_ = snap
 	// Use json.NewEncoder to avoid extra allocations
 	// Ensure no caching
-	if err := json.NewEncoder(w).Encode(snap); err != nil {
+	if err := json.NewEncoder(w).Encode(logsSnapshot{Snapshot: snap, Upstreams: h.Upstreams.Snapshot(), Keys: h.keySnapshot()}); err != nil {
 		http.Error(w, "Failed to encode snapshot", http.StatusInternalServerError)
 		return
 	}
@@ -127,6 +158,8 @@ tbody tr:hover{background:rgba(59,130,246,.14)}
 .status.ok .dot{background:#10b981}
 .status.fail .dot{background:#ef4444}
 .status.pending .dot{background:#f59e0b}
+.status.cancelled .dot{background:#94a3b8}
+.status.half .dot{background:#f59e0b}
 .pill{display:inline-block;padding:4px 10px;border-radius:999px;background:rgba(59,130,246,.18);color:#bfdbfe;font-weight:600;font-size:11px}
 .badge{display:inline-flex;align-items:center;padding:2px 8px;border-radius:999px;border:1px solid rgba(148,163,184,.2);min-width:38px;justify-content:center;font-size:11px}
 .badge.yes{color:#4ade80;border-color:rgba(74,222,128,.4)}
@@ -169,8 +202,57 @@ tbody tr:hover{background:rgba(59,130,246,.14)}
     <div class="card"><div class="num" id="success">-</div><div class="label">成功次数</div></div>
     <div class="card"><div class="num" id="errors">-</div><div class="label">失败次数</div></div>
     <div class="card"><div class="num" id="retries">-</div><div class="label">触发重试</div></div>
+    <div class="card"><div class="num" id="cancelled">-</div><div class="label">客户端取消</div></div>
     <div class="card"><div class="num" id="successRate">-</div><div class="label">成功率</div></div>
   </section>
+  <section class="card table-card">
+    <div class="table-header">
+      <span>上游节点</span>
+      <span class="refresh-tip">熔断后冷却期内不再分配请求，冷却结束后半开试探</span>
+    </div>
+    <div class="table-wrap">
+      <table>
+        <thead>
+          <tr>
+            <th>#</th>
+            <th>上游</th>
+            <th>分组</th>
+            <th>熔断状态</th>
+            <th>成功</th>
+            <th>失败</th>
+            <th>连续失败</th>
+            <th>最近延迟 (ms)</th>
+            <th>最近失败</th>
+            <th>最近探测</th>
+          </tr>
+        </thead>
+        <tbody id="upstream-rows"></tbody>
+      </table>
+    </div>
+  </section>
+  <section class="card table-card" id="key-section" style="display:none">
+    <div class="table-header">
+      <span>上游 API 密钥</span>
+      <span class="refresh-tip">配额耗尽的密钥冷却期内不再分配，请求自动轮换到其他密钥</span>
+    </div>
+    <div class="table-wrap">
+      <table>
+        <thead>
+          <tr>
+            <th>#</th>
+            <th>密钥</th>
+            <th>所属</th>
+            <th>状态</th>
+            <th>使用次数</th>
+            <th>配额错误</th>
+            <th>最近使用</th>
+            <th>冷却至</th>
+          </tr>
+        </thead>
+        <tbody id="key-rows"></tbody>
+      </table>
+    </div>
+  </section>
   <section class="card table-card">
     <div class="table-header">
       <span>最近 200 条请求记录</span>
@@ -212,6 +294,9 @@ tbody tr:hover{background:rgba(59,130,246,.14)}
 <script>
 const $ = sel => document.querySelector(sel);
 const rows = $('#rows');
+const upstreamRows = $('#upstream-rows');
+const keySection = $('#key-section');
+const keyRows = $('#key-rows');
 const emptyState = $('#empty-state');
 const indicator = $('#sse-indicator');
 const refreshTip = $('#refresh-tip');
@@ -263,6 +348,7 @@ const statusReasons = {
   '403': '权限不足或来源受限：该密钥无权访问目标模型，或访问来源不在白名单',
   '404': '找不到资源：请核对接口路径、模型名称与版本是否正确',
   '429': '请求过多或配额已用尽：请稍后重试，或切换到可用额度的密钥',
+  '499': '客户端已断开：下游在响应完成前取消了请求，代理已停止上游请求与重试',
   '500': '上游服务内部错误：可稍后重试，必要时关注 Google Gemini 服务状态',
   '502': '网关错误：代理或网络链路异常，请重试或检查 Spectre 节点',
   '503': '服务暂不可用：上游负载过高或维护中，请稍后重试',
@@ -390,6 +476,9 @@ const buildResultCell = (entry) => {
   if (entry.success) {
     return '<span class="status ok"><span class="dot"></span>成功</span>';
   }
+  if (entry.cancelled) {
+    return '<span class="status cancelled"><span class="dot"></span>客户端取消</span>';
+  }
 
   const cleanError = sanitizeError(entry.error) || (entry.status ? 'HTTP ' + entry.status + ' 错误' : '无更多细节');
   const encoded = encodeURIComponent(cleanError);
@@ -404,9 +493,23 @@ const buildRow = (entry) => {
   html += '<td>' + (entry.method || '<span class="muted">—</span>') + '</td>';
   const upstreamText = entry.upstreamUrl || entry.path || '';
   const safeUpstream = escapeHTML(upstreamText);
-  html += '<td class="col-path" title="' + safeUpstream + '">' + (upstreamText ? safeUpstream : '<span class="muted">—</span>') + '</td>';
+  const attempts = Array.isArray(entry.attempts) ? entry.attempts : [];
+  const upstreamTitle = attempts.length > 1
+    ? escapeHTML(attempts.map(a => '#' + a.attempt + ' ' + a.upstreamUrl + (a.reason ? ' (' + a.reason + ')' : '')).join('\n'))
+    : safeUpstream;
+  const failoverCount = new Set(attempts.map(a => a.upstreamUrl)).size;
+  const failoverTag = failoverCount > 1 ? ' <span class="muted">(' + failoverCount + ' 个上游)</span>' : '';
+  const apiKeys = Array.isArray(entry.apiKeys) ? entry.apiKeys : [];
+  const keyTag = apiKeys.length
+    ? ' <span class="muted" title="' + escapeHTML(apiKeys.join(' → ')) + '">密钥 ' + escapeHTML(apiKeys[apiKeys.length - 1]) + '</span>'
+    : '';
+  html += '<td class="col-path" title="' + upstreamTitle + '">' + (upstreamText ? safeUpstream + failoverTag + keyTag : '<span class="muted">—</span>') + '</td>';
   html += '<td>' + (entry.streaming ? '<span class="badge yes">是</span>' : '<span class="badge no">否</span>') + '</td>';
-  html += '<td>' + (entry.antiblockEnabled ? '<span class="badge yes">是</span>' : '<span class="badge no">否</span>') + '</td>';
+  const overrides = entry.overrides ? Object.entries(entry.overrides) : [];
+  const antiblockBadge = entry.antiblockEnabled ? '<span class="badge yes">是</span>' : '<span class="badge no">否</span>';
+  const overrideTag = overrides.length > 0 ? ' <span class="muted">(自定义)</span>' : '';
+  const overrideTitle = overrides.length > 0 ? ' title="' + escapeHTML(overrides.map(([k, v]) => k + '=' + v).join('\n')) + '"' : '';
+  html += '<td' + overrideTitle + '>' + antiblockBadge + overrideTag + '</td>';
   if (entry.status === undefined || entry.status === null) {
     html += '<td><span class="muted">—</span></td>';
   } else {
@@ -417,14 +520,72 @@ const buildRow = (entry) => {
       html += '<td>' + entry.status + '</td>';
     }
   }
-  html += '<td>' + (entry.retries ?? 0) + '</td>';
+  const hedgeTag = entry.hedges ? ' <span class="muted" title="对冲并行尝试次数">+' + entry.hedges + ' 对冲</span>' : '';
+  html += '<td>' + (entry.retries ?? 0) + hedgeTag + '</td>';
   html += '<td>' + (entry.durationMs ?? 0) + '</td>';
-  html += '<td class="result-cell">' + buildResultCell(entry) + '</td>';
-  html += '<td>' + (entry.clientIp || '<span class="muted">—</span>') + '</td>';
+  const blocks = Array.isArray(entry.blocks) ? entry.blocks : [];
+  const blockActions = { fail: '失败', retry: '重试', pass: '透传' };
+  const blockTag = blocks.length
+    ? ' <span class="muted" title="' + escapeHTML(blocks.map(b => b.category + ' → ' + (blockActions[b.action] || b.action)).join('\n')) + '">拦截 ' + escapeHTML(blocks[blocks.length - 1].category) + '</span>'
+    : '';
+  html += '<td class="result-cell">' + buildResultCell(entry) + blockTag + '</td>';
+  const clientName = entry.client ? '<span class="pill">' + escapeHTML(entry.client) + '</span> ' : '';
+  html += '<td>' + ((clientName + escapeHTML(entry.clientIp || '')) || '<span class="muted">—</span>') + '</td>';
   tr.innerHTML = html;
   return tr;
 };
 
+const upstreamStates = {
+  closed: ['ok', '正常'],
+  open: ['fail', '已熔断'],
+  'half-open': ['half', '半开试探'],
+};
+
+const renderUpstreams = (upstreams) => {
+  upstreamRows.innerHTML = '';
+  upstreams.forEach(u => {
+    const [cls, label] = upstreamStates[u.state] || ['pending', u.state];
+    const probe = u.lastProbe
+      ? fmtTs(u.lastProbe) + (u.probeError ? ' <span class="muted" title="' + escapeHTML(u.probeError) + '">失败</span>' : '')
+      : '<span class="muted">—</span>';
+    const tr = document.createElement('tr');
+    tr.innerHTML = '<td>' + u.index + '</td>'
+      + '<td>' + escapeHTML(u.upstream) + '</td>'
+      + '<td>' + escapeHTML((u.groups || []).join(', ')) + '</td>'
+      + '<td><span class="status ' + cls + '"><span class="dot"></span>' + label + '</span></td>'
+      + '<td>' + u.successes + '</td>'
+      + '<td>' + u.failures + '</td>'
+      + '<td>' + u.consecutiveFailures + '</td>'
+      + '<td>' + (u.lastLatencyMs || '<span class="muted">—</span>') + '</td>'
+      + '<td>' + fmtTs(u.lastFailure) + '</td>'
+      + '<td>' + probe + '</td>';
+    upstreamRows.appendChild(tr);
+  });
+};
+
+const keyStates = {
+  active: ['ok', '正常'],
+  cooling: ['half', '冷却中'],
+};
+
+const renderKeys = (keys) => {
+  keySection.style.display = keys.length ? '' : 'none';
+  keyRows.innerHTML = '';
+  keys.forEach(k => {
+    const [cls, label] = keyStates[k.state] || ['pending', k.state];
+    const tr = document.createElement('tr');
+    tr.innerHTML = '<td>' + k.index + '</td>'
+      + '<td>' + escapeHTML(k.key) + '</td>'
+      + '<td>' + (k.owner ? escapeHTML(k.owner) : '<span class="muted">共享</span>') + '</td>'
+      + '<td><span class="status ' + cls + '"><span class="dot"></span>' + label + '</span></td>'
+      + '<td>' + k.uses + '</td>'
+      + '<td>' + k.quotaErrors + '</td>'
+      + '<td>' + fmtTs(k.lastUsed) + '</td>'
+      + '<td>' + fmtTs(k.coolingUntil) + '</td>';
+    keyRows.appendChild(tr);
+  });
+};
+
 const renderSnapshot = (snapshot) => {
   latestSnapshot = snapshot;
   const stats = snapshot.stats || {};
@@ -432,11 +593,15 @@ const renderSnapshot = (snapshot) => {
   $('#success').textContent = stats.successCount ?? '-';
   $('#errors').textContent = stats.errorCount ?? '-';
   $('#retries').textContent = stats.retryCount ?? '-';
+  $('#cancelled').textContent = stats.cancelledCount ?? '-';
 
   const total = stats.totalRequests || 0;
   const success = stats.successCount || 0;
   $('#successRate').textContent = total > 0 ? fmtPercent((success / total) * 100) : '-';
 
+  renderUpstreams(snapshot.upstreams || []);
+  renderKeys(snapshot.keys || []);
+
   rows.innerHTML = '';
   const logs = snapshot.logs || [];
   const ordered = sortLogs(logs, sortState);
@@ -516,6 +681,8 @@ try {
       } else if (payload.type === 'retry') {
         showToast('有请求触发重试…');
         debounceReload();
+      } else if (payload.type === 'hedge') {
+        debounceReload();
       }
     } catch (err) {
       console.error('解析 SSE 消息失败', err);
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// Request headers that override global antiblock settings for a single request.
+const (
+	headerAntiblockEnable          = "X-Antiblock-Enable"
+	headerAntiblockMaxRetries      = "X-Antiblock-Max-Retries"
+	headerAntiblockSwallowThoughts = "X-Antiblock-Swallow-Thoughts"
+	headerAntiblockHeuristics      = "X-Antiblock-Heuristics"
+	headerAntiblockEvents          = "X-Antiblock-Events"
+)
+
+// queryAntiblockEvents is the query parameter alternative to X-Antiblock-Events. It is
+// removed from the URL before the request is forwarded upstream.
+const queryAntiblockEvents = "antiblock_events"
+
+const (
+	ctxKeyConfig         contextKey = "gemini-antiblock-config"
+	ctxKeyProgressEvents contextKey = "gemini-antiblock-progress-events"
+)
+
+// antiblockOverrides is the result of validating a request's override headers.
+type antiblockOverrides struct {
+	// cfg is the effective configuration for the request; h.Config when nothing is overridden.
+	cfg *config.Config
+	// enable forces antiblock handling on or off when set.
+	enable *bool
+	// progressEvents is set when the client opted in to antiblock progress events.
+	progressEvents bool
+	// applied lists the overrides in effect, for the request's metrics entry.
+	applied map[string]string
+}
+
+// parseAntiblockOverrides validates the X-Antiblock-* headers of a request and builds its
+// effective configuration. Malformed values are rejected; a retry limit above
+// CLIENT_MAX_RETRIES or MAX_CONSECUTIVE_RETRIES is clamped, and X-Antiblock-Enable only
+// applies to models matching ANTIBLOCK_MODEL_PREFIXES. Headers are ignored when
+// ALLOW_CLIENT_OVERRIDES is off.
+func (h *ProxyHandler) parseAntiblockOverrides(r *http.Request) (*antiblockOverrides, error) {
+	result := &antiblockOverrides{cfg: h.Config, applied: map[string]string{}}
+
+	// Progress events only add information to the stream, so they are accepted even when
+	// setting overrides are disabled.
+	events, err := progressEventsRequested(r)
+	if err != nil {
+		return nil, err
+	}
+	if events {
+		result.progressEvents = true
+		result.applied["progressEvents"] = "true"
+	}
+
+	headers := []string{headerAntiblockEnable, headerAntiblockMaxRetries, headerAntiblockSwallowThoughts, headerAntiblockHeuristics}
+
+	present := false
+	for _, name := range headers {
+		if r.Header.Get(name) != "" {
+			present = true
+		}
+	}
+	if !present {
+		return result, nil
+	}
+	if !h.Config.AllowClientOverrides {
+		logger.LogDebug("Ignoring X-Antiblock-* headers: client overrides are disabled")
+		return result, nil
+	}
+
+	cfg := *h.Config
+	result.cfg = &cfg
+
+	if value := r.Header.Get(headerAntiblockEnable); value != "" {
+		enable, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a boolean, got %q", headerAntiblockEnable, value)
+		}
+		if model := extractModelIdentifier(r.URL.Path); h.isAntiblockTarget(model) {
+			result.enable = &enable
+			result.applied["enable"] = strconv.FormatBool(enable)
+		} else {
+			logger.LogInfo(fmt.Sprintf("Ignoring %s for model %q, which does not match ANTIBLOCK_MODEL_PREFIXES", headerAntiblockEnable, model))
+		}
+	}
+
+	if value := r.Header.Get(headerAntiblockMaxRetries); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer, got %q", headerAntiblockMaxRetries, value)
+		}
+		applied := strconv.Itoa(retries)
+		if limit := min(h.Config.ClientMaxRetries, h.Config.MaxConsecutiveRetries); retries > limit {
+			logger.LogInfo(fmt.Sprintf("Clamping %s from %d to the admin maximum %d", headerAntiblockMaxRetries, retries, limit))
+			retries = limit
+			applied = fmt.Sprintf("%d (clamped from %s)", retries, value)
+		}
+		setMaxRetries(&cfg, h.Config.MaxConsecutiveRetries, retries)
+		result.applied["maxRetries"] = applied
+	}
+
+	if value := r.Header.Get(headerAntiblockSwallowThoughts); value != "" {
+		swallow, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a boolean, got %q", headerAntiblockSwallowThoughts, value)
+		}
+		cfg.SwallowThoughtsAfterRetry = swallow
+		result.applied["swallowThoughts"] = strconv.FormatBool(swallow)
+	}
+
+	if value := r.Header.Get(headerAntiblockHeuristics); value != "" {
+		heuristics, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a boolean, got %q", headerAntiblockHeuristics, value)
+		}
+		cfg.EnablePunctuationHeuristic = heuristics
+		result.applied["heuristics"] = strconv.FormatBool(heuristics)
+	}
+
+	logger.LogInfo(fmt.Sprintf("Client antiblock overrides: %v", result.applied))
+	return result, nil
+}
+
+// setMaxRetries applies a per-request retry limit to a copy of the configuration. Retry
+// policies were given the global limit as their MaxAttempts at load time, so the default
+// policy and every policy still at the global limit follow the new one, and no policy is
+// left above it. Lower per-reason limits from RETRY_POLICIES are kept.
+func setMaxRetries(cfg *config.Config, global, retries int) {
+	cfg.MaxConsecutiveRetries = retries
+	clamp := func(policy config.RetryPolicy) config.RetryPolicy {
+		if policy.MaxAttempts == global || policy.MaxAttempts > retries {
+			policy.MaxAttempts = retries
+		}
+		return policy
+	}
+	cfg.DefaultRetryPolicy = clamp(cfg.DefaultRetryPolicy)
+	policies := make(map[string]config.RetryPolicy, len(cfg.RetryPolicies))
+	for reason, policy := range cfg.RetryPolicies {
+		policies[reason] = clamp(policy)
+	}
+	cfg.RetryPolicies = policies
+}
+
+// progressEventsRequested reports whether the client opted in to progress events with the
+// X-Antiblock-Events header or the antiblock_events query parameter, stripping the latter.
+func progressEventsRequested(r *http.Request) (bool, error) {
+	value := r.Header.Get(headerAntiblockEvents)
+	query := r.URL.Query()
+	if queryValue := query.Get(queryAntiblockEvents); queryValue != "" {
+		value = queryValue
+	}
+	if query.Has(queryAntiblockEvents) {
+		query.Del(queryAntiblockEvents)
+		r.URL.RawQuery = query.Encode()
+	}
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean, got %q", headerAntiblockEvents, value)
+	}
+	return enabled, nil
+}
+
+// progressEventsEnabled reports whether ServeHTTP accepted the request's opt-in to
+// progress events.
+func progressEventsEnabled(r *http.Request) bool {
+	enabled, _ := r.Context().Value(ctxKeyProgressEvents).(bool)
+	return enabled
+}
+
+// requestConfig returns the effective configuration of a request, including any
+// client overrides accepted by ServeHTTP.
+func (h *ProxyHandler) requestConfig(r *http.Request) *config.Config {
+	if cfg, ok := r.Context().Value(ctxKeyConfig).(*config.Config); ok {
+		return cfg
+	}
+	return h.Config
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gemini-antiblock/config"
+)
+
+func TestParseAntiblockOverrides(t *testing.T) {
+	const (
+		targetPath = "/v1beta/models/gemini-2.5-pro:streamGenerateContent"
+		otherPath  = "/v1beta/models/text-embedding-004:embedContent"
+	)
+
+	tests := []struct {
+		name       string
+		allow      bool
+		path       string
+		headers    map[string]string
+		wantErr    bool
+		wantEnable *bool
+		wantMax    int
+		wantApply  map[string]string
+	}{
+		{
+			name:      "overrides disabled ignores headers",
+			allow:     false,
+			path:      targetPath,
+			headers:   map[string]string{headerAntiblockEnable: "false", headerAntiblockMaxRetries: "2"},
+			wantMax:   20,
+			wantApply: map[string]string{},
+		},
+		{
+			name:      "overrides disabled ignores malformed headers",
+			allow:     false,
+			path:      targetPath,
+			headers:   map[string]string{headerAntiblockMaxRetries: "many"},
+			wantMax:   20,
+			wantApply: map[string]string{},
+		},
+		{
+			name:      "no headers",
+			allow:     true,
+			path:      targetPath,
+			wantMax:   20,
+			wantApply: map[string]string{},
+		},
+		{
+			name:       "enable for a target model",
+			allow:      true,
+			path:       targetPath,
+			headers:    map[string]string{headerAntiblockEnable: "false"},
+			wantEnable: boolPtr(false),
+			wantMax:    20,
+			wantApply:  map[string]string{"enable": "false"},
+		},
+		{
+			name:      "enable ignored for other models",
+			allow:     true,
+			path:      otherPath,
+			headers:   map[string]string{headerAntiblockEnable: "true"},
+			wantMax:   20,
+			wantApply: map[string]string{},
+		},
+		{
+			name:      "retries below the limits",
+			allow:     true,
+			path:      targetPath,
+			headers:   map[string]string{headerAntiblockMaxRetries: "3"},
+			wantMax:   3,
+			wantApply: map[string]string{"maxRetries": "3"},
+		},
+		{
+			name:      "retries clamped to CLIENT_MAX_RETRIES",
+			allow:     true,
+			path:      targetPath,
+			headers:   map[string]string{headerAntiblockMaxRetries: "500"},
+			wantMax:   10,
+			wantApply: map[string]string{"maxRetries": "10 (clamped from 500)"},
+		},
+		{
+			name:      "thoughts and heuristics",
+			allow:     true,
+			path:      targetPath,
+			headers:   map[string]string{headerAntiblockSwallowThoughts: "true", headerAntiblockHeuristics: "0"},
+			wantMax:   20,
+			wantApply: map[string]string{"swallowThoughts": "true", "heuristics": "false"},
+		},
+		{name: "invalid enable", allow: true, path: targetPath, headers: map[string]string{headerAntiblockEnable: "maybe"}, wantErr: true},
+		{name: "invalid retries", allow: true, path: targetPath, headers: map[string]string{headerAntiblockMaxRetries: "many"}, wantErr: true},
+		{name: "negative retries", allow: true, path: targetPath, headers: map[string]string{headerAntiblockMaxRetries: "-1"}, wantErr: true},
+		{name: "invalid heuristics", allow: true, path: targetPath, headers: map[string]string{headerAntiblockHeuristics: "yes"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &ProxyHandler{Config: &config.Config{
+				AllowClientOverrides:   tt.allow,
+				ClientMaxRetries:       10,
+				MaxConsecutiveRetries:  20,
+				AntiblockModelPrefixes: []string{"gemini-2.5"},
+			}}
+			r := httptest.NewRequest("POST", tt.path, nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			got, err := h.parseAntiblockOverrides(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got.enable, tt.wantEnable) {
+				t.Errorf("enable = %v; want %v", got.enable, tt.wantEnable)
+			}
+			if got.cfg.MaxConsecutiveRetries != tt.wantMax {
+				t.Errorf("MaxConsecutiveRetries = %d; want %d", got.cfg.MaxConsecutiveRetries, tt.wantMax)
+			}
+			if !reflect.DeepEqual(got.applied, tt.wantApply) {
+				t.Errorf("applied = %v; want %v", got.applied, tt.wantApply)
+			}
+			if h.Config.MaxConsecutiveRetries != 20 {
+				t.Error("the handler configuration was modified")
+			}
+		})
+	}
+}
+
+func TestParseAntiblockOverridesClampsToGlobalLimit(t *testing.T) {
+	h := &ProxyHandler{Config: &config.Config{
+		AllowClientOverrides:  true,
+		ClientMaxRetries:      10,
+		MaxConsecutiveRetries: 5,
+	}}
+	r := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	r.Header.Set(headerAntiblockMaxRetries, "8")
+
+	got, err := h.parseAntiblockOverrides(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.cfg.MaxConsecutiveRetries != 5 {
+		t.Errorf("MaxConsecutiveRetries = %d; want 5", got.cfg.MaxConsecutiveRetries)
+	}
+}
+
+func TestSetMaxRetries(t *testing.T) {
+	cfg := &config.Config{
+		MaxConsecutiveRetries: 20,
+		DefaultRetryPolicy:    config.RetryPolicy{MaxAttempts: 20},
+		RetryPolicies: map[string]config.RetryPolicy{
+			"DROP":  {MaxAttempts: 20},
+			"BLOCK": {MaxAttempts: 2},
+			"STALL": {MaxAttempts: 8},
+		},
+	}
+	original := cfg.RetryPolicies
+
+	setMaxRetries(cfg, 20, 5)
+
+	if cfg.MaxConsecutiveRetries != 5 {
+		t.Errorf("MaxConsecutiveRetries = %d; want 5", cfg.MaxConsecutiveRetries)
+	}
+	if cfg.DefaultRetryPolicy.MaxAttempts != 5 {
+		t.Errorf("default policy MaxAttempts = %d; want 5", cfg.DefaultRetryPolicy.MaxAttempts)
+	}
+	want := map[string]int{"DROP": 5, "BLOCK": 2, "STALL": 5}
+	for reason, attempts := range want {
+		if got := cfg.RetryPolicies[reason].MaxAttempts; got != attempts {
+			t.Errorf("%s policy MaxAttempts = %d; want %d", reason, got, attempts)
+		}
+	}
+	if original["DROP"].MaxAttempts != 20 {
+		t.Error("the shared retry policy map was modified")
+	}
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
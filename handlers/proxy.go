@@ -5,42 +5,95 @@ import (
 	gz "compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"gemini-antiblock/apikeys"
 	"gemini-antiblock/config"
 	"gemini-antiblock/logger"
 	"gemini-antiblock/metrics"
 	"gemini-antiblock/streaming"
+	"gemini-antiblock/transport"
+	"gemini-antiblock/upstream"
 )
 
 // ProxyHandler handles proxy requests to Gemini API
 type ProxyHandler struct {
 	Config      *config.Config
 	RateLimiter *RateLimiter
-	rrCounter   uint64
+	Upstreams   *upstream.Pool
+	// Keys is the proxy's own upstream API key pool, or nil to forward client credentials.
+	Keys *apikeys.Pool
+	// Clients are the tuned HTTP clients for upstream calls, one transport per upstream.
+	Clients *transport.Clients
+
+	// accounts are the proxy-issued client tokens, by token.
+	accounts map[string]*clientAccount
 }
 
 const (
-	handlingModeAntiblockStream   = "antiblock-stream"
-	handlingModePassthroughStream = "passthrough-stream"
-	handlingModeStreamOther       = "stream"
-	handlingModeNonStream         = "non-stream"
+	handlingModeAntiblockStream    = "antiblock-stream"
+	handlingModeAntiblockNonStream = "antiblock-non-stream"
+	handlingModePassthroughStream  = "passthrough-stream"
+	handlingModeStreamOther        = "stream"
+	handlingModeNonStream          = "non-stream"
 )
 
 // NewProxyHandler creates a new proxy handler
 func NewProxyHandler(cfg *config.Config, rateLimiter *RateLimiter) *ProxyHandler {
+	pool := upstream.NewPool(config.DefaultUpstreamGroup, upstreamMembers(cfg.UpstreamGroups[config.DefaultUpstreamGroup]), upstream.Breaker{
+		Threshold: cfg.UpstreamBreakerThreshold,
+		Cooldown:  cfg.UpstreamBreakerCooldown,
+	})
+	names := make([]string, 0, len(cfg.UpstreamGroups))
+	for name := range cfg.UpstreamGroups {
+		if name != config.DefaultUpstreamGroup {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pool.AddGroup(name, upstreamMembers(cfg.UpstreamGroups[name]))
+	}
+	for _, rule := range cfg.UpstreamRoutes {
+		if _, ok := pool.Group(rule.Value); !ok {
+			logger.LogError(fmt.Sprintf("Upstream route %q points to unknown group %q; matching requests use the %q group", rule.Prefix, rule.Value, config.DefaultUpstreamGroup))
+		}
+	}
 	return &ProxyHandler{
 		Config:      cfg,
 		RateLimiter: rateLimiter,
+		Upstreams:   pool,
+		Keys:        apikeys.NewPool(cfg.UpstreamAPIKeys, cfg.UpstreamAPIKeyStrategy, cfg.UpstreamAPIKeyCooldown),
+		accounts:    newClientAccounts(cfg),
+		Clients: transport.NewClients(transport.Options{
+			DialTimeout:           cfg.UpstreamDialTimeout,
+			KeepAlive:             cfg.UpstreamTCPKeepAlive,
+			TLSHandshakeTimeout:   cfg.UpstreamTLSTimeout,
+			ResponseHeaderTimeout: cfg.UpstreamHeaderTimeout,
+			IdleConnTimeout:       cfg.UpstreamIdleConnTimeout,
+			MaxIdleConns:          cfg.UpstreamMaxIdleConns,
+			MaxConns:              cfg.UpstreamMaxConns,
+			HTTP2:                 cfg.UpstreamHTTP2,
+		}),
 	}
 }
 
+func upstreamMembers(members []config.UpstreamMember) []upstream.Member {
+	result := make([]upstream.Member, 0, len(members))
+	for _, m := range members {
+		result = append(result, upstream.Member{Base: m.Base, Weight: m.Weight})
+	}
+	return result
+}
+
 // BuildUpstreamHeaders builds headers for upstream requests
 func (h *ProxyHandler) BuildUpstreamHeaders(reqHeaders http.Header) http.Header {
 	headers := make(http.Header)
@@ -94,13 +147,16 @@ func (h *ProxyHandler) isAntiblockTarget(model string) bool {
 	return false
 }
 
-// InjectSystemPrompt injects a system prompt to ensure the [done] token is present.
+// InjectSystemPrompt injects the completion detector's system prompt (e.g. the [done] token instruction).
 // It intelligently handles both system_instruction (snake_case) and systemInstruction (camelCase)
 // by merging the content of system_instruction into systemInstruction before processing.
-// systemInstruction is the officially recommended format.
-func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}) {
+// systemInstruction is the officially recommended format. An empty prompt leaves the body untouched.
+func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}, prompt string) {
+	if prompt == "" {
+		return
+	}
 	newSystemPromptPart := map[string]interface{}{
-		"text": "IMPORTANT: At the very end of your entire response, you must write the token [done] to signal completion. This is a mandatory technical requirement.",
+		"text": prompt,
 	}
 
 	// Standardize: If system_instruction exists, merge its content into systemInstruction.
@@ -160,37 +216,58 @@ func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}) {
 	instruction["parts"] = append(parts, newSystemPromptPart)
 }
 
-// HandleStreamingPost handles streaming POST requests
-func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Request) {
-	urlObj, _ := url.Parse(r.URL.String())
-	upstreamBase := h.selectUpstreamBase()
-	upstreamURL := upstreamBase + urlObj.Path
-	if urlObj.RawQuery != "" {
-		upstreamURL += "?" + urlObj.RawQuery
+// antiblockStream is the state shared by the streaming and non-streaming antiblock handlers
+// once the initial upstream request has succeeded.
+type antiblockStream struct {
+	response *http.Response
+	headers  http.Header
+	group    *upstream.Pool
+	body     map[string]interface{}
+	detector streaming.CompletionDetector
+	base     string
+	path     string
+}
+
+// streamRequest describes the session for the stream processor.
+func (h *ProxyHandler) streamRequest(r *http.Request, stream *antiblockStream) streaming.StreamRequest {
+	requestID, _ := r.Context().Value(ctxKeyRequestID).(string)
+	return streaming.StreamRequest{
+		Body:         stream.body,
+		Headers:      stream.headers,
+		RequestID:    requestID,
+		Detector:     stream.detector,
+		Model:        extractModelIdentifier(r.URL.Path),
+		UpstreamBase: stream.base,
+		UpstreamPath: stream.path,
+		Upstreams:    stream.group,
+		Keys:         h.keyPool(r),
+		Client:       clientIdentityFrom(r),
+		Clients:      h.Clients,
 	}
+}
 
+// openAntiblockStream reads the client body, injects the completion prompt and makes
+// the initial upstream streaming request. On failure it writes the error response,
+// records metrics and returns ok=false.
+func (h *ProxyHandler) openAntiblockStream(w http.ResponseWriter, r *http.Request, group *upstream.Pool, upstreamBase, upstreamPath string) (*antiblockStream, bool) {
+	upstreamURL := upstreamBase + upstreamPath
 	if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok && rid != "" {
-		metrics.SetUpstream(rid, upstreamURL)
+		metrics.RecordAttempt(rid, upstreamBase, "")
 	}
 
-	logger.LogInfo("=== NEW STREAMING REQUEST ===")
-	logger.LogInfo("Upstream URL:", upstreamURL)
-	logger.LogInfo("Request method:", r.Method)
-	logger.LogInfo("Content-Type:", r.Header.Get("Content-Type"))
-
 	// Read and parse request body
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		logger.LogError("Failed to read request body:", err)
 		JSONError(w, 400, "Failed to read request body", err.Error())
-		return
+		return nil, false
 	}
 
 	var requestBody map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
 		logger.LogError("Failed to parse request body:", err)
 		JSONError(w, 400, "Invalid JSON in request body", err.Error())
-		return
+		return nil, false
 	}
 
 	logger.LogDebug(fmt.Sprintf("Request body size: %d bytes", len(bodyBytes)))
@@ -199,42 +276,66 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 		logger.LogDebug(fmt.Sprintf("Parsed request body with %d messages", len(contents)))
 	}
 
-	// Inject system prompt
-	h.InjectSystemPrompt(requestBody)
+	// Inject the completion detector's system prompt
+	detector := streaming.ResolveDetector(h.requestConfig(r), extractModelIdentifier(r.URL.Path), requestBody)
+	h.InjectSystemPrompt(requestBody, detector.SystemPrompt())
 
 	// Create upstream request
 	modifiedBodyBytes, err := json.Marshal(requestBody)
 	if err != nil {
 		logger.LogError("Failed to marshal modified request body:", err)
 		JSONError(w, 500, "Internal server error", "Failed to process request body")
-		return
+		return nil, false
 	}
 
 	logger.LogInfo("=== MAKING INITIAL REQUEST ===")
 	upstreamHeaders := h.BuildUpstreamHeaders(r.Header)
 
-	upstreamReq, err := http.NewRequest("POST", upstreamURL, bytes.NewReader(modifiedBodyBytes))
-	if err != nil {
-		logger.LogError("Failed to create upstream request:", err)
-		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
-		return
-	}
-
-	upstreamReq.Header = upstreamHeaders
-
-	client := &http.Client{}
-	initialResponse, err := client.Do(upstreamReq)
+	// The request gets its own context so closing the body aborts any read still in progress.
+	// It is also cancelled when no response headers arrive within the first byte timeout.
+	upstreamCtx, cancelUpstream := context.WithCancel(r.Context())
+	firstByteTimeout := h.requestConfig(r).StallFirstByteTimeout
+	headersStalled := streaming.HeaderDeadline(firstByteTimeout, cancelUpstream)
+	requestStart := time.Now()
+	initialResponse, upstreamHeaders, err := h.sendUpstream(upstreamCtx, r, "POST", upstreamURL, modifiedBodyBytes, upstreamHeaders)
+	stalled := headersStalled()
 	if err != nil {
+		cancelUpstream()
+		if r.Context().Err() != nil {
+			logger.LogInfo("Client disconnected before the initial upstream response arrived")
+			if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
+				metrics.FinishRequest(rid, metrics.StatusClientClosedRequest, false, "client cancelled")
+			}
+			return nil, false
+		}
+		h.Upstreams.ReportFailure(upstreamBase)
+		if stalled {
+			// Hand the stream processor a body that fails as a stall, so the initial
+			// attempt is retried like any other STALL instead of failing the request.
+			logger.LogError(fmt.Sprintf("No initial response headers within the first byte timeout (%v); retrying as STALL", firstByteTimeout))
+			return &antiblockStream{
+				response: &http.Response{StatusCode: http.StatusOK, Body: streaming.StalledBody()},
+				headers:  upstreamHeaders,
+				group:    group,
+				body:     requestBody,
+				detector: detector,
+				base:     upstreamBase,
+				path:     upstreamPath,
+			}, true
+		}
 		logger.LogError("Failed to make initial request:", err)
 		JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
 		if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
 			metrics.FinishRequest(rid, 502, false, "connect upstream failed")
 		}
-		return
+		return nil, false
 	}
 
+	initialResponse.Body = streaming.NewCancelOnClose(initialResponse.Body, cancelUpstream)
 	logger.LogInfo(fmt.Sprintf("Initial response status: %d %s", initialResponse.StatusCode, initialResponse.Status))
 
+	h.reportUpstreamStatus(upstreamBase, initialResponse.StatusCode, time.Since(requestStart))
+
 	// Initial failure: return standardized error
 	if initialResponse.StatusCode != http.StatusOK {
 		logger.LogError("=== INITIAL REQUEST FAILED ===")
@@ -264,7 +365,7 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.WriteHeader(initialResponse.StatusCode)
 			json.NewEncoder(w).Encode(errorResp)
-			return
+			return nil, false
 		}
 
 		// Fallback to standard error
@@ -273,13 +374,56 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 			message = "Resource has been exhausted (e.g. check quota)."
 		}
 		JSONError(w, initialResponse.StatusCode, message, string(errorBody))
+		return nil, false
+	}
+
+	return &antiblockStream{
+		response: initialResponse,
+		headers:  upstreamHeaders,
+		group:    group,
+		body:     requestBody,
+		detector: detector,
+		base:     upstreamBase,
+		path:     upstreamPath,
+	}, true
+}
+
+// HandleStreamingPost handles streaming POST requests
+func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Request) {
+	urlObj, _ := url.Parse(r.URL.String())
+	group, upstreamBase := h.selectUpstream(r)
+	upstreamPath := urlObj.Path
+	if urlObj.RawQuery != "" {
+		upstreamPath += "?" + urlObj.RawQuery
+	}
+	upstreamURL := upstreamBase + upstreamPath
+
+	if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok && rid != "" {
+		metrics.SetUpstream(rid, upstreamURL)
+	}
+
+	logger.LogInfo("=== NEW STREAMING REQUEST ===")
+	logger.LogInfo("Upstream URL:", upstreamURL)
+	logger.LogInfo("Request method:", r.Method)
+	logger.LogInfo("Content-Type:", r.Header.Get("Content-Type"))
+
+	stream, ok := h.openAntiblockStream(w, r, group, upstreamBase, upstreamPath)
+	if !ok {
 		return
 	}
+	initialResponse := stream.response
 
 	logger.LogInfo("=== INITIAL REQUEST SUCCESSFUL - STARTING STREAM PROCESSING ===")
 
-	// Set up streaming response
-	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	// Set up streaming response in the framing the client asked for
+	framing := streaming.ClientFraming(r.URL.Query())
+	var writer io.Writer = w
+	if framing == streaming.FramingJSONArray {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer = streaming.NewJSONArrayWriter(w)
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	}
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -293,17 +437,25 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 
 	// Process stream with retry logic
 	requestID, _ := r.Context().Value(ctxKeyRequestID).(string)
-	err = streaming.ProcessStreamAndRetryInternally(
-		h.Config,
+	streamReq := h.streamRequest(r, stream)
+	streamReq.ProgressEvents = progressEventsEnabled(r)
+	err := streaming.ProcessStreamAndRetryInternally(
+		r.Context(),
+		h.requestConfig(r),
 		initialResponse.Body,
-		w,
-		requestBody,
-		upstreamURL,
-		r.Header,
-		requestID,
+		writer,
+		streamReq,
 	)
+	if arrayWriter, ok := writer.(*streaming.JSONArrayWriter); ok && !errors.Is(err, streaming.ErrClientCancelled) {
+		arrayWriter.Close()
+	}
 
-	if err != nil {
+	if errors.Is(err, streaming.ErrClientCancelled) {
+		logger.LogInfo("Client disconnected; stream processing aborted")
+		if requestID != "" {
+			metrics.FinishRequest(requestID, metrics.StatusClientClosedRequest, false, err.Error())
+		}
+	} else if err != nil {
 		logger.LogError("=== UNHANDLED EXCEPTION IN STREAM PROCESSOR ===")
 		logger.LogError("Exception:", err)
 		// when stream processor returns error, mark failure if not already
@@ -312,6 +464,8 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 			status := 500
 			if err == streaming.ErrRetryLimitExceeded {
 				status = 504
+			} else if err == streaming.ErrContentBlocked {
+				status = 400
 			}
 			metrics.FinishRequest(requestID, status, false, err.Error())
 		}
@@ -325,10 +479,106 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 	logger.LogInfo("Streaming response completed")
 }
 
+// HandleNonStreamingAntiblock serves generateContent calls for antiblock models by calling
+// streamGenerateContent internally, running the same retry logic as the streaming path and
+// reassembling the result into a single GenerateContentResponse.
+func (h *ProxyHandler) HandleNonStreamingAntiblock(w http.ResponseWriter, r *http.Request) {
+	urlObj, _ := url.Parse(r.URL.String())
+	query := urlObj.Query()
+	query.Set("alt", "sse")
+	group, upstreamBase := h.selectUpstream(r)
+	upstreamPath := toStreamingPath(urlObj.Path) + "?" + query.Encode()
+	upstreamURL := upstreamBase + upstreamPath
+
+	if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok && rid != "" {
+		metrics.SetUpstream(rid, upstreamURL)
+	}
+
+	logger.LogInfo("=== NEW NON-STREAMING ANTIBLOCK REQUEST ===")
+	logger.LogInfo("[NON-STREAM ANTIBLOCK] Upstream URL:", upstreamURL)
+
+	stream, ok := h.openAntiblockStream(w, r, group, upstreamBase, upstreamPath)
+	if !ok {
+		return
+	}
+	initialResponse := stream.response
+	defer initialResponse.Body.Close()
+
+	requestID, _ := r.Context().Value(ctxKeyRequestID).(string)
+	aggregator := streaming.NewResponseAggregator()
+	err := streaming.ProcessStreamAndRetryInternally(
+		r.Context(),
+		h.requestConfig(r),
+		initialResponse.Body,
+		aggregator,
+		h.streamRequest(r, stream),
+	)
+
+	if errors.Is(err, streaming.ErrClientCancelled) {
+		logger.LogInfo("[NON-STREAM ANTIBLOCK] Client disconnected; stream processing aborted")
+		if requestID != "" {
+			metrics.FinishRequest(requestID, metrics.StatusClientClosedRequest, false, err.Error())
+		}
+		return
+	}
+
+	if errorPayload := aggregator.Error(); errorPayload != nil {
+		status := http.StatusInternalServerError
+		if errorObj, ok := errorPayload["error"].(map[string]interface{}); ok {
+			if code, ok := errorObj["code"].(float64); ok && code >= 400 {
+				status = int(code)
+			}
+			if _, hasStatus := errorObj["status"]; !hasStatus {
+				errorObj["status"] = StatusToGoogleStatus(status)
+			}
+		}
+		logger.LogError(fmt.Sprintf("[NON-STREAM ANTIBLOCK] Stream processor reported error, responding with %d", status))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorPayload)
+		if requestID != "" {
+			errMsg := "stream processor error"
+			if err != nil {
+				errMsg = err.Error()
+			}
+			metrics.FinishRequest(requestID, status, false, errMsg)
+		}
+		return
+	}
+
+	if err != nil {
+		logger.LogError("=== UNHANDLED EXCEPTION IN STREAM PROCESSOR ===")
+		logger.LogError("Exception:", err)
+		JSONError(w, 500, "Internal server error", err.Error())
+		if requestID != "" {
+			metrics.FinishRequest(requestID, 500, false, err.Error())
+		}
+		return
+	}
+
+	logger.LogInfo(fmt.Sprintf("[NON-STREAM ANTIBLOCK] Reassembled response from %d chunks", aggregator.ChunkCount()))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(aggregator.Response())
+	if requestID != "" {
+		metrics.FinishRequest(requestID, http.StatusOK, true, "")
+	}
+}
+
+// toStreamingPath rewrites a ":generateContent" method path to ":streamGenerateContent".
+func toStreamingPath(path string) string {
+	if strings.HasSuffix(path, ":generateContent") {
+		return strings.TrimSuffix(path, ":generateContent") + ":streamGenerateContent"
+	}
+	return path
+}
+
 // HandleStreamingPassthrough forwards streaming requests without antiblock processing
 func (h *ProxyHandler) HandleStreamingPassthrough(w http.ResponseWriter, r *http.Request) {
 	urlObj, _ := url.Parse(r.URL.String())
-	upstreamBase := h.selectUpstreamBase()
+	_, upstreamBase := h.selectUpstream(r)
 	upstreamURL := upstreamBase + urlObj.Path
 	if urlObj.RawQuery != "" {
 		upstreamURL += "?" + urlObj.RawQuery
@@ -343,21 +593,29 @@ func (h *ProxyHandler) HandleStreamingPassthrough(w http.ResponseWriter, r *http
 
 	upstreamHeaders := h.BuildUpstreamHeaders(r.Header)
 
-	upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, r.Body)
+	// The body is buffered so it can be resent with another key after a quota error.
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		logger.LogError("[PASSTHROUGH] Failed to create upstream request:", err)
-		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
+		logger.LogError("[PASSTHROUGH] Failed to read request body:", err)
+		JSONError(w, 400, "Failed to read request body", err.Error())
 		if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
-			metrics.FinishRequest(rid, 500, false, err.Error())
+			metrics.FinishRequest(rid, 400, false, err.Error())
 		}
 		return
 	}
-	upstreamReq.Header = upstreamHeaders
 
-	client := &http.Client{}
-	resp, err := client.Do(upstreamReq)
+	requestStart := time.Now()
+	resp, _, err := h.sendUpstream(r.Context(), r, r.Method, upstreamURL, body, upstreamHeaders)
 	if err != nil {
+		if r.Context().Err() != nil {
+			logger.LogInfo("[PASSTHROUGH] Client disconnected before upstream response arrived")
+			if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
+				metrics.FinishRequest(rid, metrics.StatusClientClosedRequest, false, "client cancelled")
+			}
+			return
+		}
 		logger.LogError("[PASSTHROUGH] Failed to connect to upstream server:", err)
+		h.Upstreams.ReportFailure(upstreamBase)
 		JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
 		if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
 			metrics.FinishRequest(rid, 502, false, err.Error())
@@ -367,6 +625,7 @@ func (h *ProxyHandler) HandleStreamingPassthrough(w http.ResponseWriter, r *http
 	defer resp.Body.Close()
 
 	logger.LogInfo("[PASSTHROUGH] Initial response status:", resp.StatusCode, resp.Status)
+	h.reportUpstreamStatus(upstreamBase, resp.StatusCode, time.Since(requestStart))
 
 	if resp.StatusCode != http.StatusOK {
 		errorBody, _ := io.ReadAll(resp.Body)
@@ -407,7 +666,7 @@ func (h *ProxyHandler) HandleStreamingPassthrough(w http.ResponseWriter, r *http
 			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
 				logger.LogError("[PASSTHROUGH] Failed to write downstream chunk:", writeErr)
 				if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
-					metrics.FinishRequest(rid, http.StatusBadGateway, false, writeErr.Error())
+					metrics.FinishRequest(rid, passthroughFailureStatus(r), false, writeErr.Error())
 				}
 				return
 			}
@@ -420,7 +679,7 @@ func (h *ProxyHandler) HandleStreamingPassthrough(w http.ResponseWriter, r *http
 			}
 			logger.LogError("[PASSTHROUGH] Upstream read error:", readErr)
 			if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
-				metrics.FinishRequest(rid, http.StatusBadGateway, false, readErr.Error())
+				metrics.FinishRequest(rid, passthroughFailureStatus(r), false, readErr.Error())
 			}
 			return
 		}
@@ -432,10 +691,19 @@ func (h *ProxyHandler) HandleStreamingPassthrough(w http.ResponseWriter, r *http
 	}
 }
 
+// passthroughFailureStatus classifies a mid-stream passthrough failure as a client
+// cancellation when the downstream request context is already done.
+func passthroughFailureStatus(r *http.Request) int {
+	if r.Context().Err() != nil {
+		return metrics.StatusClientClosedRequest
+	}
+	return http.StatusBadGateway
+}
+
 // HandleNonStreaming handles non-streaming requests
 func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request) {
 	urlObj, _ := url.Parse(r.URL.String())
-	upstreamBase := h.selectUpstreamBase()
+	_, upstreamBase := h.selectUpstream(r)
 	upstreamURL := upstreamBase + urlObj.Path
 	if urlObj.RawQuery != "" {
 		upstreamURL += "?" + urlObj.RawQuery
@@ -450,21 +718,30 @@ func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request
 	// 可观测：打印上游 URL
 	logger.LogInfo("[NON-STREAM] Upstream URL:", upstreamURL)
 
-	var body io.Reader
+	// The body is buffered so it can be resent with another key after a quota error.
+	var body []byte
 	if r.Method != "GET" && r.Method != "HEAD" {
-		body = r.Body
-	}
-
-	upstreamReq, err := http.NewRequest(r.Method, upstreamURL, body)
-	if err != nil {
-		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
-		return
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			JSONError(w, 400, "Failed to read request body", err.Error())
+			if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
+				metrics.FinishRequest(rid, 400, false, err.Error())
+			}
+			return
+		}
 	}
-	upstreamReq.Header = upstreamHeaders
 
-	client := &http.Client{}
-	resp, err := client.Do(upstreamReq)
+	requestStart := time.Now()
+	resp, _, err := h.sendUpstream(r.Context(), r, r.Method, upstreamURL, body, upstreamHeaders)
 	if err != nil {
+		if r.Context().Err() != nil {
+			logger.LogInfo("[NON-STREAM] Client disconnected before upstream response arrived")
+			if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
+				metrics.FinishRequest(rid, metrics.StatusClientClosedRequest, false, "client cancelled")
+			}
+			return
+		}
+		h.Upstreams.ReportFailure(upstreamBase)
 		JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
 		if rid, ok := r.Context().Value(ctxKeyRequestID).(string); ok {
 			metrics.FinishRequest(rid, 502, false, "connect upstream failed")
@@ -475,6 +752,7 @@ func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request
 
 	// 可观测：记录初始返回码
 	logger.LogInfo("[NON-STREAM] Initial response status:", resp.StatusCode, resp.Status)
+	h.reportUpstreamStatus(upstreamBase, resp.StatusCode, time.Since(requestStart))
 
 	if resp.StatusCode != http.StatusOK {
 		// 非 200：读取错误体
@@ -549,19 +827,20 @@ type contextKey string
 const ctxKeyRequestID contextKey = "gemini-request-id"
 
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// First, enforce rate limiting if enabled and a key is present.
-	if h.Config.EnableRateLimit {
-		apiKey := r.Header.Get("X-Goog-Api-Key")
-		if apiKey == "" {
-			authHeader := r.Header.Get("Authorization")
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				apiKey = strings.TrimPrefix(authHeader, "Bearer ")
-			}
+	// Proxy-issued client tokens are checked before anything is forwarded.
+	var account *clientAccount
+	if r.Method != "OPTIONS" {
+		var ok bool
+		if account, ok = h.authenticate(w, r); !ok {
+			return
 		}
+	}
 
-		if apiKey != "" {
-			logger.LogDebug("Enforcing rate limit for key ending with: ...", apiKey[len(apiKey)-4:])
-			h.RateLimiter.Wait(apiKey)
+	// Then enforce rate limiting if enabled and the caller can be identified.
+	if h.Config.EnableRateLimit {
+		if key := rateLimitKey(r, account); key != "" {
+			logger.LogDebug("Enforcing rate limit for key ending with:", apikeys.Mask(requestCredential(r)))
+			h.RateLimiter.Wait(key)
 			logger.LogDebug("Rate limit check passed for key.")
 		}
 	}
@@ -583,13 +862,24 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		strings.Contains(strings.ToLower(r.URL.Path), "sse") ||
 		r.URL.Query().Get("alt") == "sse"
 
+	overrides, err := h.parseAntiblockOverrides(r)
+	if err != nil {
+		logger.LogError("Invalid antiblock override header:", err)
+		JSONError(w, 400, "Invalid antiblock override header", err.Error())
+		return
+	}
+
 	model := extractModelIdentifier(r.URL.Path)
+	antiblockTarget := h.isAntiblockTarget(model)
+	if overrides.enable != nil {
+		antiblockTarget = *overrides.enable
+	}
 	antiblockEnabled := false
 	handlingMode := handlingModeNonStream
 
 	if isStream {
 		if strings.EqualFold(r.Method, "POST") {
-			if h.isAntiblockTarget(model) {
+			if antiblockTarget {
 				antiblockEnabled = true
 				handlingMode = handlingModeAntiblockStream
 			} else {
@@ -598,6 +888,9 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			handlingMode = handlingModeStreamOther
 		}
+	} else if strings.EqualFold(r.Method, "POST") && strings.HasSuffix(r.URL.Path, ":generateContent") && antiblockTarget {
+		antiblockEnabled = true
+		handlingMode = handlingModeAntiblockNonStream
 	}
 
 	logger.LogInfo("Detected streaming request:", isStream)
@@ -608,7 +901,23 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// start metrics session for this request
 	rid := fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddInt64(&reqSeq, 1))
 	metrics.StartRequest(r, rid, isStream, model, antiblockEnabled, handlingMode)
-	r = r.WithContext(context.WithValue(r.Context(), ctxKeyRequestID, rid))
+	if len(overrides.applied) > 0 {
+		metrics.SetOverrides(rid, overrides.applied)
+	}
+	ctx := context.WithValue(r.Context(), ctxKeyRequestID, rid)
+	ctx = context.WithValue(ctx, ctxKeyConfig, overrides.cfg)
+	ctx = context.WithValue(ctx, ctxKeyProgressEvents, overrides.progressEvents)
+	ctx = context.WithValue(ctx, ctxKeyAccount, account)
+	if account != nil {
+		metrics.SetClient(rid, account.Name)
+		r = r.WithContext(context.WithValue(ctx, ctxKeyClient, account.Name))
+		dropClientCredentials(r)
+	} else {
+		r = r.WithContext(context.WithValue(ctx, ctxKeyClient, clientIdentity(r)))
+		if h.Keys != nil {
+			stripClientKey(r)
+		}
+	}
 
 	if isStream {
 		if strings.EqualFold(r.Method, "POST") {
@@ -626,15 +935,34 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if antiblockEnabled {
+		h.HandleNonStreamingAntiblock(w, r)
+		return
+	}
+
 	h.HandleNonStreaming(w, r)
 }
 
-func (h *ProxyHandler) selectUpstreamBase() string {
-	if bases := h.Config.UpstreamURLBases; len(bases) > 0 {
-		idx := atomic.AddUint64(&h.rrCounter, 1) - 1
-		selected := bases[int(idx%uint64(len(bases)))]
-		logger.LogDebug(fmt.Sprintf("Selected Spectre upstream[%d]: %s", int(idx%uint64(len(bases))), selected))
-		return selected
+// reportUpstreamStatus feeds the status of an upstream response into the pool: 5xx
+// counts as a failure of the base, 200 as a success. Other statuses are the client's
+// concern and leave the base's health untouched.
+func (h *ProxyHandler) reportUpstreamStatus(base string, status int, latency time.Duration) {
+	if status >= 500 {
+		h.Upstreams.ReportFailure(base)
+	} else if status == http.StatusOK {
+		h.Upstreams.ReportSuccess(base, latency)
+	}
+}
+
+// selectUpstream routes a request to its upstream group per UPSTREAM_ROUTES and picks
+// the group's next base.
+func (h *ProxyHandler) selectUpstream(r *http.Request) (*upstream.Pool, string) {
+	name := h.Config.UpstreamGroupFor(extractModelIdentifier(r.URL.Path), r.URL.Path)
+	group, ok := h.Upstreams.Group(name)
+	if !ok {
+		group = h.Upstreams
 	}
-	return h.Config.UpstreamURLBase
+	selected, idx := group.Next()
+	logger.LogDebug(fmt.Sprintf("Selected upstream group %q member[%d]: %s", group.Name(), idx, selected))
+	return group, selected
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 	"gemini-antiblock/config"
 	"gemini-antiblock/handlers"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/upstream"
 )
 
 func main() {
@@ -28,19 +30,44 @@ func main() {
 	// Set up logging
 	logger.SetDebugMode(cfg.DebugMode)
 
+	if err := cfg.Validate(); err != nil {
+		logger.LogError("Invalid configuration:", err)
+		os.Exit(1)
+	}
+
 	logger.LogInfo("=== GEMINI ANTIBLOCK PROXY STARTING ===")
 	upstreamSummary := cfg.UpstreamURLBase
 	if len(cfg.UpstreamURLBases) > 1 {
 		upstreamSummary = strings.Join(cfg.UpstreamURLBases, ", ")
 	}
 	logger.LogInfo(fmt.Sprintf("Upstream URL: %s", upstreamSummary))
+	if len(cfg.UpstreamGroups) > 1 {
+		for name, members := range cfg.UpstreamGroups {
+			described := make([]string, 0, len(members))
+			for _, m := range members {
+				described = append(described, fmt.Sprintf("%s (weight %d)", m.Base, m.Weight))
+			}
+			logger.LogInfo(fmt.Sprintf("Upstream group %q: %s", name, strings.Join(described, ", ")))
+		}
+	}
+	if len(cfg.UpstreamRoutes) > 0 {
+		logger.LogInfo(fmt.Sprintf("Upstream routes: %d rules", len(cfg.UpstreamRoutes)))
+	}
+	if len(cfg.UpstreamAPIKeys) > 0 {
+		logger.LogInfo(fmt.Sprintf("Upstream API key pool: %d keys, %s, cooldown %v", len(cfg.UpstreamAPIKeys), cfg.UpstreamAPIKeyStrategy, cfg.UpstreamAPIKeyCooldown))
+	}
+	if len(cfg.ClientTokens) > 0 {
+		logger.LogInfo(fmt.Sprintf("Client tokens: %d configured; requests without a valid token are rejected", len(cfg.ClientTokens)))
+	}
 	if len(cfg.SpectreProxyWorkerURLs) > 1 {
 		logger.LogInfo(fmt.Sprintf("Spectre worker pool size: %d", len(cfg.SpectreProxyWorkerURLs)))
 	}
+	logger.LogInfo(fmt.Sprintf("Upstream transport: dial timeout %v, TLS timeout %v, response header timeout %v, %d idle connections per upstream, HTTP/2 %t", cfg.UpstreamDialTimeout, cfg.UpstreamTLSTimeout, cfg.UpstreamHeaderTimeout, cfg.UpstreamMaxIdleConns, cfg.UpstreamHTTP2))
 	logger.LogInfo(fmt.Sprintf("Max retries: %d", cfg.MaxConsecutiveRetries))
 	logger.LogInfo(fmt.Sprintf("Debug mode: %t", cfg.DebugMode))
 	logger.LogInfo(fmt.Sprintf("Retry delay: %v", cfg.RetryDelayMs))
 	logger.LogInfo(fmt.Sprintf("Swallow thoughts after retry: %t", cfg.SwallowThoughtsAfterRetry))
+	logger.LogInfo(fmt.Sprintf("Completion detector: %s (%d model rules)", cfg.CompletionDetector, len(cfg.CompletionDetectorRules)))
 	logger.LogInfo(fmt.Sprintf("Server port: %s", cfg.Port))
 
 	// Create rate limiter from config
@@ -61,17 +88,29 @@ func main() {
 
 	// Create proxy handler
 	proxyHandler := handlers.NewProxyHandler(cfg, rateLimiter)
+	proxyHandler.Upstreams.StartHealthChecks(context.Background(), upstream.HealthCheck{
+		Interval: cfg.UpstreamHealthInterval,
+		Timeout:  cfg.UpstreamHealthTimeout,
+		Path:     cfg.UpstreamHealthPath,
+		Clients:  proxyHandler.Clients,
+	})
+	if cfg.UpstreamBreakerThreshold > 0 {
+		logger.LogInfo(fmt.Sprintf("Upstream circuit breaker: open after %d consecutive failures, retest after %v", cfg.UpstreamBreakerThreshold, cfg.UpstreamBreakerCooldown))
+	}
 
 	// Set up routes
 	router := mux.NewRouter()
 
-	// Health check endpoint
-	router.HandleFunc("/health", handlers.HealthHandler).Methods("GET")
-	router.HandleFunc("/healthz", handlers.HealthHandler).Methods("GET")
+	// Health check endpoints: liveness always answers 200, readiness 503 while every
+	// upstream is unavailable
+	router.HandleFunc("/health", proxyHandler.HealthHandler).Methods("GET")
+	router.HandleFunc("/healthz", proxyHandler.HealthHandler).Methods("GET")
+	router.HandleFunc("/ready", proxyHandler.ReadyHandler).Methods("GET")
+	router.HandleFunc("/readyz", proxyHandler.ReadyHandler).Methods("GET")
 
 	// Logs and metrics endpoints
 	router.HandleFunc("/logs", handlers.LogsPageHandler).Methods("GET")
-	router.HandleFunc("/logs/antiblock.json", handlers.LogsJSONHandler).Methods("GET")
+	router.HandleFunc("/logs/antiblock.json", proxyHandler.LogsJSONHandler).Methods("GET")
 	router.HandleFunc("/logs/stream", handlers.LogsSSEHandler).Methods("GET")
 
 	// Handle all requests with the proxy handler
@@ -10,32 +10,59 @@ import (
 	"time"
 )
 
+// StatusClientClosedRequest is recorded when the downstream client disconnects before
+// the request completes (nginx's non-standard 499). Such requests count as cancelled,
+// not as errors.
+const StatusClientClosedRequest = 499
+
+// AttemptEntry records one upstream attempt of an antiblock session.
+type AttemptEntry struct {
+	Attempt  int    `json:"attempt"`
+	Upstream string `json:"upstreamUrl"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// BlockEntry records a safety block seen by an antiblock request and how it was handled.
+type BlockEntry struct {
+	Category string `json:"category"`
+	Action   string `json:"action"`
+}
+
 // RequestEntry represents a single proxied request summary for UI display.
 type RequestEntry struct {
-	ID         string    `json:"id"`
-	Timestamp  time.Time `json:"timestamp"`
-	Method     string    `json:"method"`
-	Path       string    `json:"path"`
-	Upstream   string    `json:"upstreamUrl,omitempty"`
-	Model      string    `json:"model"`
-	Streaming  bool      `json:"streaming"`
-	Antiblock  bool      `json:"antiblockEnabled"`
-	Mode       string    `json:"handlingMode,omitempty"`
-	DurationMs int64     `json:"durationMs"`
-	Status     int       `json:"status"`
-	Retries    int       `json:"retries"`
-	Success    bool      `json:"success"`
-	Error      string    `json:"error,omitempty"`
-	ClientIP   string    `json:"clientIp,omitempty"`
+	ID         string            `json:"id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Upstream   string            `json:"upstreamUrl,omitempty"`
+	Model      string            `json:"model"`
+	Streaming  bool              `json:"streaming"`
+	Antiblock  bool              `json:"antiblockEnabled"`
+	Mode       string            `json:"handlingMode,omitempty"`
+	DurationMs int64             `json:"durationMs"`
+	Status     int               `json:"status"`
+	Retries    int               `json:"retries"`
+	Hedges     int               `json:"hedges,omitempty"`
+	Attempts   []AttemptEntry    `json:"attempts,omitempty"`
+	Overrides  map[string]string `json:"overrides,omitempty"`
+	Blocks     []BlockEntry      `json:"blocks,omitempty"`
+	APIKeys    []string          `json:"apiKeys,omitempty"`
+	Success    bool              `json:"success"`
+	Cancelled  bool              `json:"cancelled,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	ClientIP   string            `json:"clientIp,omitempty"`
+	Client     string            `json:"client,omitempty"`
 }
 
 // Stats represents aggregated counters for display.
 type Stats struct {
-	TotalRequests int64     `json:"totalRequests"`
-	RetryCount    int64     `json:"retryCount"`
-	ErrorCount    int64     `json:"errorCount"`
-	SuccessCount  int64     `json:"successCount"`
-	LastActivity  time.Time `json:"lastActivity"`
+	TotalRequests  int64     `json:"totalRequests"`
+	RetryCount     int64     `json:"retryCount"`
+	HedgeCount     int64     `json:"hedgeCount"`
+	ErrorCount     int64     `json:"errorCount"`
+	SuccessCount   int64     `json:"successCount"`
+	CancelledCount int64     `json:"cancelledCount"`
+	LastActivity   time.Time `json:"lastActivity"`
 }
 
 // Snapshot is the top-level JSON returned to UI.
@@ -46,10 +73,12 @@ type Snapshot struct {
 
 var (
 	// counters
-	totalRequests int64
-	retryCount    int64
-	errorCount    int64
-	successCount  int64
+	totalRequests  int64
+	retryCount     int64
+	hedgeCount     int64
+	errorCount     int64
+	successCount   int64
+	cancelledCount int64
 
 	lastActivityMu sync.RWMutex
 	lastActivity   time.Time
@@ -115,16 +144,34 @@ func IncRetry(requestID string) {
 	})
 }
 
+// IncHedge increments hedged attempt counters for the given request.
+func IncHedge(requestID string) {
+	atomic.AddInt64(&hedgeCount, 1)
+	sessMu.Lock()
+	if s, ok := sessions[requestID]; ok {
+		s.Hedges++
+	}
+	sessMu.Unlock()
+
+	broadcastEvent(map[string]interface{}{
+		"type":      "hedge",
+		"requestId": requestID,
+	})
+}
+
 // FinishRequest finalizes a session and appends it to the ring buffer.
+// A status of StatusClientClosedRequest records the request as cancelled by the client.
 func FinishRequest(requestID string, status int, success bool, errMsg string) {
 	now := time.Now().UTC()
 	setLastActivity(now)
+	cancelled := status == StatusClientClosedRequest
 
 	sessMu.Lock()
 	s, ok := sessions[requestID]
 	if ok {
 		s.Status = status
 		s.Success = success
+		s.Cancelled = cancelled
 		s.Error = errMsg
 		s.DurationMs = now.Sub(s.Timestamp).Milliseconds()
 		delete(sessions, requestID)
@@ -133,6 +180,8 @@ func FinishRequest(requestID string, status int, success bool, errMsg string) {
 
 	if success {
 		atomic.AddInt64(&successCount, 1)
+	} else if cancelled {
+		atomic.AddInt64(&cancelledCount, 1)
 	} else {
 		atomic.AddInt64(&errorCount, 1)
 	}
@@ -164,6 +213,58 @@ func SetUpstream(requestID, upstream string) {
 	sessMu.Unlock()
 }
 
+// RecordAttempt appends the upstream chosen for an attempt of an active request.
+// The reason is the interruption that triggered the attempt ("" for the initial one).
+func RecordAttempt(requestID, upstream, reason string) {
+	normalized := normalizeUpstreamDisplay(upstream)
+
+	sessMu.Lock()
+	if s, ok := sessions[requestID]; ok {
+		s.Attempts = append(s.Attempts, AttemptEntry{
+			Attempt:  len(s.Attempts) + 1,
+			Upstream: normalized,
+			Reason:   reason,
+		})
+	}
+	sessMu.Unlock()
+}
+
+// RecordBlock appends a safety block category and the action taken for an active request.
+func RecordBlock(requestID, category, action string) {
+	sessMu.Lock()
+	if s, ok := sessions[requestID]; ok {
+		s.Blocks = append(s.Blocks, BlockEntry{Category: category, Action: action})
+	}
+	sessMu.Unlock()
+}
+
+// RecordAPIKey appends the (masked) upstream API key used by an attempt of an active request.
+func RecordAPIKey(requestID, key string) {
+	sessMu.Lock()
+	if s, ok := sessions[requestID]; ok {
+		s.APIKeys = append(s.APIKeys, key)
+	}
+	sessMu.Unlock()
+}
+
+// SetClient records the name of the proxy-issued client token an active request used.
+func SetClient(requestID, name string) {
+	sessMu.Lock()
+	if s, ok := sessions[requestID]; ok {
+		s.Client = name
+	}
+	sessMu.Unlock()
+}
+
+// SetOverrides records the client antiblock overrides in effect for an active request.
+func SetOverrides(requestID string, overrides map[string]string) {
+	sessMu.Lock()
+	if s, ok := sessions[requestID]; ok {
+		s.Overrides = overrides
+	}
+	sessMu.Unlock()
+}
+
 func normalizeUpstreamDisplay(raw string) string {
 	if raw == "" {
 		return ""
@@ -181,11 +282,13 @@ func normalizeUpstreamDisplay(raw string) string {
 // Snapshot returns current stats and recent logs.
 func GetSnapshot(limit int) Snapshot {
 	stats := Stats{
-		TotalRequests: atomic.LoadInt64(&totalRequests),
-		RetryCount:    atomic.LoadInt64(&retryCount),
-		ErrorCount:    atomic.LoadInt64(&errorCount),
-		SuccessCount:  atomic.LoadInt64(&successCount),
-		LastActivity:  getLastActivity(),
+		TotalRequests:  atomic.LoadInt64(&totalRequests),
+		RetryCount:     atomic.LoadInt64(&retryCount),
+		HedgeCount:     atomic.LoadInt64(&hedgeCount),
+		ErrorCount:     atomic.LoadInt64(&errorCount),
+		SuccessCount:   atomic.LoadInt64(&successCount),
+		CancelledCount: atomic.LoadInt64(&cancelledCount),
+		LastActivity:   getLastActivity(),
 	}
 
 	ringMu.RLock()
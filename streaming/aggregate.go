@@ -0,0 +1,234 @@
+package streaming
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"gemini-antiblock/logger"
+)
+
+// ResponseAggregator collects the SSE output of the stream processor and
+// reassembles it into a single GenerateContentResponse for non-streaming clients.
+type ResponseAggregator struct {
+	pending        []byte
+	candidates     map[int]map[string]interface{}
+	usageMetadata  interface{}
+	antiblockUsage interface{}
+	modelVersion   interface{}
+	responseID     interface{}
+	promptFeedback interface{}
+	errorPayload   map[string]interface{}
+	chunkCount     int
+}
+
+// NewResponseAggregator creates an empty aggregator.
+func NewResponseAggregator() *ResponseAggregator {
+	return &ResponseAggregator{
+		candidates: make(map[int]map[string]interface{}),
+	}
+}
+
+// Write implements io.Writer. The stream processor writes complete SSE events,
+// but events are buffered until their terminating blank line to be safe.
+func (a *ResponseAggregator) Write(p []byte) (int, error) {
+	a.pending = append(a.pending, p...)
+	for {
+		idx := bytes.Index(a.pending, []byte("\n\n"))
+		if idx == -1 {
+			break
+		}
+		event := string(a.pending[:idx])
+		a.pending = a.pending[idx+2:]
+		a.consumeEvent(event)
+	}
+	return len(p), nil
+}
+
+func (a *ResponseAggregator) consumeEvent(event string) {
+	eventType := ""
+	var dataLines []string
+	for _, line := range strings.Split(event, "\n") {
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			dataLines = append(dataLines, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if len(dataLines) == 0 {
+		return
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.Join(dataLines, "\n")), &data); err != nil {
+		logger.LogDebug("Aggregator failed to parse event data:", err)
+		return
+	}
+
+	if eventType == "error" {
+		a.errorPayload = data
+		return
+	}
+	if _, isError := data["error"]; isError {
+		a.errorPayload = data
+		return
+	}
+
+	a.chunkCount++
+	a.mergeChunk(data)
+}
+
+func (a *ResponseAggregator) mergeChunk(data map[string]interface{}) {
+	if v, ok := data["usageMetadata"]; ok {
+		a.usageMetadata = v
+	}
+	if v, ok := data["antiblockUsage"]; ok {
+		a.antiblockUsage = v
+	}
+	if v, ok := data["modelVersion"]; ok {
+		a.modelVersion = v
+	}
+	if v, ok := data["responseId"]; ok {
+		a.responseID = v
+	}
+	if v, ok := data["promptFeedback"]; ok && a.promptFeedback == nil {
+		a.promptFeedback = v
+	}
+
+	candidates, _ := data["candidates"].([]interface{})
+	for i, raw := range candidates {
+		candidate, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index := i
+		if idx, ok := candidate["index"].(float64); ok {
+			index = int(idx)
+		}
+
+		merged, exists := a.candidates[index]
+		if !exists {
+			merged = map[string]interface{}{
+				"content": map[string]interface{}{
+					"role":  "model",
+					"parts": []interface{}{},
+				},
+			}
+			if _, hasIndex := candidate["index"]; hasIndex {
+				merged["index"] = index
+			}
+			a.candidates[index] = merged
+		}
+
+		for key, value := range candidate {
+			switch key {
+			case "content":
+				if content, ok := value.(map[string]interface{}); ok {
+					if parts, ok := content["parts"].([]interface{}); ok {
+						mergedContent := merged["content"].(map[string]interface{})
+						mergedContent["parts"] = appendMergedParts(mergedContent["parts"].([]interface{}), parts)
+					}
+				}
+			case "citationMetadata":
+				merged[key] = mergeCitationMetadata(merged[key], value)
+			case "index":
+			default:
+				merged[key] = value
+			}
+		}
+	}
+}
+
+// appendMergedParts appends parts, concatenating consecutive text parts that share
+// the same thought flag so the final response has one part per logical block.
+func appendMergedParts(existing []interface{}, parts []interface{}) []interface{} {
+	for _, raw := range parts {
+		part, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		text, isText := part["text"].(string)
+		if isText && len(existing) > 0 {
+			if last, ok := existing[len(existing)-1].(map[string]interface{}); ok {
+				lastText, lastIsText := last["text"].(string)
+				lastThought, _ := last["thought"].(bool)
+				thought, _ := part["thought"].(bool)
+				if lastIsText && lastThought == thought {
+					last["text"] = lastText + text
+					if sig, ok := part["thoughtSignature"]; ok {
+						last["thoughtSignature"] = sig
+					}
+					continue
+				}
+			}
+		}
+		copied := make(map[string]interface{}, len(part))
+		for k, v := range part {
+			copied[k] = v
+		}
+		existing = append(existing, copied)
+	}
+	return existing
+}
+
+func mergeCitationMetadata(existing, incoming interface{}) interface{} {
+	in, ok := incoming.(map[string]interface{})
+	if !ok {
+		return existing
+	}
+	cur, ok := existing.(map[string]interface{})
+	if !ok {
+		return in
+	}
+	curSources, _ := cur["citationSources"].([]interface{})
+	inSources, _ := in["citationSources"].([]interface{})
+	cur["citationSources"] = append(curSources, inSources...)
+	return cur
+}
+
+// Error returns the error payload emitted by the stream processor, if any.
+func (a *ResponseAggregator) Error() map[string]interface{} {
+	return a.errorPayload
+}
+
+// ChunkCount returns the number of response chunks merged so far.
+func (a *ResponseAggregator) ChunkCount() int {
+	return a.chunkCount
+}
+
+// Response builds the reassembled GenerateContentResponse.
+func (a *ResponseAggregator) Response() map[string]interface{} {
+	indexes := make([]int, 0, len(a.candidates))
+	for idx := range a.candidates {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	candidates := make([]interface{}, 0, len(indexes))
+	for _, idx := range indexes {
+		candidates = append(candidates, a.candidates[idx])
+	}
+
+	response := map[string]interface{}{}
+	if len(candidates) > 0 {
+		response["candidates"] = candidates
+	}
+	if a.promptFeedback != nil {
+		response["promptFeedback"] = a.promptFeedback
+	}
+	if a.usageMetadata != nil {
+		response["usageMetadata"] = a.usageMetadata
+	}
+	if a.antiblockUsage != nil {
+		response["antiblockUsage"] = a.antiblockUsage
+	}
+	if a.modelVersion != nil {
+		response["modelVersion"] = a.modelVersion
+	}
+	if a.responseID != nil {
+		response["responseId"] = a.responseID
+	}
+	return response
+}
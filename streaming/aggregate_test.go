@@ -0,0 +1,121 @@
+package streaming
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResponseAggregator(t *testing.T) {
+	tests := []struct {
+		name      string
+		writes    []string
+		want      string
+		wantError string
+		wantCount int
+	}{
+		{
+			name: "text chunks with finish reason and usage",
+			writes: []string{
+				`data: {"candidates":[{"content":{"role":"model","parts":[{"text":"Hello"}]}}],"modelVersion":"gemini-2.5-pro","responseId":"r1"}` + "\n\n",
+				`data: {"candidates":[{"content":{"role":"model","parts":[{"text":", world."}]}}]}` + "\n\n",
+				`data: {"candidates":[{"content":{"role":"model","parts":[]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":4,"totalTokenCount":7}}` + "\n\n",
+			},
+			want: `{
+				"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello, world."}]}, "finishReason": "STOP"}],
+				"usageMetadata": {"promptTokenCount": 3, "candidatesTokenCount": 4, "totalTokenCount": 7},
+				"modelVersion": "gemini-2.5-pro",
+				"responseId": "r1"
+			}`,
+			wantCount: 3,
+		},
+		{
+			name: "thoughts, text and function calls stay separate parts",
+			writes: []string{
+				`data: {"candidates":[{"content":{"parts":[{"text":"Plan","thought":true}]}}]}` + "\n\n",
+				`data: {"candidates":[{"content":{"parts":[{"text":" more","thought":true},{"text":"Calling."}]}}]}` + "\n\n",
+				`data: {"candidates":[{"content":{"parts":[{"functionCall":{"name":"f","args":{}}}]},"finishReason":"STOP"}]}` + "\n\n",
+			},
+			want: `{
+				"candidates": [{"content": {"role": "model", "parts": [
+					{"text": "Plan more", "thought": true},
+					{"text": "Calling."},
+					{"functionCall": {"name": "f", "args": {}}}
+				]}, "finishReason": "STOP"}]
+			}`,
+			wantCount: 3,
+		},
+		{
+			name: "candidates are merged by index",
+			writes: []string{
+				`data: {"candidates":[{"index":1,"content":{"parts":[{"text":"B"}]}},{"index":0,"content":{"parts":[{"text":"A"}]}}]}` + "\n\n",
+				`data: {"candidates":[{"index":0,"content":{"parts":[{"text":"a"}]},"finishReason":"STOP"},{"index":1,"content":{"parts":[{"text":"b"}]},"finishReason":"MAX_TOKENS"}]}` + "\n\n",
+			},
+			want: `{
+				"candidates": [
+					{"index": 0, "content": {"role": "model", "parts": [{"text": "Aa"}]}, "finishReason": "STOP"},
+					{"index": 1, "content": {"role": "model", "parts": [{"text": "Bb"}]}, "finishReason": "MAX_TOKENS"}
+				]
+			}`,
+			wantCount: 2,
+		},
+		{
+			name: "events split across writes and progress comments",
+			writes: []string{
+				": keep-alive\n\n",
+				`data: {"candidates":[{"content":{"parts":[{"te`,
+				`xt":"Done."}]},"finishReason":"STOP"}]}` + "\n",
+				"\n",
+			},
+			want:      `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Done."}]}, "finishReason": "STOP"}]}`,
+			wantCount: 1,
+		},
+		{
+			name: "error event",
+			writes: []string{
+				`data: {"candidates":[{"content":{"parts":[{"text":"Partial"}]}}]}` + "\n\n",
+				"event: error\ndata: {\"error\":{\"code\":500,\"message\":\"boom\"}}\n\n",
+			},
+			want:      `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Partial"}]}}]}`,
+			wantError: "boom",
+			wantCount: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregator := NewResponseAggregator()
+			for _, w := range tt.writes {
+				if _, err := aggregator.Write([]byte(w)); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+
+			if got := aggregator.ChunkCount(); got != tt.wantCount {
+				t.Errorf("ChunkCount() = %d; want %d", got, tt.wantCount)
+			}
+			message := ""
+			if payload := aggregator.Error(); payload != nil {
+				message, _ = payload["error"].(map[string]interface{})["message"].(string)
+			}
+			if message != tt.wantError {
+				t.Errorf("error message = %q; want %q", message, tt.wantError)
+			}
+
+			// Compare as JSON so numbers and nesting match what the client receives.
+			encoded, err := json.Marshal(aggregator.Response())
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			var got, want interface{}
+			json.Unmarshal(encoded, &got)
+			if err := json.NewDecoder(strings.NewReader(tt.want)).Decode(&want); err != nil {
+				t.Fatalf("bad want: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Response() = %s; want %s", encoded, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+)
+
+// blockFinishReasons are the candidate finish reasons that mean the response was blocked.
+var blockFinishReasons = map[string]bool{
+	"SAFETY":             true,
+	"RECITATION":         true,
+	"PROHIBITED_CONTENT": true,
+	"BLOCKLIST":          true,
+	"SPII":               true,
+	"IMAGE_SAFETY":       true,
+}
+
+// BlockReason returns the retry reason of a block category, e.g. "BLOCK_SAFETY".
+func BlockReason(category string) string {
+	return ReasonBlock + "_" + category
+}
+
+// promptBlockCategory returns the category of a prompt-level block, e.g. "PROMPT_SAFETY",
+// when a chunk's promptFeedback reports that the prompt itself was blocked.
+func promptBlockCategory(data map[string]interface{}) (string, bool) {
+	feedback, _ := data["promptFeedback"].(map[string]interface{})
+	reason, _ := feedback["blockReason"].(string)
+	if reason == "" {
+		return "", false
+	}
+	return "PROMPT_" + reason, true
+}
+
+// chunkBlocked reports whether a chunk blocks its prompt or any of its candidates.
+func chunkBlocked(data map[string]interface{}) bool {
+	if _, blocked := promptBlockCategory(data); blocked {
+		return true
+	}
+	candidates, _ := data["candidates"].([]interface{})
+	for _, raw := range candidates {
+		if candidate, ok := raw.(map[string]interface{}); ok {
+			if reason, _ := candidate["finishReason"].(string); blockFinishReasons[reason] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// endsCandidate reports whether an accepted chunk with this finish reason is the
+// candidate's last. Block finish reasons are only accepted when passed through.
+func endsCandidate(finishReason string) bool {
+	return finishReason == "STOP" || finishReason == "MAX_TOKENS" || blockFinishReasons[finishReason]
+}
+
+// blockAction looks up the policy for a block category and returns its action. Each
+// category is logged and recorded once per attempt. A failing block is remembered so the
+// session ends with an error.
+func (s *streamSession) blockAction(category string) string {
+	policy := s.cfg.BlockPolicyFor(category)
+	if !s.attemptBlocks[category] {
+		if s.attemptBlocks == nil {
+			s.attemptBlocks = map[string]bool{}
+		}
+		s.attemptBlocks[category] = true
+		logger.LogError(fmt.Sprintf("Content blocked (%s). Block policy: %s", category, policy.Action))
+		if s.requestID != "" {
+			metrics.RecordBlock(s.requestID, category, policy.Action)
+		}
+	}
+	if policy.Action == config.BlockActionFail {
+		s.failedBlock = category
+	}
+	return policy.Action
+}
+
+// failBlocked ends the session with a Google-style error for a block category.
+func (s *streamSession) failBlocked(category string, retries int, started time.Time) error {
+	logger.LogError(fmt.Sprintf("=== CONTENT BLOCKED (%s) - FAILING REQUEST ===", category))
+	s.emitSummary(ProgressStatusBlocked, retries, started)
+	errorBytes, _ := json.Marshal(blockError(category))
+	if err := s.write("event: error\ndata: " + string(errorBytes)); err != nil {
+		return err
+	}
+	return ErrContentBlocked
+}
+
+// blockError builds the Google-style error sent when a block policy fails the request.
+func blockError(category string) map[string]interface{} {
+	subject, reason := "response", category
+	if promptReason, ok := strings.CutPrefix(category, "PROMPT_"); ok {
+		subject, reason = "prompt", promptReason
+	}
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    400,
+			"status":  "INVALID_ARGUMENT",
+			"message": fmt.Sprintf("The %s was blocked by the upstream safety filters (%s).", subject, reason),
+			"details": []interface{}{
+				map[string]interface{}{
+					"@type":    "proxy.block",
+					"category": category,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,88 @@
+package streaming
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/metrics"
+)
+
+func TestChunkBlocked(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		wantBlocked  bool
+		wantCategory string
+	}{
+		{"plain text", `{"candidates": [{"content": {"parts": [{"text": "Hi"}]}}]}`, false, ""},
+		{"normal stop", `{"candidates": [{"finishReason": "STOP"}]}`, false, ""},
+		{"safety finish reason", `{"candidates": [{"finishReason": "SAFETY"}]}`, true, ""},
+		{"second candidate blocked", `{"candidates": [{"finishReason": "STOP"}, {"finishReason": "RECITATION"}]}`, true, ""},
+		{"blocked prompt", `{"promptFeedback": {"blockReason": "SAFETY"}}`, true, "PROMPT_SAFETY"},
+		{"prompt feedback without a block", `{"promptFeedback": {"safetyRatings": []}}`, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := decodeJSON(t, tt.data)
+			if got := chunkBlocked(data); got != tt.wantBlocked {
+				t.Errorf("chunkBlocked() = %v; want %v", got, tt.wantBlocked)
+			}
+			category, ok := promptBlockCategory(data)
+			if category != tt.wantCategory || ok != (tt.wantCategory != "") {
+				t.Errorf("promptBlockCategory() = %q, %v; want %q", category, ok, tt.wantCategory)
+			}
+		})
+	}
+}
+
+func TestBlockActionRecordsOncePerAttempt(t *testing.T) {
+	const requestID = "block-action-test"
+	metrics.StartRequest(httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:streamGenerateContent", nil), requestID, true, "", true, "")
+
+	cfg := &config.Config{BlockPolicies: map[string]config.BlockPolicy{
+		"SAFETY": {Action: config.BlockActionRetry, Retries: 3},
+		"PROMPT": {Action: config.BlockActionFail},
+	}}
+	session := newTestSession(cfg, nil, nil)
+	session.requestID = requestID
+
+	// Two candidates blocked in the same attempt count once.
+	session.attemptBlocks = map[string]bool{}
+	for i := 0; i < 2; i++ {
+		if got := session.blockAction("SAFETY"); got != config.BlockActionRetry {
+			t.Errorf("blockAction(SAFETY) = %q; want %q", got, config.BlockActionRetry)
+		}
+	}
+	if session.failedBlock != "" {
+		t.Errorf("failedBlock = %q after a retried block", session.failedBlock)
+	}
+
+	// The next attempt counts again.
+	session.attemptBlocks = map[string]bool{}
+	session.blockAction("SAFETY")
+	if got := session.blockAction("PROMPT_SAFETY"); got != config.BlockActionFail {
+		t.Errorf("blockAction(PROMPT_SAFETY) = %q; want %q", got, config.BlockActionFail)
+	}
+	if session.failedBlock != "PROMPT_SAFETY" {
+		t.Errorf("failedBlock = %q; want PROMPT_SAFETY", session.failedBlock)
+	}
+
+	metrics.FinishRequest(requestID, 400, false, "")
+	var got []metrics.BlockEntry
+	for _, entry := range metrics.GetSnapshot(0).Logs {
+		if entry.ID == requestID {
+			got = entry.Blocks
+		}
+	}
+	want := []metrics.BlockEntry{
+		{Category: "SAFETY", Action: config.BlockActionRetry},
+		{Category: "SAFETY", Action: config.BlockActionRetry},
+		{Category: "PROMPT_SAFETY", Action: config.BlockActionFail},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded blocks = %+v; want %+v", got, want)
+	}
+}
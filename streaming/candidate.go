@@ -0,0 +1,121 @@
+package streaming
+
+import "sort"
+
+// candidateState tracks one response candidate across stream attempts.
+type candidateState struct {
+	index int
+	// text is the formal text forwarded to the client for this candidate so far.
+	text string
+	// outputFormalText is set once any formal text has been forwarded.
+	outputFormalText bool
+	finished         bool
+	// interruption is the reason the candidate stopped early, cleared when it is resumed.
+	interruption string
+	// swallowing drops thought chunks after a retry until formal text resumes.
+	swallowing bool
+	// parts is the model turn streamed so far, including thoughts and thought signatures,
+	// replayed as history on retries according to the thought history mode.
+	parts []interface{}
+	// functionCalls counts the functionCall parts forwarded for this candidate.
+	functionCalls int
+	// tokensUsed is the output (candidate plus thinking) tokens spent on this candidate
+	// across attempts, measured against maxOutputTokens.
+	tokensUsed int
+}
+
+// streaming reports whether the candidate is still expected to produce output.
+func (c *candidateState) streaming() bool {
+	return !c.finished && c.interruption == ""
+}
+
+// candidateSet holds the state of every candidate of a response, keyed by index.
+type candidateSet struct {
+	states map[int]*candidateState
+}
+
+// newCandidateSet pre-creates the candidates the request asked for, so one that never
+// shows up before a drop is still resumed.
+func newCandidateSet(expected int) *candidateSet {
+	set := &candidateSet{states: make(map[int]*candidateState)}
+	for i := 0; i < expected; i++ {
+		set.get(i)
+	}
+	return set
+}
+
+func (s *candidateSet) get(index int) *candidateState {
+	state, ok := s.states[index]
+	if !ok {
+		state = &candidateState{index: index}
+		s.states[index] = state
+	}
+	return state
+}
+
+// ordered returns the candidates sorted by index.
+func (s *candidateSet) ordered() []*candidateState {
+	list := make([]*candidateState, 0, len(s.states))
+	for _, state := range s.states {
+		list = append(list, state)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].index < list[j].index })
+	return list
+}
+
+// nextUnfinished returns the lowest-index candidate that still needs a retry, or nil.
+func (s *candidateSet) nextUnfinished() *candidateState {
+	for _, state := range s.ordered() {
+		if !state.finished {
+			return state
+		}
+	}
+	return nil
+}
+
+func (s *candidateSet) totalChars() int {
+	total := 0
+	for _, state := range s.states {
+		total += len(state.text)
+	}
+	return total
+}
+
+// requestedCandidateCount returns generationConfig.candidateCount, defaulting to 1.
+func requestedCandidateCount(body map[string]interface{}) int {
+	if genConfig, ok := body["generationConfig"].(map[string]interface{}); ok {
+		if count, ok := genConfig["candidateCount"].(float64); ok && count > 1 {
+			return int(count)
+		}
+	}
+	return 1
+}
+
+// singleCandidateBody copies body with candidateCount forced to 1, so a retry resumes
+// exactly one interrupted candidate.
+func singleCandidateBody(body map[string]interface{}) map[string]interface{} {
+	return withGenerationConfig(body, "candidateCount", 1)
+}
+
+// removeThoughtParts drops thought parts from a candidate, returning true if any were removed.
+func removeThoughtParts(candidate map[string]interface{}) bool {
+	content, ok := candidate["content"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	parts, _ := content["parts"].([]interface{})
+	kept := make([]interface{}, 0, len(parts))
+	for _, raw := range parts {
+		if part, ok := raw.(map[string]interface{}); ok {
+			if thought, _ := part["thought"].(bool); thought {
+				continue
+			}
+		}
+		kept = append(kept, raw)
+	}
+	if len(kept) == len(parts) {
+		return false
+	}
+	content["parts"] = kept
+	return true
+}
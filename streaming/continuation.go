@@ -0,0 +1,217 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// Continuation strategies control how a retry request asks the model to resume.
+const (
+	// ContinuationPrefill ends the conversation with the partial model turn, letting the
+	// model extend it without any instruction.
+	ContinuationPrefill = "prefill"
+	// ContinuationUser follows the partial model turn with a user turn carrying the prompt.
+	ContinuationUser = "user"
+	// ContinuationSystem replays the partial model turn and appends the prompt to the
+	// system instruction instead of adding a user turn.
+	ContinuationSystem = "system"
+	// ContinuationRestart resends the original request; the text the client already
+	// received is skipped from the regenerated output.
+	ContinuationRestart = "restart"
+)
+
+// Built-in continuation prompts, used when no CONTINUATION_PROMPT_RULES entry matches.
+const (
+	DefaultContinuationPrompt   = "Continue exactly where you left off without any preamble or repetition."
+	DefaultContinuationPromptZH = "请从上次中断的地方直接继续输出，不要添加任何开场白，也不要重复已经输出的内容。"
+)
+
+// continuationTailRunes is how much of the accumulated text the {tail} placeholder expands to.
+const continuationTailRunes = 50
+
+// Continuation describes how one retry request resumes a candidate.
+type Continuation struct {
+	Strategy string
+	// Prompt is the instruction used by the user and system strategies.
+	Prompt string
+}
+
+// ResolveContinuationStrategy picks the continuation strategy for a model using the
+// longest matching prefix rule, falling back to the default.
+func ResolveContinuationStrategy(cfg *config.Config, model string) string {
+	strategy := cfg.ContinuationStrategy
+	if value, ok := config.MatchPrefixRule(cfg.ContinuationStrategyRules, model); ok {
+		strategy = value
+	}
+	strategy = strings.ToLower(strategy)
+	switch strategy {
+	case ContinuationPrefill, ContinuationUser, ContinuationSystem, ContinuationRestart:
+		return strategy
+	default:
+		logger.LogError(fmt.Sprintf("Invalid continuation strategy '%s' for model '%s'. Falling back to '%s'.", strategy, model, ContinuationUser))
+		return ContinuationUser
+	}
+}
+
+// ContinuationPrompt renders the continuation prompt for a model and the language of the
+// session. Rules are "model-prefix[@lang]=template"; the longest prefix wins and a rule
+// for the session's language beats one without a language. Templates may use {tail}
+// (the end of the text produced so far) and {model}.
+func ContinuationPrompt(cfg *config.Config, model string, body map[string]interface{}, accumulatedText string) string {
+	language := sessionLanguage(body, accumulatedText)
+
+	template := DefaultContinuationPrompt
+	if language == "zh" {
+		template = DefaultContinuationPromptZH
+	}
+	best := -1
+	for _, rule := range cfg.ContinuationPromptRules {
+		prefix, ruleLanguage, _ := strings.Cut(rule.Prefix, "@")
+		if ruleLanguage != "" && !strings.EqualFold(ruleLanguage, language) {
+			continue
+		}
+		score := 2 * len(prefix)
+		if prefix == "*" {
+			score = 0
+		} else if model == "" || !strings.HasPrefix(model, prefix) {
+			continue
+		}
+		if ruleLanguage != "" {
+			score++
+		}
+		if score > best {
+			best = score
+			template = rule.Value
+		}
+	}
+
+	prompt := strings.ReplaceAll(template, "{tail}", tailRunes(accumulatedText, continuationTailRunes))
+	prompt = strings.ReplaceAll(prompt, "{model}", model)
+	return prompt
+}
+
+// sessionLanguage guesses the language to resume in from the text produced so far, or
+// from the last user turn when nothing was produced yet. Only "zh" and "en" are told apart.
+func sessionLanguage(body map[string]interface{}, accumulatedText string) string {
+	sample := accumulatedText
+	if strings.TrimSpace(sample) == "" {
+		sample = lastUserText(body)
+	}
+
+	han, letters := 0, 0
+	for _, r := range sample {
+		if unicode.Is(unicode.Han, r) {
+			han++
+			letters++
+		} else if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	if letters > 0 && han*10 >= letters*3 {
+		return "zh"
+	}
+	return "en"
+}
+
+// lastUserText returns the text of the last user turn of a request body.
+func lastUserText(body map[string]interface{}) string {
+	contents, _ := body["contents"].([]interface{})
+	for i := len(contents) - 1; i >= 0; i-- {
+		content, ok := contents[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if role, _ := content["role"].(string); role != "user" && role != "" {
+			continue
+		}
+		var text strings.Builder
+		parts, _ := content["parts"].([]interface{})
+		for _, raw := range parts {
+			if part, ok := raw.(map[string]interface{}); ok {
+				if t, ok := part["text"].(string); ok {
+					text.WriteString(t)
+				}
+			}
+		}
+		return text.String()
+	}
+	return ""
+}
+
+// withSystemInstructionPart copies body with one text part appended to its system
+// instruction, leaving the original request untouched. Like InjectSystemPrompt, it
+// merges a snake_case system_instruction into systemInstruction first, so only one of
+// the two is sent upstream.
+func withSystemInstructionPart(body map[string]interface{}, text string) map[string]interface{} {
+	copied := make(map[string]interface{}, len(body))
+	for k, v := range body {
+		copied[k] = v
+	}
+
+	instruction := map[string]interface{}{}
+	if existing, ok := body["systemInstruction"].(map[string]interface{}); ok {
+		for k, v := range existing {
+			instruction[k] = v
+		}
+	}
+	parts, _ := instruction["parts"].([]interface{})
+	var snakeParts []interface{}
+	if snake, ok := body["system_instruction"].(map[string]interface{}); ok {
+		snakeParts, _ = snake["parts"].([]interface{})
+	}
+	delete(copied, "system_instruction")
+
+	newParts := make([]interface{}, 0, len(snakeParts)+len(parts)+1)
+	newParts = append(newParts, snakeParts...)
+	newParts = append(newParts, parts...)
+	instruction["parts"] = append(newParts, map[string]interface{}{"text": text})
+	copied["systemInstruction"] = instruction
+	return copied
+}
+
+// SkipReplayedText wraps the line channel of a restarted attempt and drops the formal
+// text the client already received, sent. The skip is positional: it assumes the
+// regenerated answer opens with exactly the same text, which holds for deterministic
+// sampling but not in general. The replayed text is compared with sent, and a divergence
+// is logged, since the output after it no longer continues what the client has.
+func SkipReplayedText(ctx context.Context, in <-chan string, sent string) <-chan string {
+	out := make(chan string, 100)
+	replay := []rune(sent)
+	go func() {
+		defer close(out)
+		pos, diverged := 0, false
+		for line := range in {
+			if pos < len(replay) {
+				content := ParseLineContent(line)
+				if content.Text != "" && !content.IsThought {
+					text := []rune(content.Text)
+					cut := min(len(replay)-pos, len(text))
+					if !diverged && string(text[:cut]) != string(replay[pos:pos+cut]) {
+						diverged = true
+						logger.LogError(fmt.Sprintf("Restarted attempt diverged from the text already sent after %d characters; the remaining replay is skipped by length", pos))
+					}
+					pos += cut
+					if cut == len(text) && ExtractFinishReason(line) == "" && !IsBlockedLine(line) {
+						continue
+					}
+					remaining, prefix := len(string(text[:cut])), ""
+					line, _ = trimLeadingText(line, &remaining, &prefix)
+					if pos == len(replay) {
+						logger.LogDebug("Restarted attempt caught up with the text already sent")
+					}
+				}
+			}
+			select {
+			case out <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
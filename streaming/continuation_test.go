@@ -0,0 +1,295 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gemini-antiblock/config"
+)
+
+// decodeJSON decodes a JSON literal used as a test fixture.
+func decodeJSON(t *testing.T, raw string) map[string]interface{} {
+	t.Helper()
+	var value map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		t.Fatalf("bad fixture %s: %v", raw, err)
+	}
+	return value
+}
+
+// normalizeJSON round-trips a value through JSON so it compares equal to a decoded fixture.
+func normalizeJSON(t *testing.T, value interface{}) interface{} {
+	t.Helper()
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded interface{}
+	json.Unmarshal(encoded, &decoded)
+	return decoded
+}
+
+func TestBuildContinuationBody(t *testing.T) {
+	const request = `{
+		"contents": [
+			{"role": "user", "parts": [{"text": "Question"}]}
+		],
+		"generationConfig": {"temperature": 0}
+	}`
+	modelParts := []interface{}{map[string]interface{}{"text": "Partial answer"}}
+
+	tests := []struct {
+		name     string
+		request  string
+		strategy string
+		want     string
+	}{
+		{
+			name:     "user strategy adds a user turn",
+			request:  request,
+			strategy: ContinuationUser,
+			want: `{
+				"contents": [
+					{"role": "user", "parts": [{"text": "Question"}]},
+					{"role": "model", "parts": [{"text": "Partial answer"}]},
+					{"role": "user", "parts": [{"text": "Go on."}]}
+				],
+				"generationConfig": {"temperature": 0}
+			}`,
+		},
+		{
+			name:     "prefill strategy ends with the model turn",
+			request:  request,
+			strategy: ContinuationPrefill,
+			want: `{
+				"contents": [
+					{"role": "user", "parts": [{"text": "Question"}]},
+					{"role": "model", "parts": [{"text": "Partial answer"}]}
+				],
+				"generationConfig": {"temperature": 0}
+			}`,
+		},
+		{
+			name:     "system strategy without a system instruction",
+			request:  request,
+			strategy: ContinuationSystem,
+			want: `{
+				"contents": [
+					{"role": "user", "parts": [{"text": "Question"}]},
+					{"role": "model", "parts": [{"text": "Partial answer"}]}
+				],
+				"systemInstruction": {"parts": [{"text": "Go on."}]},
+				"generationConfig": {"temperature": 0}
+			}`,
+		},
+		{
+			name: "system strategy with a camelCase system instruction",
+			request: `{
+				"systemInstruction": {"role": "system", "parts": [{"text": "Be brief."}]},
+				"contents": [{"role": "user", "parts": [{"text": "Question"}]}]
+			}`,
+			strategy: ContinuationSystem,
+			want: `{
+				"systemInstruction": {"role": "system", "parts": [{"text": "Be brief."}, {"text": "Go on."}]},
+				"contents": [
+					{"role": "user", "parts": [{"text": "Question"}]},
+					{"role": "model", "parts": [{"text": "Partial answer"}]}
+				]
+			}`,
+		},
+		{
+			name: "system strategy with a snake_case system instruction",
+			request: `{
+				"system_instruction": {"parts": [{"text": "Be brief."}]},
+				"contents": [{"role": "user", "parts": [{"text": "Question"}]}]
+			}`,
+			strategy: ContinuationSystem,
+			want: `{
+				"systemInstruction": {"parts": [{"text": "Be brief."}, {"text": "Go on."}]},
+				"contents": [
+					{"role": "user", "parts": [{"text": "Question"}]},
+					{"role": "model", "parts": [{"text": "Partial answer"}]}
+				]
+			}`,
+		},
+		{
+			name: "system strategy with both spellings",
+			request: `{
+				"system_instruction": {"parts": [{"text": "Snake."}]},
+				"systemInstruction": {"parts": [{"text": "Camel."}]},
+				"contents": [{"role": "user", "parts": [{"text": "Question"}]}]
+			}`,
+			strategy: ContinuationSystem,
+			want: `{
+				"systemInstruction": {"parts": [{"text": "Snake."}, {"text": "Camel."}, {"text": "Go on."}]},
+				"contents": [
+					{"role": "user", "parts": [{"text": "Question"}]},
+					{"role": "model", "parts": [{"text": "Partial answer"}]}
+				]
+			}`,
+		},
+		{
+			name: "history goes after the last user turn",
+			request: `{
+				"contents": [
+					{"role": "user", "parts": [{"text": "Call a tool"}]},
+					{"role": "model", "parts": [{"functionCall": {"name": "f"}}]},
+					{"role": "function", "parts": [{"functionResponse": {"name": "f"}}]}
+				]
+			}`,
+			strategy: ContinuationPrefill,
+			want: `{
+				"contents": [
+					{"role": "user", "parts": [{"text": "Call a tool"}]},
+					{"role": "model", "parts": [{"functionCall": {"name": "f"}}]},
+					{"role": "function", "parts": [{"functionResponse": {"name": "f"}}]},
+					{"role": "model", "parts": [{"text": "Partial answer"}]}
+				]
+			}`,
+		},
+		{
+			name:     "restart strategy resends the original request",
+			request:  request,
+			strategy: ContinuationRestart,
+			want:     request,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := decodeJSON(t, tt.request)
+			got := BuildContinuationBody(original, modelParts, Continuation{Strategy: tt.strategy, Prompt: "Go on."})
+			if want := decodeJSON(t, tt.want); !reflect.DeepEqual(normalizeJSON(t, got), normalizeJSON(t, want)) {
+				encoded, _ := json.Marshal(got)
+				t.Errorf("BuildContinuationBody() = %s\nwant %s", encoded, tt.want)
+			}
+			if !reflect.DeepEqual(original, decodeJSON(t, tt.request)) {
+				t.Error("the original request body was modified")
+			}
+		})
+	}
+}
+
+func TestResolveContinuationStrategy(t *testing.T) {
+	cfg := &config.Config{
+		ContinuationStrategy: "user",
+		ContinuationStrategyRules: []config.PrefixRule{
+			{Prefix: "gemini-2.5", Value: "System"},
+			{Prefix: "gemini-2.5-flash", Value: "restart"},
+			{Prefix: "gemini-bad", Value: "rewind"},
+		},
+	}
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"gemini-1.5-pro", ContinuationUser},
+		{"gemini-2.5-pro", ContinuationSystem},
+		{"gemini-2.5-flash", ContinuationRestart},
+		{"gemini-bad", ContinuationUser},
+	}
+	for _, tt := range tests {
+		if got := ResolveContinuationStrategy(cfg, tt.model); got != tt.want {
+			t.Errorf("ResolveContinuationStrategy(%q) = %q; want %q", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestContinuationPrompt(t *testing.T) {
+	cfg := &config.Config{
+		ContinuationPromptRules: []config.PrefixRule{
+			{Prefix: "*", Value: "Any model."},
+			{Prefix: "gemini-2.5", Value: "Continue {model} after: {tail}"},
+			{Prefix: "gemini-2.5@zh", Value: "继续"},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		cfg   *config.Config
+		model string
+		text  string
+		want  string
+	}{
+		{"built-in English prompt", &config.Config{}, "gemini-2.5-pro", "Some text", DefaultContinuationPrompt},
+		{"built-in Chinese prompt", &config.Config{}, "gemini-2.5-pro", "这是一些中文内容", DefaultContinuationPromptZH},
+		{"wildcard rule", cfg, "gemini-1.5-pro", "Some text", "Any model."},
+		{"placeholders", cfg, "gemini-2.5-pro", "Some text", "Continue gemini-2.5-pro after: Some text"},
+		{"language rule wins", cfg, "gemini-2.5-pro", "这是一些中文内容", "继续"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ContinuationPrompt(tt.cfg, tt.model, nil, tt.text); got != tt.want {
+				t.Errorf("ContinuationPrompt() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipReplayedText(t *testing.T) {
+	tests := []struct {
+		name   string
+		sent   string
+		chunks []string
+		want   string
+	}{
+		{
+			name:   "exact replay across chunks",
+			sent:   "Hello, world. ",
+			chunks: []string{"Hello, ", "world. More", " text."},
+			want:   "More text.",
+		},
+		{
+			name:   "replay ending on a chunk boundary",
+			sent:   "Hello",
+			chunks: []string{"Hel", "lo", " there."},
+			want:   " there.",
+		},
+		{
+			name:   "multi-byte text is skipped by characters",
+			sent:   "你好，",
+			chunks: []string{"你好，世界。"},
+			want:   "世界。",
+		},
+		{
+			name:   "diverging replay is still skipped by length",
+			sent:   "Hello, world. ",
+			chunks: []string{"Greetings, all! Next"},
+			want:   "! Next",
+		},
+		{
+			name:   "nothing to skip",
+			chunks: []string{"Fresh"},
+			want:   "Fresh",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make(chan string, len(tt.chunks)+1)
+			for _, chunk := range tt.chunks {
+				in <- textChunkLine(t, chunk, "")
+			}
+			in <- textChunkLine(t, "", "STOP")
+			close(in)
+
+			got := ""
+			finished := false
+			for line := range SkipReplayedText(context.Background(), in, tt.sent) {
+				got += ParseLineContent(line).Text
+				if ExtractFinishReason(line) == "STOP" {
+					finished = true
+				}
+			}
+			if got != tt.want {
+				t.Errorf("forwarded text = %q; want %q", got, tt.want)
+			}
+			if !finished {
+				t.Error("finish chunk was not forwarded")
+			}
+		})
+	}
+}
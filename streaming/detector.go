@@ -0,0 +1,278 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// CompletionDetector decides whether a response that finished with STOP is genuinely
+// complete, and optionally contributes the system prompt that makes the check possible.
+type CompletionDetector interface {
+	// Name identifies the detector in logs and configuration.
+	Name() string
+	// SystemPrompt returns the instruction to inject into the request, or "" if none is needed.
+	SystemPrompt() string
+	// IsComplete reports whether the accumulated formal text is a finished response.
+	IsComplete(text string) bool
+	// StripMarker removes any completion marker from the text of the final chunk.
+	StripMarker(text string) string
+}
+
+// DetectorFactory builds a detector from the proxy configuration.
+type DetectorFactory func(cfg *config.Config) CompletionDetector
+
+var (
+	detectorRegistryMu sync.RWMutex
+	detectorRegistry   = map[string]DetectorFactory{
+		"sentinel": func(cfg *config.Config) CompletionDetector {
+			return NewSentinelDetector(cfg.CompletionSentinel)
+		},
+		"json": func(cfg *config.Config) CompletionDetector {
+			return JSONDetector{}
+		},
+		"fences": func(cfg *config.Config) CompletionDetector {
+			return CodeFenceDetector{}
+		},
+		"punctuation": func(cfg *config.Config) CompletionDetector {
+			return PunctuationDetector{}
+		},
+	}
+)
+
+// RegisterDetector makes a detector available by name for COMPLETION_DETECTOR settings.
+// Registering an existing name replaces the previous factory.
+func RegisterDetector(name string, factory DetectorFactory) {
+	detectorRegistryMu.Lock()
+	detectorRegistry[strings.ToLower(name)] = factory
+	detectorRegistryMu.Unlock()
+}
+
+// RegisteredDetectors returns the sorted names of all registered detectors.
+func RegisteredDetectors() []string {
+	detectorRegistryMu.RLock()
+	names := make([]string, 0, len(detectorRegistry))
+	for name := range detectorRegistry {
+		names = append(names, name)
+	}
+	detectorRegistryMu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// NewDetector builds a detector from a spec such as "sentinel" or "sentinel+fences".
+// Several names joined with '+' must all agree before a response counts as complete.
+func NewDetector(cfg *config.Config, spec string) (CompletionDetector, error) {
+	names := strings.Split(spec, "+")
+	detectors := make([]CompletionDetector, 0, len(names))
+
+	detectorRegistryMu.RLock()
+	defer detectorRegistryMu.RUnlock()
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		factory, ok := detectorRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown completion detector %q", name)
+		}
+		detectors = append(detectors, factory(cfg))
+	}
+
+	switch len(detectors) {
+	case 0:
+		return nil, fmt.Errorf("empty completion detector spec %q", spec)
+	case 1:
+		return detectors[0], nil
+	default:
+		return allOfDetector(detectors), nil
+	}
+}
+
+// ResolveDetector picks the detector for a model using the longest matching prefix rule,
+// falling back to the default. Requests asking for JSON output never get the sentinel
+// prompt, since it would corrupt the structured response.
+func ResolveDetector(cfg *config.Config, model string, requestBody map[string]interface{}) CompletionDetector {
+	spec := cfg.CompletionDetector
+	if value, ok := config.MatchPrefixRule(cfg.CompletionDetectorRules, model); ok {
+		spec = value
+	}
+
+	if wantsJSONOutput(requestBody) && !strings.Contains(strings.ToLower(spec), "json") {
+		logger.LogInfo(fmt.Sprintf("Structured JSON output requested; using 'json' completion detector instead of '%s'", spec))
+		spec = "json"
+	}
+
+	detector, err := NewDetector(cfg, spec)
+	if err != nil {
+		logger.LogError(fmt.Sprintf("Invalid completion detector for model '%s': %v. Falling back to sentinel.", model, err))
+		return NewSentinelDetector(cfg.CompletionSentinel)
+	}
+	logger.LogDebug(fmt.Sprintf("Using completion detector '%s' for model '%s'", detector.Name(), model))
+	return detector
+}
+
+func wantsJSONOutput(requestBody map[string]interface{}) bool {
+	genConfig, ok := requestBody["generationConfig"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	mimeType, _ := genConfig["responseMimeType"].(string)
+	return strings.EqualFold(mimeType, "application/json")
+}
+
+// SentinelDetector asks the model to end its answer with a token and checks for it.
+type SentinelDetector struct {
+	Token string
+}
+
+// NewSentinelDetector creates a sentinel detector, defaulting to "[done]".
+func NewSentinelDetector(token string) SentinelDetector {
+	if strings.TrimSpace(token) == "" {
+		token = config.DefaultCompletionSentinel
+	}
+	return SentinelDetector{Token: token}
+}
+
+// Name implements CompletionDetector.
+func (d SentinelDetector) Name() string { return "sentinel" }
+
+// SystemPrompt implements CompletionDetector.
+func (d SentinelDetector) SystemPrompt() string {
+	return fmt.Sprintf("IMPORTANT: At the very end of your entire response, you must write the token %s to signal completion. This is a mandatory technical requirement.", d.Token)
+}
+
+// IsComplete implements CompletionDetector.
+func (d SentinelDetector) IsComplete(text string) bool {
+	return strings.HasSuffix(strings.TrimSpace(text), d.Token)
+}
+
+// StripMarker removes the longest suffix of the token, which handles a token split across chunks.
+func (d SentinelDetector) StripMarker(text string) string {
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	for i := len(d.Token); i > 0; i-- {
+		suffix := d.Token[len(d.Token)-i:]
+		if strings.HasSuffix(trimmed, suffix) {
+			return strings.TrimSuffix(trimmed, suffix)
+		}
+	}
+	return text
+}
+
+// JSONDetector treats a response as complete once it parses as valid JSON.
+type JSONDetector struct{}
+
+// Name implements CompletionDetector.
+func (JSONDetector) Name() string { return "json" }
+
+// SystemPrompt implements CompletionDetector.
+func (JSONDetector) SystemPrompt() string { return "" }
+
+// IsComplete implements CompletionDetector. A surrounding markdown code fence is ignored.
+func (JSONDetector) IsComplete(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "```") {
+		trimmed = strings.TrimPrefix(trimmed, "```json")
+		trimmed = strings.TrimPrefix(trimmed, "```")
+		trimmed = strings.TrimSuffix(strings.TrimSpace(trimmed), "```")
+	}
+	return trimmed != "" && json.Valid([]byte(trimmed))
+}
+
+// StripMarker implements CompletionDetector.
+func (JSONDetector) StripMarker(text string) string { return text }
+
+// CodeFenceDetector treats a response as complete when every ``` fence has been closed.
+type CodeFenceDetector struct{}
+
+// Name implements CompletionDetector.
+func (CodeFenceDetector) Name() string { return "fences" }
+
+// SystemPrompt implements CompletionDetector.
+func (CodeFenceDetector) SystemPrompt() string { return "" }
+
+// IsComplete implements CompletionDetector.
+func (CodeFenceDetector) IsComplete(text string) bool {
+	if strings.TrimSpace(text) == "" {
+		return false
+	}
+	fences := 0
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			fences++
+		}
+	}
+	return fences%2 == 0
+}
+
+// StripMarker implements CompletionDetector.
+func (CodeFenceDetector) StripMarker(text string) string { return text }
+
+// PunctuationDetector treats a response as complete when it ends with sentence punctuation.
+type PunctuationDetector struct{}
+
+// Name implements CompletionDetector.
+func (PunctuationDetector) Name() string { return "punctuation" }
+
+// SystemPrompt implements CompletionDetector.
+func (PunctuationDetector) SystemPrompt() string { return "" }
+
+// IsComplete implements CompletionDetector.
+func (PunctuationDetector) IsComplete(text string) bool {
+	return endsWithSentencePunctuation(text)
+}
+
+// StripMarker implements CompletionDetector.
+func (PunctuationDetector) StripMarker(text string) string { return text }
+
+// allOfDetector combines detectors; all of them must report completion.
+type allOfDetector []CompletionDetector
+
+func (d allOfDetector) Name() string {
+	names := make([]string, len(d))
+	for i, detector := range d {
+		names[i] = detector.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+func (d allOfDetector) SystemPrompt() string {
+	var prompts []string
+	for _, detector := range d {
+		if prompt := detector.SystemPrompt(); prompt != "" {
+			prompts = append(prompts, prompt)
+		}
+	}
+	return strings.Join(prompts, "\n")
+}
+
+// IsComplete checks each detector against the text with the other detectors' markers
+// stripped, so e.g. "sentinel+json" validates the JSON without the trailing token.
+func (d allOfDetector) IsComplete(text string) bool {
+	for i, detector := range d {
+		candidate := text
+		for j, other := range d {
+			if j != i {
+				candidate = other.StripMarker(candidate)
+			}
+		}
+		if !detector.IsComplete(candidate) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d allOfDetector) StripMarker(text string) string {
+	for _, detector := range d {
+		text = detector.StripMarker(text)
+	}
+	return text
+}
@@ -0,0 +1,200 @@
+package streaming
+
+import (
+	"testing"
+
+	"gemini-antiblock/config"
+)
+
+func TestDetectorIsComplete(t *testing.T) {
+	tests := []struct {
+		name     string
+		detector CompletionDetector
+		text     string
+		want     bool
+	}{
+		{"sentinel default token", NewSentinelDetector(""), "All done. [done]", true},
+		{"sentinel token followed by whitespace", NewSentinelDetector(""), "All done.[done]\n ", true},
+		{"sentinel missing token", NewSentinelDetector(""), "All done.", false},
+		{"sentinel token not at the end", NewSentinelDetector(""), "[done] and then more", false},
+		{"sentinel partial token", NewSentinelDetector(""), "All done. [do", false},
+		{"custom marker", NewSentinelDetector("<<END>>"), "Answer.<<END>>", true},
+		{"custom marker ignores the default token", NewSentinelDetector("<<END>>"), "Answer.[done]", false},
+		{"json object", JSONDetector{}, `{"a": [1, 2]}`, true},
+		{"json in a code fence", JSONDetector{}, "```json\n{\"a\": 1}\n```", true},
+		{"truncated json", JSONDetector{}, `{"a": [1, 2`, false},
+		{"empty json", JSONDetector{}, "  ", false},
+		{"closed fences", CodeFenceDetector{}, "Code:\n```go\nx := 1\n```\nDone", true},
+		{"open fence", CodeFenceDetector{}, "Code:\n```go\nx := 1", false},
+		{"no fences", CodeFenceDetector{}, "plain text", true},
+		{"empty text has no fences to close", CodeFenceDetector{}, "", false},
+		{"ends with a period", PunctuationDetector{}, "A sentence.", true},
+		{"ends with CJK punctuation", PunctuationDetector{}, "一句话。", true},
+		{"ends mid-word", PunctuationDetector{}, "A senten", false},
+		{"combined detectors agree", allOfDetector{NewSentinelDetector(""), JSONDetector{}}, `{"a": 1}[done]`, true},
+		{"combined detectors need the token", allOfDetector{NewSentinelDetector(""), JSONDetector{}}, `{"a": 1}`, false},
+		{"combined detectors need valid json", allOfDetector{NewSentinelDetector(""), JSONDetector{}}, `{"a": [done]`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.detector.IsComplete(tt.text); got != tt.want {
+				t.Errorf("%s.IsComplete(%q) = %t; want %t", tt.detector.Name(), tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSentinelStripMarker(t *testing.T) {
+	tests := []struct {
+		token string
+		text  string
+		want  string
+	}{
+		{"", "Answer.[done]", "Answer."},
+		{"", "Answer. [done]\n", "Answer. "},
+		// The final chunk may carry only the end of a token split across chunks.
+		{"", "ne]", ""},
+		{"", "]", ""},
+		{"", "Answer.[do", "Answer.[do"},
+		{"", "Answer.", "Answer."},
+		{"<<END>>", "Answer.<<END>>", "Answer."},
+		{"<<END>>", "Answer.[done]", "Answer.[done]"},
+	}
+
+	for _, tt := range tests {
+		detector := NewSentinelDetector(tt.token)
+		if got := detector.StripMarker(tt.text); got != tt.want {
+			t.Errorf("StripMarker(%q) with token %q = %q; want %q", tt.text, detector.Token, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveCompletionMarkerFromLine(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         string
+		shouldRemove bool
+		want         string
+	}{
+		{
+			name:         "marker on the final chunk",
+			line:         `data: {"candidates":[{"content":{"parts":[{"text":"Bye.[done]"}]},"finishReason":"STOP"}]}`,
+			shouldRemove: true,
+			want:         `data: {"candidates":[{"content":{"parts":[{"text":"Bye."}]},"finishReason":"STOP"}]}`,
+		},
+		{
+			name: "left alone when not requested",
+			line: `data: {"candidates":[{"content":{"parts":[{"text":"Bye.[done]"}]},"finishReason":"STOP"}]}`,
+			want: `data: {"candidates":[{"content":{"parts":[{"text":"Bye.[done]"}]},"finishReason":"STOP"}]}`,
+		},
+		{
+			name:         "thought parts are not touched",
+			line:         `data: {"candidates":[{"content":{"parts":[{"text":"Bye.[done]"},{"text":"think [done]","thought":true}]}}]}`,
+			shouldRemove: true,
+			want:         `data: {"candidates":[{"content":{"parts":[{"text":"Bye."},{"text":"think [done]","thought":true}]}}]}`,
+		},
+		{
+			name:         "every candidate",
+			line:         `data: {"candidates":[{"content":{"parts":[{"text":"A[done]"}]}},{"content":{"parts":[{"text":"B[done]"}]}}]}`,
+			shouldRemove: true,
+			want:         `data: {"candidates":[{"content":{"parts":[{"text":"A"}]}},{"content":{"parts":[{"text":"B"}]}}]}`,
+		},
+		{
+			name:         "line without a marker is unchanged",
+			line:         `data: {"candidates":[{"content":{"parts":[{"text": "Bye."}]}}]}`,
+			shouldRemove: true,
+			want:         `data: {"candidates":[{"content":{"parts":[{"text": "Bye."}]}}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RemoveCompletionMarkerFromLine(tt.line, NewSentinelDetector(""), tt.shouldRemove); got != tt.want {
+				t.Errorf("RemoveCompletionMarkerFromLine() = %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractFinishReason(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`data: {"candidates":[{"content":{"parts":[{"text":"x"}]},"finishReason":"STOP"}]}`, "STOP"},
+		{`data: {"candidates":[{"content":{"parts":[{"text":"x"}]}},{"finishReason":"MAX_TOKENS"}]}`, "MAX_TOKENS"},
+		{`data: {"candidates":[{"content":{"parts":[{"text":"finishReason"}]}}]}`, ""},
+		{`data: {"candidates":[{"content":{"parts":[{"text":"x"}]}}]}`, ""},
+		{`: keep-alive`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := ExtractFinishReason(tt.line); got != tt.want {
+			t.Errorf("ExtractFinishReason(%s) = %q; want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestResolveDetector(t *testing.T) {
+	cfg := &config.Config{
+		CompletionDetector: "sentinel",
+		CompletionDetectorRules: []config.PrefixRule{
+			{Prefix: "gemini-2.5", Value: "punctuation"},
+			{Prefix: "gemini-2.5-flash", Value: "sentinel+fences"},
+			{Prefix: "gemini-broken", Value: "nonexistent"},
+		},
+	}
+	jsonBody := map[string]interface{}{
+		"generationConfig": map[string]interface{}{"responseMimeType": "application/json"},
+	}
+
+	tests := []struct {
+		model string
+		body  map[string]interface{}
+		want  string
+	}{
+		{"gemini-1.5-pro", nil, "sentinel"},
+		{"gemini-2.5-pro", nil, "punctuation"},
+		{"gemini-2.5-flash-lite", nil, "sentinel+fences"},
+		{"gemini-2.5-pro", jsonBody, "json"},
+		{"gemini-broken", nil, "sentinel"},
+	}
+
+	for _, tt := range tests {
+		if got := ResolveDetector(cfg, tt.model, tt.body).Name(); got != tt.want {
+			t.Errorf("ResolveDetector(%q) = %q; want %q", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestNewDetector(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "sentinel", want: "sentinel"},
+		{spec: " Sentinel + JSON ", want: "sentinel+json"},
+		{spec: "fences+", want: "fences"},
+		{spec: "unknown", wantErr: true},
+		{spec: "+", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		detector, err := NewDetector(&config.Config{}, tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NewDetector(%q) = %s; want an error", tt.spec, detector.Name())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewDetector(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := detector.Name(); got != tt.want {
+			t.Errorf("NewDetector(%q).Name() = %q; want %q", tt.spec, got, tt.want)
+		}
+	}
+}
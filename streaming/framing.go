@@ -0,0 +1,208 @@
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gemini-antiblock/logger"
+)
+
+// Response framings of streamGenerateContent.
+const (
+	// FramingSSE is used with alt=sse: one "data: " event per chunk.
+	FramingSSE = "sse"
+	// FramingJSONArray is the default without alt=sse: a JSON array streamed one
+	// element per chunk.
+	FramingJSONArray = "json-array"
+)
+
+// ClientFraming returns the framing a streamGenerateContent client asked for.
+func ClientFraming(query url.Values) string {
+	if query.Get("alt") == "sse" {
+		return FramingSSE
+	}
+	return FramingJSONArray
+}
+
+// eventReader yields the chunks of an upstream stream as SSE events.
+type eventReader interface {
+	Next() (*SSEEvent, error)
+}
+
+// newEventReader detects the framing of an upstream body from its first non-whitespace
+// byte: '[' starts a streamed JSON array, anything else is read as SSE.
+func newEventReader(reader io.Reader, maxEventSize int) (eventReader, error) {
+	br := bufio.NewReader(reader)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		case '[':
+			logger.LogDebug("Upstream stream uses JSON array framing")
+			return &jsonArrayReader{r: br, maxEventSize: maxEventSize}, nil
+		}
+		return NewSSEReader(br, maxEventSize), nil
+	}
+}
+
+// jsonArrayReader reads the elements of a streamed JSON array as they arrive. Each
+// element becomes an event whose data is the element's JSON.
+type jsonArrayReader struct {
+	r            *bufio.Reader
+	maxEventSize int
+	started      bool
+}
+
+// Next returns the next element. It returns io.EOF at the closing bracket, and also
+// when the stream ends before it, so a cut-off array is handled like a dropped stream.
+func (j *jsonArrayReader) Next() (*SSEEvent, error) {
+	for {
+		b, err := j.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case b == ' ' || b == '\t' || b == '\r' || b == '\n':
+		case b == '[' && !j.started:
+			j.started = true
+		case b == ',' && j.started:
+		case b == ']' && j.started:
+			return nil, io.EOF
+		case b == '{' && j.started:
+			return j.readObject()
+		default:
+			return nil, fmt.Errorf("unexpected %q in JSON array stream", b)
+		}
+	}
+}
+
+// readObject reads one object element after its opening brace.
+func (j *jsonArrayReader) readObject() (*SSEEvent, error) {
+	buf := []byte{'{'}
+	depth := 1
+	inString, escaped := false, false
+	for depth > 0 {
+		b, err := j.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+		if j.maxEventSize > 0 && len(buf) > j.maxEventSize {
+			return nil, fmt.Errorf("%w of %d bytes", ErrSSEEventTooLarge, j.maxEventSize)
+		}
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if b == '\\' {
+				escaped = true
+			} else if b == '"' {
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return &SSEEvent{Data: string(buf)}, nil
+}
+
+// JSONArrayWriter re-frames the SSE output of the stream processor as the streamed
+// JSON array that streamGenerateContent returns without alt=sse. Chunks and error
+// events become array elements; keep-alive comments become whitespace, and other
+// events, such as antiblock progress events, have no JSON array form and are dropped.
+// Close must be called to terminate the array.
+type JSONArrayWriter struct {
+	w        io.Writer
+	pending  []byte
+	elements int
+}
+
+// NewJSONArrayWriter creates a writer that frames its output onto w.
+func NewJSONArrayWriter(w io.Writer) *JSONArrayWriter {
+	return &JSONArrayWriter{w: w}
+}
+
+// Write implements io.Writer. Events are buffered until their terminating blank line.
+func (j *JSONArrayWriter) Write(p []byte) (int, error) {
+	j.pending = append(j.pending, p...)
+	for {
+		idx := bytes.Index(j.pending, []byte("\n\n"))
+		if idx == -1 {
+			break
+		}
+		event := string(j.pending[:idx])
+		j.pending = j.pending[idx+2:]
+		if err := j.writeEvent(event); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (j *JSONArrayWriter) writeEvent(event string) error {
+	eventType := ""
+	var dataLines []string
+	comment := false
+	for _, line := range strings.Split(event, "\n") {
+		switch {
+		case strings.HasPrefix(line, ":"):
+			comment = true
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			dataLines = append(dataLines, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if len(dataLines) == 0 {
+		if comment {
+			_, err := io.WriteString(j.w, "\n")
+			return err
+		}
+		return nil
+	}
+	if eventType != "" && eventType != "message" && eventType != "error" {
+		logger.LogDebug(fmt.Sprintf("Dropping %q event: the client requested JSON array framing", eventType))
+		return nil
+	}
+
+	separator := "["
+	if j.elements > 0 {
+		separator = "\n,\r\n"
+	}
+	j.elements++
+	_, err := io.WriteString(j.w, separator+strings.Join(dataLines, "\n"))
+	return err
+}
+
+// Flush implements http.Flusher when the underlying writer does.
+func (j *JSONArrayWriter) Flush() {
+	if flusher, ok := j.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close terminates the array.
+func (j *JSONArrayWriter) Close() error {
+	closing := "\n]"
+	if j.elements == 0 {
+		closing = "[]"
+	}
+	_, err := io.WriteString(j.w, closing)
+	j.Flush()
+	return err
+}
@@ -0,0 +1,220 @@
+package streaming
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestJSONArrayReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		maxSize int
+		want    []string
+		wantErr error
+		// wantSyntaxErr expects an error other than io.EOF or the size limit.
+		wantSyntaxErr bool
+	}{
+		{
+			name:  "elements on separate lines",
+			input: "[{\"a\":1}\n,\r\n{\"b\":2}\n]",
+			want:  []string{`{"a":1}`, `{"b":2}`},
+		},
+		{
+			name:  "pretty-printed elements",
+			input: "[{\n  \"a\": {\n    \"b\": [1, 2]\n  }\n}\n]",
+			want:  []string{"{\n  \"a\": {\n    \"b\": [1, 2]\n  }\n}"},
+		},
+		{
+			name:  "braces and escapes inside strings",
+			input: `[{"text":"a } ] { [ \"quoted\" \\"}, {"text":"\\\\"}]`,
+			want:  []string{`{"text":"a } ] { [ \"quoted\" \\"}`, `{"text":"\\\\"}`},
+		},
+		{
+			name:  "leading whitespace",
+			input: "\r\n  [ {\"a\":1} ]",
+			want:  []string{`{"a":1}`},
+		},
+		{
+			name:  "empty array",
+			input: "[]",
+		},
+		{
+			name:  "array cut off between elements",
+			input: "[{\"a\":1},",
+			want:  []string{`{"a":1}`},
+		},
+		{
+			name:    "array cut off inside an element",
+			input:   "[{\"a\":1},{\"b\":",
+			want:    []string{`{"a":1}`},
+			wantErr: io.EOF,
+		},
+		{
+			name:          "unexpected value",
+			input:         "[{\"a\":1}, 42]",
+			want:          []string{`{"a":1}`},
+			wantSyntaxErr: true,
+		},
+		{
+			name:    "element above the size limit",
+			input:   `[{"text":"` + strings.Repeat("x", 64) + `"}]`,
+			maxSize: 32,
+			wantErr: ErrSSEEventTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One byte per read, so every element is split across reads.
+			reader, err := newEventReader(iotest.OneByteReader(strings.NewReader(tt.input)), tt.maxSize)
+			if err != nil {
+				t.Fatalf("newEventReader: %v", err)
+			}
+			if _, ok := reader.(*jsonArrayReader); !ok {
+				t.Fatalf("reader is %T; want *jsonArrayReader", reader)
+			}
+
+			var got []string
+			for {
+				event, err := reader.Next()
+				if err != nil {
+					wantErr := tt.wantErr
+					if wantErr == nil {
+						wantErr = io.EOF
+					}
+					if tt.wantSyntaxErr {
+						if err == io.EOF || errors.Is(err, ErrSSEEventTooLarge) {
+							t.Fatalf("error = %v; want a syntax error", err)
+						}
+					} else if !errors.Is(err, wantErr) {
+						t.Fatalf("error = %v; want %v", err, wantErr)
+					}
+					break
+				}
+				got = append(got, event.Data)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("elements = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewEventReaderDetectsSSE(t *testing.T) {
+	reader, err := newEventReader(strings.NewReader("\n data: {}\n\n"), 0)
+	if err != nil {
+		t.Fatalf("newEventReader: %v", err)
+	}
+	if _, ok := reader.(*SSEReader); !ok {
+		t.Fatalf("reader is %T; want *SSEReader", reader)
+	}
+}
+
+func TestJSONArrayWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []interface{}
+		// wantPrefix is checked on the raw output when set.
+		wantPrefix string
+	}{
+		{
+			name:   "chunks become elements",
+			writes: []string{"data: {\"a\":1}\n\n", "data: {\"b\":2}\n\n"},
+			want:   []interface{}{map[string]interface{}{"a": 1.0}, map[string]interface{}{"b": 2.0}},
+		},
+		{
+			name:   "event split across writes",
+			writes: []string{"data: {\"a\"", ":1}\n", "\n"},
+			want:   []interface{}{map[string]interface{}{"a": 1.0}},
+		},
+		{
+			name:   "error events are kept",
+			writes: []string{"data: {\"a\":1}\n\n", "event: error\ndata: {\"error\":{\"code\":400}}\n\n"},
+			want: []interface{}{
+				map[string]interface{}{"a": 1.0},
+				map[string]interface{}{"error": map[string]interface{}{"code": 400.0}},
+			},
+		},
+		{
+			name:   "multi-line error data",
+			writes: []string{upstreamErrorEvent(429, []byte("{\n  \"error\": {\n    \"code\": 429\n  }\n}\n"))},
+			want:   []interface{}{map[string]interface{}{"error": map[string]interface{}{"code": 429.0}}},
+		},
+		{
+			name:   "progress events are dropped",
+			writes: []string{"event: antiblock\ndata: {\"type\":\"retrying\"}\n\n", "data: {\"a\":1}\n\n"},
+			want:   []interface{}{map[string]interface{}{"a": 1.0}},
+		},
+		{
+			name:       "keep-alive comments become whitespace",
+			writes:     []string{": keep-alive\n\n", "data: {\"a\":1}\n\n"},
+			want:       []interface{}{map[string]interface{}{"a": 1.0}},
+			wantPrefix: "\n[",
+		},
+		{
+			name: "no elements",
+			want: []interface{}{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writer := NewJSONArrayWriter(&out)
+			for _, w := range tt.writes {
+				if _, err := writer.Write([]byte(w)); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			if tt.wantPrefix != "" && !strings.HasPrefix(out.String(), tt.wantPrefix) {
+				t.Errorf("output %q does not start with %q", out.String(), tt.wantPrefix)
+			}
+			var got []interface{}
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatalf("output %q is not a JSON array: %v", out.String(), err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("elements = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "pretty-printed JSON is compacted",
+			body: "{\n  \"error\": {\n    \"code\": 403,\n    \"message\": \"denied\"\n  }\n}\n",
+			want: "event: error\ndata: {\"error\":{\"code\":403,\"message\":\"denied\"}}\n\n",
+		},
+		{
+			name: "non-JSON body is wrapped",
+			body: "Forbidden\n",
+			want: "event: error\ndata: {\"error\":{\"code\":403,\"message\":\"Forbidden\"}}\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamErrorEvent(403, []byte(tt.body)); got != tt.want {
+				t.Errorf("upstreamErrorEvent() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/upstream"
+)
+
+// ReasonHedge marks a speculative attempt in the metrics attempt list.
+const ReasonHedge = "HEDGE"
+
+// hedgeContestant is one upstream response racing to produce formal text first.
+type hedgeContestant struct {
+	base     string
+	body     io.Closer
+	watchdog *stallWatchdog
+	stream   *sseStream
+
+	buffered []string
+	ended    bool
+	aborted  bool
+	// usage is the latest usageMetadata the contestant reported.
+	usage usageCounts
+}
+
+// abort closes a losing contestant's upstream response.
+func (c *hedgeContestant) abort() {
+	c.watchdog.stop()
+	if !c.aborted {
+		c.aborted = true
+		c.body.Close()
+	}
+}
+
+type hedgeEvent struct {
+	contestant *hedgeContestant
+	line       string
+	ended      bool
+}
+
+type hedgeLaunch struct {
+	id         int
+	contestant *hedgeContestant
+	err        error
+}
+
+// hedgeRace runs a resumed attempt against speculative copies of itself. While no
+// contestant has produced formal text, another one is launched every delay, up to max
+// in parallel. The first to produce formal text (or a block) wins: its held-back lines
+// and the rest of its stream are forwarded and every other contestant is cancelled.
+type hedgeRace struct {
+	ctx    context.Context
+	delay  time.Duration
+	max    int
+	launch func(ctx context.Context, id int) (*hedgeContestant, error)
+
+	events   chan hedgeEvent
+	launched chan hedgeLaunch
+	out      chan string
+	// stop ends the race early; done is closed once run has returned.
+	stop chan struct{}
+	done chan struct{}
+
+	contestants []*hedgeContestant
+	// winner is set before any of its lines are forwarded.
+	winner *hedgeContestant
+	// loserUsage is the usage of the contestants that lost, set together with winner.
+	// The losers were billed for it even though their output is discarded.
+	loserUsage []usageCounts
+}
+
+// startHedgeRace starts racing primary; lines yields the winner's stream.
+func startHedgeRace(ctx context.Context, primary *hedgeContestant, delay time.Duration, max int, launch func(ctx context.Context, id int) (*hedgeContestant, error)) *hedgeRace {
+	r := &hedgeRace{
+		ctx:      ctx,
+		delay:    delay,
+		max:      max,
+		launch:   launch,
+		events:   make(chan hedgeEvent),
+		launched: make(chan hedgeLaunch, max),
+		out:      make(chan string, 100),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.run(primary)
+	return r
+}
+
+func (r *hedgeRace) lines() <-chan string {
+	return r.out
+}
+
+// forward feeds a contestant's lines to run. Once the race is over the rest of the
+// stream is discarded so the contestant's line iterator never blocks.
+func (r *hedgeRace) forward(c *hedgeContestant) {
+	for line := range c.stream.lines {
+		select {
+		case r.events <- hedgeEvent{contestant: c, line: line}:
+		case <-r.stop:
+			for range c.stream.lines {
+			}
+			return
+		case <-r.ctx.Done():
+			return
+		}
+	}
+	select {
+	case r.events <- hedgeEvent{contestant: c, ended: true}:
+	case <-r.stop:
+	case <-r.ctx.Done():
+	}
+}
+
+func (r *hedgeRace) run(primary *hedgeContestant) {
+	defer close(r.done)
+	defer close(r.out)
+
+	send := func(line string) bool {
+		select {
+		case r.out <- line:
+			return true
+		case <-r.stop:
+			return false
+		case <-r.ctx.Done():
+			return false
+		}
+	}
+
+	alive := 0
+	add := func(c *hedgeContestant) {
+		r.contestants = append(r.contestants, c)
+		alive++
+		go r.forward(c)
+	}
+	add(primary)
+
+	// Hedges are launched in the background so the race keeps reading while a hedge
+	// waits for its response headers; pending ones are cancelled once a winner is known.
+	pending := map[int]context.CancelFunc{}
+	launches := 0
+	defer func() {
+		// Launches still in flight are cancelled and waited for so none leaks a response.
+		for _, cancel := range pending {
+			cancel()
+		}
+		for n := len(pending); n > 0; n-- {
+			if res := <-r.launched; res.err == nil {
+				res.contestant.abort()
+			}
+		}
+	}()
+
+	timer := time.NewTimer(r.delay)
+	defer timer.Stop()
+	hedgeTimer := timer.C
+
+	decide := func(c *hedgeContestant) bool {
+		r.winner = c
+		hedgeTimer = nil
+		for _, cancel := range pending {
+			cancel()
+		}
+		for _, other := range r.contestants {
+			if other == c {
+				continue
+			}
+			if !other.ended {
+				other.abort()
+			}
+			if other.usage.Total > 0 {
+				r.loserUsage = append(r.loserUsage, other.usage)
+			}
+		}
+		if len(r.contestants) > 1 {
+			logger.LogInfo(fmt.Sprintf("Attempt on %s won the hedge race against %d other attempt(s)", c.base, len(r.contestants)-1))
+		}
+		for _, line := range c.buffered {
+			if !send(line) {
+				return false
+			}
+		}
+		c.buffered = nil
+		return true
+	}
+
+	for alive > 0 || len(pending) > 0 {
+		select {
+		case <-r.ctx.Done():
+			for _, c := range r.contestants {
+				c.abort()
+			}
+			return
+		case <-r.stop:
+			return
+		case <-hedgeTimer:
+			launches++
+			logger.LogInfo(fmt.Sprintf("No formal text after %v; launching hedged attempt %d/%d", time.Duration(launches)*r.delay, launches+1, r.max))
+			launchCtx, cancel := context.WithCancel(r.ctx)
+			pending[launches] = cancel
+			go func(id int) {
+				c, err := r.launch(launchCtx, id)
+				r.launched <- hedgeLaunch{id: id, contestant: c, err: err}
+			}(launches)
+			if launches+1 < r.max {
+				timer.Reset(r.delay)
+			} else {
+				hedgeTimer = nil
+			}
+		case res := <-r.launched:
+			cancel := pending[res.id]
+			delete(pending, res.id)
+			if res.err != nil {
+				cancel()
+				if r.winner == nil {
+					logger.LogError("Hedged attempt failed to start:", res.err)
+				}
+				continue
+			}
+			if r.winner != nil {
+				res.contestant.abort()
+				continue
+			}
+			add(res.contestant)
+		case ev := <-r.events:
+			c := ev.contestant
+			if ev.ended {
+				c.ended = true
+				alive--
+				if r.winner == nil && alive == 0 && len(pending) == 0 {
+					// Nobody produced formal text; hand the last stream to the retry loop as is.
+					if !decide(c) {
+						return
+					}
+				} else if r.winner == nil {
+					logger.LogDebug(fmt.Sprintf("Attempt on %s ended without formal text during the hedge race", c.base))
+					c.abort()
+				}
+				continue
+			}
+
+			if r.winner == c {
+				if !send(ev.line) {
+					return
+				}
+				continue
+			}
+			if r.winner != nil {
+				continue
+			}
+			_, data, isData := parseDataLine(ev.line)
+			if usage, ok := parseUsage(data); isData && ok && usage.Total >= c.usage.Total {
+				c.usage = usage
+			}
+			c.buffered = append(c.buffered, ev.line)
+			content := ParseLineContent(ev.line)
+			if (content.Text != "" && !content.IsThought) || content.HasFunctionCall || (isData && chunkBlocked(data)) {
+				if !decide(c) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// takeLoserUsage returns the usage of the contestants that lost the race, once. It is
+// only called after a line of the race was received, which happens after the winner
+// and the losers' usage were settled.
+func (r *hedgeRace) takeLoserUsage() []usageCounts {
+	usage := r.loserUsage
+	r.loserUsage = nil
+	return usage
+}
+
+// finish ends the race, stops every contestant's watchdog and returns the winner,
+// falling back to the first contestant if the race was cut short.
+func (r *hedgeRace) finish() *hedgeContestant {
+	close(r.stop)
+	<-r.done
+	winner := r.winner
+	if winner == nil {
+		winner = r.contestants[0]
+	}
+	for _, c := range r.contestants {
+		if c == winner {
+			c.watchdog.stop()
+			continue
+		}
+		c.abort()
+		if r.winner == nil && c.usage.Total > 0 {
+			r.loserUsage = append(r.loserUsage, c.usage)
+		}
+	}
+	return winner
+}
+
+// hedgeBases picks the upstream base for each of the n hedges of an attempt on current,
+// spreading them over the pool when there is one.
+func hedgeBases(pool *upstream.Pool, current string, n int) []string {
+	bases := make([]string, n)
+	base := current
+	for i := range bases {
+		if pool != nil {
+			base = pool.Pick(upstream.StrategyNext, base)
+		}
+		bases[i] = base
+	}
+	return bases
+}
+
+// launchHedge sends a speculative copy of the current retry request to base and
+// starts reading its stream.
+func launchHedge(ctx context.Context, cfg *config.Config, req StreamRequest, retryBody map[string]interface{}, base string) (*hedgeContestant, error) {
+	if req.RequestID != "" {
+		metrics.IncHedge(req.RequestID)
+		metrics.RecordAttempt(req.RequestID, base, ReasonHedge)
+	}
+
+	requestStart := time.Now()
+	attemptCtx, cancelAttempt := context.WithCancel(ctx)
+	headersStalled := HeaderDeadline(cfg.StallFirstByteTimeout, cancelAttempt)
+	resp, err := sendRetryRequest(attemptCtx, req.Clients, retryBody, base+req.UpstreamPath, req.Headers)
+	headersStalled()
+	if err != nil {
+		cancelAttempt()
+		if req.Upstreams != nil && ctx.Err() == nil {
+			req.Upstreams.ReportFailure(base)
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancelAttempt()
+		if req.Upstreams != nil && resp.StatusCode >= 500 {
+			req.Upstreams.ReportFailure(base)
+		}
+		return nil, fmt.Errorf("upstream %s returned status %d", base, resp.StatusCode)
+	}
+	if req.Upstreams != nil {
+		req.Upstreams.ReportSuccess(base, time.Since(requestStart))
+	}
+	logger.LogInfo(fmt.Sprintf("Hedged attempt on %s got a new stream", base))
+
+	body := NewCancelOnClose(resp.Body, cancelAttempt)
+	watchdog := newStallWatchdog(body, cfg.StallFirstByteTimeout, cfg.StallIdleTimeout)
+	stream := startSSEStream(ctx, watchdog, cfg.SSEMaxEventBytes)
+	return &hedgeContestant{base: base, body: body, watchdog: watchdog, stream: stream}, nil
+}
@@ -0,0 +1,230 @@
+package streaming
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const thoughtChunkLine = `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"Thinking","thought":true}]}}]}`
+
+// closeNotifier records when a contestant's body is closed by the race.
+type closeNotifier struct {
+	io.ReadCloser
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *closeNotifier) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.ReadCloser.Close()
+}
+
+// fakeUpstream is the far end of a contestant's stream.
+type fakeUpstream struct {
+	t      *testing.T
+	w      *io.PipeWriter
+	closed chan struct{}
+}
+
+// send writes SSE events; writes to an aborted contestant are dropped.
+func (u *fakeUpstream) send(lines ...string) {
+	for _, line := range lines {
+		u.w.Write([]byte(line + "\n\n"))
+	}
+}
+
+// end closes the stream cleanly.
+func (u *fakeUpstream) end() {
+	u.w.Close()
+}
+
+func (u *fakeUpstream) waitAborted() {
+	u.t.Helper()
+	select {
+	case <-u.closed:
+	case <-time.After(time.Second):
+		u.t.Fatal("contestant was not aborted")
+	}
+}
+
+func (u *fakeUpstream) aborted() bool {
+	select {
+	case <-u.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// newFakeContestant returns a contestant whose stream the test writes through the
+// returned upstream.
+func newFakeContestant(t *testing.T, ctx context.Context, base string) (*hedgeContestant, *fakeUpstream) {
+	r, w := io.Pipe()
+	body := &closeNotifier{ReadCloser: r, closed: make(chan struct{})}
+	watchdog := newStallWatchdog(body, 0, 0)
+	c := &hedgeContestant{base: base, body: body, watchdog: watchdog, stream: startSSEStream(ctx, watchdog, 0)}
+	t.Cleanup(func() { w.Close() })
+	return c, &fakeUpstream{t: t, w: w, closed: body.closed}
+}
+
+// hedgeLauncher hands out prepared contestants to the race in launch order.
+func hedgeLauncher(contestants ...*hedgeContestant) func(ctx context.Context, id int) (*hedgeContestant, error) {
+	return func(ctx context.Context, id int) (*hedgeContestant, error) {
+		return contestants[id-1], nil
+	}
+}
+
+// receiveLines reads n lines of the race's output.
+func receiveLines(t *testing.T, lines <-chan string, n int) []string {
+	t.Helper()
+	var got []string
+	for len(got) < n {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("race output closed after %d of %d lines", len(got), n)
+			}
+			got = append(got, line)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d of %d lines", len(got), n)
+		}
+	}
+	return got
+}
+
+func waitClosed(t *testing.T, lines <-chan string) {
+	t.Helper()
+	select {
+	case line, ok := <-lines:
+		if ok {
+			t.Fatalf("unexpected line %s", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("race output was not closed")
+	}
+}
+
+func TestHedgeRaceWinnerForwardsBufferedLines(t *testing.T) {
+	ctx := context.Background()
+	primary, primaryUp := newFakeContestant(t, ctx, "https://primary")
+	hedge, hedgeUp := newFakeContestant(t, ctx, "https://hedge")
+	race := startHedgeRace(ctx, primary, 10*time.Millisecond, 2, hedgeLauncher(hedge))
+
+	primaryUp.send(thoughtChunkLine)
+	hello := textChunkLine(t, "Hello", "")
+	hedgeUp.send(thoughtChunkLine, hello)
+
+	if got, want := receiveLines(t, race.lines(), 2), []string{thoughtChunkLine, hello}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first lines = %q; want %q", got, want)
+	}
+	primaryUp.waitAborted()
+
+	// The rest of the winner's stream is forwarded as it arrives.
+	world := textChunkLine(t, " world", "STOP")
+	hedgeUp.send(world)
+	if got := receiveLines(t, race.lines(), 1); got[0] != world {
+		t.Errorf("next line = %q; want %q", got[0], world)
+	}
+	hedgeUp.end()
+	waitClosed(t, race.lines())
+
+	if winner := race.finish(); winner != hedge {
+		t.Errorf("finish() = %s; want the hedge", winner.base)
+	}
+	if hedgeUp.aborted() {
+		t.Error("the winner was aborted")
+	}
+}
+
+func TestHedgeRaceChargesLoserUsage(t *testing.T) {
+	ctx := context.Background()
+	primary, primaryUp := newFakeContestant(t, ctx, "https://primary")
+	hedge, hedgeUp := newFakeContestant(t, ctx, "https://hedge")
+	race := startHedgeRace(ctx, primary, 10*time.Millisecond, 2, hedgeLauncher(hedge))
+
+	// The primary reports usage for its thinking, then goes quiet.
+	primaryUp.send(usageChunkLine(t, "", "", 10, 0, 4), usageChunkLine(t, "", "", 10, 0, 7))
+	hello := textChunkLine(t, "Hello", "STOP")
+	hedgeUp.send(hello)
+
+	if got := receiveLines(t, race.lines(), 1); got[0] != hello {
+		t.Errorf("first line = %q; want %q", got[0], hello)
+	}
+	primaryUp.waitAborted()
+	want := []usageCounts{{Prompt: 10, Thoughts: 7, Total: 17}}
+	if got := race.takeLoserUsage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("takeLoserUsage() = %+v; want %+v", got, want)
+	}
+	if got := race.takeLoserUsage(); got != nil {
+		t.Errorf("second takeLoserUsage() = %+v; want nil", got)
+	}
+
+	hedgeUp.end()
+	waitClosed(t, race.lines())
+	race.finish()
+}
+
+func TestHedgeRaceWithoutFormalText(t *testing.T) {
+	ctx := context.Background()
+	primary, primaryUp := newFakeContestant(t, ctx, "https://primary")
+	hedge, hedgeUp := newFakeContestant(t, ctx, "https://hedge")
+	launched := make(chan struct{})
+	race := startHedgeRace(ctx, primary, 10*time.Millisecond, 2, func(ctx context.Context, id int) (*hedgeContestant, error) {
+		close(launched)
+		return hedge, nil
+	})
+
+	primaryUp.send(usageChunkLine(t, "", "", 10, 0, 3))
+	select {
+	case <-launched:
+	case <-time.After(time.Second):
+		t.Fatal("no hedge was launched")
+	}
+	// The primary ends while the hedge is still running, so it is dropped from the race.
+	primaryUp.end()
+	primaryUp.waitAborted()
+
+	// The last contestant to end is handed over as is.
+	hedgeUp.send(thoughtChunkLine)
+	hedgeUp.end()
+	if got := receiveLines(t, race.lines(), 1); got[0] != thoughtChunkLine {
+		t.Errorf("forwarded line = %q; want %q", got[0], thoughtChunkLine)
+	}
+	waitClosed(t, race.lines())
+
+	if winner := race.finish(); winner != hedge {
+		t.Errorf("finish() = %s; want the hedge", winner.base)
+	}
+	want := []usageCounts{{Prompt: 10, Thoughts: 3, Total: 13}}
+	if got := race.takeLoserUsage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("takeLoserUsage() = %+v; want %+v", got, want)
+	}
+}
+
+func TestHedgeRaceContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	primary, primaryUp := newFakeContestant(t, ctx, "https://primary")
+	hedge, hedgeUp := newFakeContestant(t, ctx, "https://hedge")
+	launched := make(chan struct{})
+	race := startHedgeRace(ctx, primary, 10*time.Millisecond, 2, func(ctx context.Context, id int) (*hedgeContestant, error) {
+		defer close(launched)
+		return hedge, nil
+	})
+
+	primaryUp.send(thoughtChunkLine)
+	<-launched
+	hedgeUp.send(thoughtChunkLine)
+	cancel()
+
+	waitClosed(t, race.lines())
+	primaryUp.waitAborted()
+	hedgeUp.waitAborted()
+	if winner := race.finish(); winner != primary {
+		t.Errorf("finish() = %s; want the primary", winner.base)
+	}
+}
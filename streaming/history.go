@@ -0,0 +1,132 @@
+package streaming
+
+import (
+	"fmt"
+	"strings"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// Thought history modes control how much of an interrupted attempt's reasoning is
+// replayed in the model turn of a retry request.
+const (
+	// ThoughtHistoryNone replays formal text and function calls only.
+	ThoughtHistoryNone = "none"
+	// ThoughtHistorySignatures also keeps the thoughtSignature of each replayed part, so
+	// the model can pick its reasoning back up without re-deriving it.
+	ThoughtHistorySignatures = "signatures"
+	// ThoughtHistoryFull additionally replays the thought parts themselves.
+	ThoughtHistoryFull = "full"
+)
+
+// ResolveThoughtHistory picks the thought history mode for a model using the longest
+// matching prefix rule, falling back to the default.
+func ResolveThoughtHistory(cfg *config.Config, model string) string {
+	mode := cfg.RetryThoughtHistory
+	if value, ok := config.MatchPrefixRule(cfg.RetryThoughtHistoryRules, model); ok {
+		mode = value
+	}
+	mode = strings.ToLower(mode)
+	switch mode {
+	case ThoughtHistoryNone, ThoughtHistorySignatures, ThoughtHistoryFull:
+		return mode
+	default:
+		logger.LogError(fmt.Sprintf("Invalid retry thought history mode '%s' for model '%s'. Falling back to '%s'.", mode, model, ThoughtHistoryNone))
+		return ThoughtHistoryNone
+	}
+}
+
+// recordParts appends the parts of a chunk to the candidate's model turn. Consecutive
+// text of the same kind (formal or thought) is merged into one part, a thoughtSignature
+// is kept on the part it arrived with, and function calls are kept verbatim.
+func (c *candidateState) recordParts(parts []map[string]interface{}) {
+	for _, part := range parts {
+		if _, ok := part["functionCall"]; ok {
+			c.functionCalls++
+			c.parts = append(c.parts, part)
+			continue
+		}
+		text, _ := part["text"].(string)
+		signature, _ := part["thoughtSignature"].(string)
+		thought, _ := part["thought"].(bool)
+		if text == "" && signature == "" {
+			continue
+		}
+
+		if last := c.lastTextPart(thought); last != nil {
+			if _, signed := last["thoughtSignature"]; !signed || signature == "" {
+				last["text"] = last["text"].(string) + text
+				if signature != "" {
+					last["thoughtSignature"] = signature
+				}
+				continue
+			}
+		}
+
+		recorded := map[string]interface{}{"text": text}
+		if thought {
+			recorded["thought"] = true
+		}
+		if signature != "" {
+			recorded["thoughtSignature"] = signature
+		}
+		c.parts = append(c.parts, recorded)
+	}
+}
+
+// lastTextPart returns the last recorded part if it is a text part of the given kind.
+func (c *candidateState) lastTextPart(thought bool) map[string]interface{} {
+	if len(c.parts) == 0 {
+		return nil
+	}
+	last, ok := c.parts[len(c.parts)-1].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if _, isText := last["text"].(string); !isText {
+		return nil
+	}
+	if lastThought, _ := last["thought"].(bool); lastThought != thought {
+		return nil
+	}
+	return last
+}
+
+// historyParts returns the parts to replay as the model turn of a retry request under
+// the given thought history mode.
+func (c *candidateState) historyParts(mode string) []interface{} {
+	parts := make([]interface{}, 0, len(c.parts))
+	for _, raw := range c.parts {
+		part, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := part["functionCall"]; ok {
+			parts = append(parts, part)
+			continue
+		}
+
+		thought, _ := part["thought"].(bool)
+		if thought && mode != ThoughtHistoryFull {
+			continue
+		}
+		text, _ := part["text"].(string)
+		replayed := map[string]interface{}{"text": text}
+		if thought {
+			replayed["thought"] = true
+		}
+		signature, signed := part["thoughtSignature"]
+		if signed && mode != ThoughtHistoryNone {
+			replayed["thoughtSignature"] = signature
+		} else if text == "" {
+			continue
+		}
+		parts = append(parts, replayed)
+	}
+
+	if len(parts) == 0 {
+		return []interface{}{map[string]interface{}{"text": c.text}}
+	}
+	return parts
+}
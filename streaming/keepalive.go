@@ -0,0 +1,92 @@
+package streaming
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// keepAliveComment is the SSE comment sent while nothing else is forwarded. Clients
+// ignore comment lines, but proxies and SDKs see traffic and keep the stream open.
+const keepAliveComment = ": keep-alive\n\n"
+
+// keepAliveWriter serializes writes to the client so heartbeats never interleave with
+// forwarded chunks, and remembers when data was last written.
+type keepAliveWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	flusher   http.Flusher
+	lastWrite time.Time
+}
+
+func (k *keepAliveWriter) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.lastWrite = time.Now()
+	return k.w.Write(p)
+}
+
+func (k *keepAliveWriter) Flush() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.flusher.Flush()
+}
+
+// heartbeat writes a keep-alive comment if nothing was written for interval.
+func (k *keepAliveWriter) heartbeat(interval time.Duration) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.lastWrite) < interval {
+		return nil
+	}
+	k.lastWrite = time.Now()
+	if _, err := io.WriteString(k.w, keepAliveComment); err != nil {
+		return err
+	}
+	k.flusher.Flush()
+	return nil
+}
+
+// startKeepAlive wraps a streaming client writer so an SSE comment is sent whenever no
+// data was forwarded for interval: during long thinking phases, swallowed thoughts,
+// retry backoff and while waiting for a retry response. Writers that cannot flush
+// (such as the non-streaming aggregator) and a zero interval are returned unchanged.
+// stop must be called before the session returns.
+func startKeepAlive(ctx context.Context, writer io.Writer, interval time.Duration) (io.Writer, func()) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok || interval <= 0 {
+		return writer, func() {}
+	}
+
+	k := &keepAliveWriter{w: writer, flusher: flusher, lastWrite: time.Now()}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.heartbeat(interval); err != nil {
+					logger.LogDebug("Failed to write keep-alive comment:", err)
+					return
+				}
+			}
+		}
+	}()
+
+	return k, func() {
+		close(done)
+		wg.Wait()
+	}
+}
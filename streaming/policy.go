@@ -0,0 +1,93 @@
+package streaming
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"gemini-antiblock/config"
+)
+
+// Interruption reasons used for logging, metrics and retry policy lookup.
+const (
+	ReasonDrop                = "DROP"
+	ReasonBlock               = "BLOCK"
+	ReasonFinishDuringThought = "FINISH_DURING_THOUGHT"
+	ReasonFinishEmpty         = "FINISH_EMPTY_RESPONSE"
+	ReasonFinishIncomplete    = "FINISH_INCOMPLETE"
+	ReasonFinishAbnormal      = "FINISH_ABNORMAL"
+	ReasonNetworkError        = "NETWORK_ERROR"
+	ReasonStall               = "STALL"
+	ReasonEventTooLarge       = "EVENT_TOO_LARGE"
+)
+
+// HTTPStatusReason returns the retry reason for a retryable upstream status, e.g. "HTTP_503".
+func HTTPStatusReason(status int) string {
+	return fmt.Sprintf("HTTP_%d", status)
+}
+
+// retryTracker counts retries per reason within one stream session and decides how
+// long to back off before the next attempt.
+type retryTracker struct {
+	cfg      *config.Config
+	attempts map[string]int
+}
+
+func newRetryTracker(cfg *config.Config) *retryTracker {
+	return &retryTracker{
+		cfg:      cfg,
+		attempts: make(map[string]int),
+	}
+}
+
+// next records another retry for reason. It returns the delay to wait, the limit that
+// applies and whether the retry is allowed under both the reason's policy and the
+// global MaxConsecutiveRetries cap.
+func (t *retryTracker) next(reason string, totalRetries int) (time.Duration, int, bool) {
+	policy := t.cfg.RetryPolicyFor(reason)
+	if category, ok := strings.CutPrefix(reason, ReasonBlock+"_"); ok {
+		// Retried blocks are also capped by their block policy.
+		if block := t.cfg.BlockPolicyFor(category); block.Retries < policy.MaxAttempts {
+			policy.MaxAttempts = block.Retries
+		}
+	}
+	if totalRetries >= t.cfg.MaxConsecutiveRetries {
+		return 0, t.cfg.MaxConsecutiveRetries, false
+	}
+	if t.attempts[reason] >= policy.MaxAttempts {
+		return 0, policy.MaxAttempts, false
+	}
+	t.attempts[reason]++
+	return backoffDelay(policy, t.attempts[reason]), policy.MaxAttempts, true
+}
+
+// jitter returns a random number in [0, 1) used to spread backoff delays.
+var jitter = rand.Float64
+
+// backoffDelay computes BaseDelay * Multiplier^(attempt-1), randomised by ±Jitter and
+// capped at MaxDelay when set.
+func backoffDelay(policy config.RetryPolicy, attempt int) time.Duration {
+	if policy.BaseDelay <= 0 || attempt <= 0 {
+		return 0
+	}
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(policy.BaseDelay) * math.Pow(multiplier, float64(attempt-1))
+	if policy.MaxDelay > 0 && delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (2*jitter() - 1)
+	}
+	if policy.MaxDelay > 0 && delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
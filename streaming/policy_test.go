@@ -0,0 +1,137 @@
+package streaming
+
+import (
+	"testing"
+	"time"
+
+	"gemini-antiblock/config"
+)
+
+// withJitter fixes the jitter source for the duration of a test.
+func withJitter(t *testing.T, value float64) {
+	t.Helper()
+	previous := jitter
+	jitter = func() float64 { return value }
+	t.Cleanup(func() { jitter = previous })
+}
+
+func TestBackoffDelay(t *testing.T) {
+	exponential := config.RetryPolicy{BaseDelay: time.Second, Multiplier: 2}
+
+	tests := []struct {
+		name    string
+		policy  config.RetryPolicy
+		attempt int
+		jitter  float64
+		want    time.Duration
+	}{
+		{"no base delay", config.RetryPolicy{Multiplier: 2}, 3, 0.5, 0},
+		{"attempt zero", exponential, 0, 0.5, 0},
+		{"first attempt uses the base delay", exponential, 1, 0.5, time.Second},
+		{"second attempt doubles", exponential, 2, 0.5, 2 * time.Second},
+		{"fourth attempt", exponential, 4, 0.5, 8 * time.Second},
+		{"multiplier below one is constant", config.RetryPolicy{BaseDelay: time.Second, Multiplier: 0.5}, 3, 0.5, time.Second},
+		{"capped at the max delay", config.RetryPolicy{BaseDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}, 10, 0.5, 5 * time.Second},
+		{"lowest jitter", config.RetryPolicy{BaseDelay: time.Second, Multiplier: 1, Jitter: 0.2}, 1, 0, 800 * time.Millisecond},
+		{"highest jitter", config.RetryPolicy{BaseDelay: time.Second, Multiplier: 1, Jitter: 0.2}, 1, 1, 1200 * time.Millisecond},
+		{"jitter stays under the cap", config.RetryPolicy{BaseDelay: time.Second, Multiplier: 2, Jitter: 0.5, MaxDelay: 4 * time.Second}, 3, 1, 4 * time.Second},
+		{"jitter applies below the cap", config.RetryPolicy{BaseDelay: time.Second, Multiplier: 2, Jitter: 0.5, MaxDelay: 4 * time.Second}, 3, 0, 2 * time.Second},
+		{"full jitter never goes negative", config.RetryPolicy{BaseDelay: time.Second, Multiplier: 1, Jitter: 2}, 1, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withJitter(t, tt.jitter)
+			if got := backoffDelay(tt.policy, tt.attempt); got != tt.want {
+				t.Errorf("backoffDelay() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryTrackerNext(t *testing.T) {
+	withJitter(t, 0.5)
+	cfg := &config.Config{
+		MaxConsecutiveRetries: 5,
+		DefaultRetryPolicy:    config.RetryPolicy{MaxAttempts: 3},
+		RetryPolicies: map[string]config.RetryPolicy{
+			ReasonDrop: {MaxAttempts: 2},
+			"HTTP_5XX": {MaxAttempts: 4, BaseDelay: time.Second, Multiplier: 2},
+		},
+		BlockPolicies: map[string]config.BlockPolicy{
+			"SAFETY": {Action: config.BlockActionRetry, Retries: 1},
+		},
+	}
+
+	type step struct {
+		reason    string
+		wantDelay time.Duration
+		wantLimit int
+		wantOK    bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "per-reason budget",
+			steps: []step{
+				{ReasonDrop, 0, 2, true},
+				{ReasonDrop, 0, 2, true},
+				{ReasonDrop, 0, 2, false},
+			},
+		},
+		{
+			name: "budgets are counted per reason",
+			steps: []step{
+				{ReasonDrop, 0, 2, true},
+				{ReasonStall, 0, 3, true},
+				{ReasonDrop, 0, 2, true},
+				{ReasonStall, 0, 3, true},
+				{ReasonDrop, 0, 2, false},
+			},
+		},
+		{
+			name: "status class policy backs off",
+			steps: []step{
+				{HTTPStatusReason(503), time.Second, 4, true},
+				{HTTPStatusReason(503), 2 * time.Second, 4, true},
+				{HTTPStatusReason(500), time.Second, 4, true},
+			},
+		},
+		{
+			name: "block retries are capped by the block policy",
+			steps: []step{
+				{BlockReason("SAFETY"), 0, 1, true},
+				{BlockReason("SAFETY"), 0, 1, false},
+			},
+		},
+		{
+			name: "global cap",
+			steps: []step{
+				{ReasonDrop, 0, 2, true},
+				{ReasonDrop, 0, 2, true},
+				{ReasonStall, 0, 3, true},
+				{ReasonStall, 0, 3, true},
+				{ReasonStall, 0, 3, true},
+				{ReasonNetworkError, 0, 5, false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newRetryTracker(cfg)
+			total := 0
+			for i, s := range tt.steps {
+				delay, limit, ok := tracker.next(s.reason, total)
+				if delay != s.wantDelay || limit != s.wantLimit || ok != s.wantOK {
+					t.Fatalf("step %d: next(%s) = %v, %d, %t; want %v, %d, %t", i, s.reason, delay, limit, ok, s.wantDelay, s.wantLimit, s.wantOK)
+				}
+				if ok {
+					total++
+				}
+			}
+		})
+	}
+}
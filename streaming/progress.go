@@ -0,0 +1,74 @@
+package streaming
+
+import (
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+)
+
+// ProgressEventName is the SSE event name of antiblock progress events.
+const ProgressEventName = "antiblock"
+
+// Progress event types.
+const (
+	ProgressInterrupted = "interrupted"
+	ProgressRetrying    = "retrying"
+	ProgressResumed     = "resumed"
+	ProgressSummary     = "summary"
+)
+
+// Summary statuses.
+const (
+	ProgressStatusCompleted          = "completed"
+	ProgressStatusRetryLimitExceeded = "retry_limit_exceeded"
+	ProgressStatusFailed             = "failed"
+	ProgressStatusBlocked            = "blocked"
+)
+
+// emitProgress writes an "event: antiblock" SSE event when the client opted in to
+// progress events. Clients that did not opt in never see these events.
+func (s *streamSession) emitProgress(eventType string, fields map[string]interface{}) error {
+	if !s.progress {
+		return nil
+	}
+	payload := map[string]interface{}{"type": eventType}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.write("event: " + ProgressEventName + "\ndata: " + string(data))
+}
+
+// emitInterrupted reports that a candidate stopped early in the given attempt.
+func (s *streamSession) emitInterrupted(attempt int, state *candidateState) error {
+	s.interruptions = append(s.interruptions, state.interruption)
+	return s.emitProgress(ProgressInterrupted, map[string]interface{}{
+		"attempt":          attempt,
+		"candidate":        state.index,
+		"reason":           state.interruption,
+		"accumulatedChars": utf8.RuneCountInString(state.text),
+	})
+}
+
+// emitSummary reports the outcome of the whole session as the last progress event.
+func (s *streamSession) emitSummary(status string, retries int, started time.Time) error {
+	reasons := s.interruptions
+	if reasons == nil {
+		reasons = []string{}
+	}
+	chars := 0
+	for _, state := range s.candidates.ordered() {
+		chars += utf8.RuneCountInString(state.text)
+	}
+	return s.emitProgress(ProgressSummary, map[string]interface{}{
+		"status":           status,
+		"attempts":         retries + 1,
+		"retries":          retries,
+		"interruptions":    reasons,
+		"accumulatedChars": chars,
+		"durationMs":       time.Since(started).Milliseconds(),
+	})
+}
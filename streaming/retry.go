@@ -1,28 +1,56 @@
 package streaming
 
 import (
-    "bytes"
-    "encoding/json"
-    "fmt"
-    "io"
-    "net/http"
-    "os"
-    "strings"
-    "time"
-
-    "gemini-antiblock/config"
-    "gemini-antiblock/logger"
-    "gemini-antiblock/metrics"
-    "errors"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gemini-antiblock/apikeys"
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/transport"
+	"gemini-antiblock/upstream"
 )
 
 var nonRetryableStatuses = map[int]bool{
-    400: true, 401: true, 403: true, 404: true, 429: true,
+	400: true, 401: true, 403: true, 404: true, 429: true,
 }
 
 // ErrRetryLimitExceeded indicates the internal retry loop exhausted the limit.
 var ErrRetryLimitExceeded = errors.New("retry limit exceeded")
 
+// ErrClientCancelled indicates the downstream client went away before the stream completed.
+var ErrClientCancelled = errors.New("client cancelled")
+
+// ErrContentBlocked is returned when a block policy fails the request.
+var ErrContentBlocked = errors.New("content blocked")
+
+// sleepWithContext waits for d, returning early with ErrClientCancelled if ctx is done.
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	if ctx.Err() != nil {
+		return ErrClientCancelled
+	}
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ErrClientCancelled
+	case <-timer.C:
+		return nil
+	}
+}
+
 // endsWithSentencePunctuation returns true if the given text ends with a sentence-ending punctuation.
 // The set includes common Chinese and English sentence terminators and closing quotes.
 func endsWithSentencePunctuation(text string) bool {
@@ -36,15 +64,22 @@ func endsWithSentencePunctuation(text string) bool {
 	return strings.ContainsRune(punctuations, last)
 }
 
-// BuildRetryRequestBody builds a new request body for retry with accumulated context
-func BuildRetryRequestBody(originalBody map[string]interface{}, accumulatedText string) map[string]interface{} {
-	logger.LogDebug(fmt.Sprintf("Building retry request body. Accumulated text length: %d", len(accumulatedText)))
-	logger.LogDebug(fmt.Sprintf("Accumulated text preview: %s", func() string {
-		if len(accumulatedText) > 200 {
-			return accumulatedText[:200] + "..."
+// BuildContinuationBody builds a retry request body that resumes the given model turn
+// using the continuation's strategy and prompt.
+func BuildContinuationBody(originalBody map[string]interface{}, modelParts []interface{}, continuation Continuation) map[string]interface{} {
+	if continuation.Strategy == ContinuationRestart {
+		logger.LogDebug("Restart continuation: resending the original request without history")
+		return originalBody
+	}
+
+	logger.LogDebug(fmt.Sprintf("Building retry request body. Strategy: %s, model turn parts: %d", continuation.Strategy, len(modelParts)))
+	for _, raw := range modelParts {
+		if part, ok := raw.(map[string]interface{}); ok {
+			if text, ok := part["text"].(string); ok {
+				logger.LogDebug(fmt.Sprintf("Accumulated text preview: %s", previewText(text, 200)))
+			}
 		}
-		return accumulatedText
-	}()))
+	}
 
 	retryBody := make(map[string]interface{})
 	for k, v := range originalBody {
@@ -56,11 +91,11 @@ func BuildRetryRequestBody(originalBody map[string]interface{}, accumulatedText
 		contents = []interface{}{}
 	}
 
-	// Find last user message index
+	// Find last user message index; function responses count as user-side turns
 	lastUserIndex := -1
 	for i := len(contents) - 1; i >= 0; i-- {
 		if content, ok := contents[i].(map[string]interface{}); ok {
-			if role, ok := content["role"].(string); ok && role == "user" {
+			if role, ok := content["role"].(string); ok && (role == "user" || role == "function") {
 				lastUserIndex = i
 				break
 			}
@@ -70,17 +105,20 @@ func BuildRetryRequestBody(originalBody map[string]interface{}, accumulatedText
 	// Build retry context
 	history := []interface{}{
 		map[string]interface{}{
-			"role": "model",
-			"parts": []interface{}{
-				map[string]interface{}{"text": accumulatedText},
-			},
+			"role":  "model",
+			"parts": modelParts,
 		},
-		map[string]interface{}{
+	}
+	switch continuation.Strategy {
+	case ContinuationUser:
+		history = append(history, map[string]interface{}{
 			"role": "user",
 			"parts": []interface{}{
-				map[string]interface{}{"text": "Continue exactly where you left off without any preamble or repetition."},
+				map[string]interface{}{"text": continuation.Prompt},
 			},
-		},
+		})
+	case ContinuationSystem:
+		retryBody = withSystemInstructionPart(retryBody, continuation.Prompt)
 	}
 
 	// Insert history after last user message
@@ -101,181 +139,599 @@ func BuildRetryRequestBody(originalBody map[string]interface{}, accumulatedText
 	return retryBody
 }
 
-// ProcessStreamAndRetryInternally handles streaming with internal retry logic
-func ProcessStreamAndRetryInternally(cfg *config.Config, initialReader io.Reader, writer io.Writer, originalRequestBody map[string]interface{}, upstreamURL string, originalHeaders http.Header, requestID string) error {
-	var accumulatedText string
-	consecutiveRetryCount := 0
-	currentReader := initialReader
-	totalLinesProcessed := 0
-	sessionStartTime := time.Now()
+// StreamRequest describes one antiblock streaming session.
+type StreamRequest struct {
+	// Body is the original request body, with the completion prompt already injected.
+	Body map[string]interface{}
+	// Headers are the headers of the initial upstream request; auth and content headers are forwarded on retries.
+	Headers   http.Header
+	RequestID string
+	Detector  CompletionDetector
+	// Model is the model identifier from the request path, used to resolve per-model settings.
+	Model string
+	// UpstreamBase is the base the initial request was sent to and UpstreamPath the
+	// path plus query appended to whichever base each retry uses.
+	UpstreamBase string
+	UpstreamPath string
+	// Upstreams, when set, lets retries fail over to another base per RetryUpstreamStrategy.
+	Upstreams *upstream.Pool
+	// Keys, when set, is the proxy's upstream API key pool: a retry that runs out of quota
+	// rotates to another key instead of failing. Client identifies the caller for it.
+	Keys   *apikeys.Pool
+	Client string
+	// Clients are the upstream HTTP clients retries and hedges are sent with.
+	Clients *transport.Clients
+	// ProgressEvents makes the session report interruptions, retries and a final summary
+	// to the client as "event: antiblock" SSE events.
+	ProgressEvents bool
+}
 
-	isOutputtingFormalText := false
-	swallowModeActive := false
-	// Counts consecutive resume attempts (after at least one retry) whose last formal text ends with sentence punctuation
-	resumePunctStreak := 0
+// streamSession holds the state of one antiblock stream across attempts.
+type streamSession struct {
+	ctx        context.Context
+	cfg        *config.Config
+	writer     io.Writer
+	detector   CompletionDetector
+	candidates *candidateSet
+	// thoughtHistory is the thought history mode and continuation the continuation
+	// strategy used when building retry requests.
+	thoughtHistory string
+	continuation   string
+	// maxOutputTokens is the client's output token budget for each candidate, 0 if unset.
+	maxOutputTokens int
+	// attemptUsage is the latest usage reported in this attempt and usageHistory the
+	// final usage of each earlier attempt.
+	attemptUsage usageCounts
+	usageHistory []usageCounts
+
+	// resumed is the candidate a retry attempt continues; nil during the initial attempt,
+	// which streams every candidate.
+	resumed *candidateState
+
+	// The last formal text chunk of the resumed candidate seen in this attempt, kept for the
+	// cross-attempt punctuation heuristic.
+	lastFormalText    string
+	lastFormalLine    string
+	lastFormalFlushed bool
+
+	// progress enables client-visible progress events; interruptions lists every
+	// interruption reason of the session for the summary event.
+	progress      bool
+	interruptions []string
+
+	// requestID identifies the request in metrics; failedBlock is the block category
+	// whose policy fails the request, once one was seen.
+	requestID   string
+	failedBlock string
+	// attemptBlocks are the block categories already recorded in this attempt. A block
+	// is usually repeated on every later chunk and candidate, but is counted once.
+	attemptBlocks map[string]bool
+}
 
-	// Get maxOutputTokens from client request, with a default fallback
-	maxOutputChars := 65535 // Default value
-	if genConfig, ok := originalRequestBody["generationConfig"].(map[string]interface{}); ok {
-		if maxTokens, ok := genConfig["maxOutputTokens"].(float64); ok && maxTokens > 0 {
-			maxOutputChars = int(maxTokens)
-			logger.LogInfo(fmt.Sprintf("Client-specified maxOutputTokens found, character limit set to: %d", maxOutputChars))
+// write forwards one SSE line to the client and flushes it.
+func (s *streamSession) write(line string) error {
+	if _, err := s.writer.Write([]byte(line + "\n\n")); err != nil {
+		if s.ctx.Err() != nil {
+			return ErrClientCancelled
 		}
+		return fmt.Errorf("failed to write to output stream: %w", err)
 	}
 
-	logger.LogInfo(fmt.Sprintf("Starting stream processing session. Max retries: %d", cfg.MaxConsecutiveRetries))
-
-	for {
-		interruptionReason := ""
-		cleanExit := false
-		streamStartTime := time.Now()
-		linesInThisStream := 0
-		textInThisStream := ""
-
-		logger.LogDebug(fmt.Sprintf("=== Starting stream attempt %d/%d ===", consecutiveRetryCount+1, cfg.MaxConsecutiveRetries+1))
+	// Flush the response to ensure data is sent immediately to the client
+	if flusher, ok := s.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
 
-		// Create channel for SSE lines
-		lineCh := make(chan string, 100)
-		go SSELineIterator(currentReader, lineCh)
+// active reports whether a candidate takes part in the current attempt.
+func (s *streamSession) active(state *candidateState) bool {
+	return s.resumed == nil || state == s.resumed
+}
 
-		// Track the last formal text chunk seen in this attempt
-		attemptLastFormalText := ""
-		attemptLastFormalDataLine := ""
-		attemptLastFormalTextFlushed := false
+// acceptedCandidate is a candidate chunk that passed the retry checks and is forwarded.
+type acceptedCandidate struct {
+	state     *candidateState
+	candidate map[string]interface{}
+	content   CandidateContent
+}
 
-		// Process lines
-		for line := range lineCh {
-			totalLinesProcessed++
-			linesInThisStream++
+// processLine handles one line of the current attempt. It forwards what is good to the
+// client and records interruptions on the candidates; done is true once no active
+// candidate is still streaming.
+func (s *streamSession) processLine(line string) (done bool, err error) {
+	prefix, data, isData := parseDataLine(line)
+	if !isData {
+		return false, s.write(line)
+	}
 
-			var textChunk string
-			var isThought bool
+	if usage, ok := parseUsage(data); ok && usage.Total >= s.attemptUsage.Total {
+		s.attemptUsage = usage
+	}
 
-			if IsDataLine(line) {
-				content := ParseLineContent(line)
-				textChunk = content.Text
-				isThought = content.IsThought
+	if category, blocked := promptBlockCategory(data); blocked {
+		logger.LogError(fmt.Sprintf("Prompt blocked in line: %s", line))
+		pass := s.blockAction(category) == config.BlockActionPass
+		if pass {
+			if err := s.write(line); err != nil {
+				return true, err
 			}
-
-			// Thought swallowing logic
-			if swallowModeActive {
-				if isThought {
-					logger.LogDebug("Swallowing thought chunk due to post-retry filter:", line)
-					finishReason := ExtractFinishReason(line)
-					if finishReason != "" {
-						logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' while swallowing a 'thought' chunk. Triggering retry.", finishReason))
-						interruptionReason = "FINISH_DURING_THOUGHT"
-						break
-					}
-					continue
+		}
+		for _, state := range s.candidates.ordered() {
+			if s.active(state) && state.streaming() {
+				if pass {
+					state.finished = true
 				} else {
-					logger.LogInfo("First formal text chunk received after swallowing. Resuming normal stream.")
-					swallowModeActive = false
+					state.interruption = BlockReason(category)
 				}
 			}
+		}
+		return true, nil
+	}
 
-			// Record the last formal text chunk for this attempt as early as possible,
-			// so even if this line triggers a retry (e.g., STOP but considered incomplete),
-			// it is still considered in cross-attempt punctuation heuristic.
-			if textChunk != "" && !isThought {
-				attemptLastFormalText = textChunk
-				attemptLastFormalDataLine = line
-				attemptLastFormalTextFlushed = false
-			}
-
-			// Retry decision logic
-			finishReason := ExtractFinishReason(line)
-			needsRetry := false
-
-			if finishReason != "" && isThought {
-				logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' on a 'thought' chunk. This is an invalid state. Triggering retry.", finishReason))
-				interruptionReason = "FINISH_DURING_THOUGHT"
-				needsRetry = true
-			} else if IsBlockedLine(line) {
-				logger.LogError(fmt.Sprintf("Content blocked detected in line: %s", line))
-				interruptionReason = "BLOCK"
-				needsRetry = true
-			} else if finishReason == "STOP" {
-				tempAccumulatedText := accumulatedText + textChunk
-				trimmedText := strings.TrimSpace(tempAccumulatedText)
-
-				// Check for empty response - if we have STOP but no accumulated text at all, it's incomplete
-				if len(trimmedText) == 0 {
-					logger.LogError("Finish reason 'STOP' with no text content detected. This indicates an empty response. Triggering retry.")
-					interruptionReason = "FINISH_EMPTY_RESPONSE"
-					needsRetry = true
-				} else if !strings.HasSuffix(trimmedText, "[done]") {
-					runes := []rune(trimmedText)
-					lastChar := string(runes[len(runes)-1])
-					logger.LogError(fmt.Sprintf("Finish reason 'STOP' treated as incomplete because text ends with '%s'. Triggering retry.", lastChar))
-					interruptionReason = "FINISH_INCOMPLETE"
-					needsRetry = true
-				}
-			} else if finishReason != "" && finishReason != "MAX_TOKENS" && finishReason != "STOP" {
-				logger.LogError(fmt.Sprintf("Abnormal finish reason: %s. Triggering retry.", finishReason))
-				interruptionReason = "FINISH_ABNORMAL"
-				needsRetry = true
+	rawCandidates, _ := data["candidates"].([]interface{})
+	kept := make([]interface{}, 0, len(rawCandidates))
+	var accepted []acceptedCandidate
+	modified := false
+
+	for pos, raw := range rawCandidates {
+		candidate, ok := raw.(map[string]interface{})
+		if !ok {
+			kept = append(kept, raw)
+			continue
+		}
+		content := candidateContent(pos, candidate)
+
+		var state *candidateState
+		if s.resumed != nil {
+			// Retries request a single candidate; map it back onto the one being resumed.
+			state = s.resumed
+			if _, hasIndex := candidate["index"]; content.Index != state.index || (!hasIndex && state.index != 0) {
+				candidate["index"] = state.index
+				modified = true
 			}
+			content.Index = state.index
+		} else {
+			state = s.candidates.get(content.Index)
+		}
 
-			if needsRetry {
-				break
+		if !state.streaming() {
+			logger.LogDebug(fmt.Sprintf("Dropping chunk for candidate %d, which is no longer streaming", state.index))
+			modified = true
+			continue
+		}
+
+		keep, changed := s.checkCandidate(state, candidate, content, prefix, data)
+		if changed {
+			modified = true
+		}
+		if !keep {
+			modified = true
+			continue
+		}
+		kept = append(kept, candidate)
+		accepted = append(accepted, acceptedCandidate{state: state, candidate: candidate, content: content})
+	}
+
+	// Report usage summed over every attempt, so resent prompts and discarded output
+	// are accounted for. The final chunk optionally carries a per-attempt breakdown.
+	if usage, ok := data["usageMetadata"].(map[string]interface{}); ok && len(s.usageHistory) > 0 {
+		s.mergedUsage().applyTo(usage)
+		modified = true
+	}
+	if s.cfg.UsageBreakdown && s.completesSession(accepted) {
+		data["antiblockUsage"] = s.usageBreakdown()
+		modified = true
+	}
+
+	// Line is good: forward and update state
+	if len(rawCandidates) == 0 || len(kept) > 0 {
+		out := line
+		if modified {
+			if _, hasCandidates := data["candidates"]; hasCandidates {
+				data["candidates"] = kept
+			}
+			if out, err = encodeDataLine(prefix, data); err != nil {
+				logger.LogDebug("Failed to marshal modified data:", err)
+				out = line
 			}
+		}
+		if err := s.write(out); err != nil {
+			return true, err
+		}
+	}
+
+	for _, a := range accepted {
+		a.state.recordParts(candidateParts(a.candidate))
+		if a.content.Text != "" {
+			a.state.outputFormalText = true
+			a.state.text += a.content.Text
+			if a.state == s.resumed {
+				s.lastFormalFlushed = true
+			}
+		}
+
+		if finishReason := a.content.FinishReason; endsCandidate(finishReason) {
+			logger.LogInfo(fmt.Sprintf("Finish reason '%s' accepted as final for candidate %d.", finishReason, a.state.index))
+			a.state.finished = true
+		}
+	}
 
-			// Line is good: forward and update state
-			isEndOfResponse := finishReason == "STOP" || finishReason == "MAX_TOKENS"
-			processedLine := RemoveDoneTokenFromLine(line, isEndOfResponse)
+	for _, state := range s.candidates.ordered() {
+		if s.active(state) && state.streaming() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
 
-			if _, err := writer.Write([]byte(processedLine + "\n\n")); err != nil {
-				return fmt.Errorf("failed to write to output stream: %w", err)
+// checkCandidate applies thought swallowing and the retry decision to one candidate of a
+// chunk. keep is false when the candidate must not be forwarded; changed is true when the
+// candidate object was modified in place.
+func (s *streamSession) checkCandidate(state *candidateState, candidate map[string]interface{}, content CandidateContent, prefix string, data map[string]interface{}) (keep bool, changed bool) {
+	finishReason := content.FinishReason
+
+	// Thought swallowing logic
+	if state.swallowing {
+		if content.IsThoughtOnly() {
+			logger.LogDebug(fmt.Sprintf("Swallowing thought chunk of candidate %d due to post-retry filter", state.index))
+			// Not forwarded, but still part of the model turn replayed in full thought history mode.
+			state.recordParts(candidateParts(candidate))
+			if finishReason != "" {
+				logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' while swallowing a 'thought' chunk. Triggering retry.", finishReason))
+				state.interruption = ReasonFinishDuringThought
 			}
+			return false, false
+		}
+		logger.LogInfo("First formal text chunk received after swallowing. Resuming normal stream.")
+		state.swallowing = false
+		changed = removeThoughtParts(candidate)
+	}
+
+	// Record the last formal text chunk for this attempt as early as possible,
+	// so even if this chunk triggers a retry (e.g., STOP but considered incomplete),
+	// it is still considered in cross-attempt punctuation heuristic.
+	if content.Text != "" && state == s.resumed {
+		s.lastFormalText = content.Text
+		s.lastFormalLine = singleCandidateLine(prefix, data, candidate)
+		s.lastFormalFlushed = false
+	}
+
+	// Retry decision logic
+	reason := ""
+	if blockFinishReasons[finishReason] {
+		if s.blockAction(finishReason) != config.BlockActionPass {
+			reason = BlockReason(finishReason)
+		}
+	} else if finishReason != "" && content.IsThoughtOnly() {
+		logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' on a 'thought' chunk. This is an invalid state. Triggering retry.", finishReason))
+		reason = ReasonFinishDuringThought
+	} else if finishReason == "STOP" {
+		tempAccumulatedText := state.text + content.Text
+		trimmedText := strings.TrimSpace(tempAccumulatedText)
+
+		// Check for empty response - if we have STOP but no accumulated text at all, it's incomplete
+		if state.functionCalls+content.FunctionCalls > 0 {
+			// A tool-call turn carries no completion marker; the client now has to run the tool.
+			logger.LogInfo(fmt.Sprintf("Finish reason 'STOP' after a function call accepted as complete for candidate %d.", state.index))
+		} else if len(trimmedText) == 0 {
+			logger.LogError("Finish reason 'STOP' with no text content detected. This indicates an empty response. Triggering retry.")
+			reason = ReasonFinishEmpty
+		} else if !s.detector.IsComplete(tempAccumulatedText) {
+			runes := []rune(trimmedText)
+			lastChar := string(runes[len(runes)-1])
+			logger.LogError(fmt.Sprintf("Finish reason 'STOP' treated as incomplete by '%s' detector (text ends with '%s'). Triggering retry.", s.detector.Name(), lastChar))
+			reason = ReasonFinishIncomplete
+		}
+	} else if finishReason != "" && finishReason != "MAX_TOKENS" {
+		logger.LogError(fmt.Sprintf("Abnormal finish reason: %s. Triggering retry.", finishReason))
+		reason = ReasonFinishAbnormal
+	}
+
+	if reason != "" {
+		state.interruption = reason
+		return false, changed
+	}
+
+	if finishReason == "STOP" || finishReason == "MAX_TOKENS" {
+		if stripCandidateMarker(candidate, s.detector) {
+			changed = true
+		}
+	}
+	return true, changed
+}
+
+// completesSession reports whether accepting these candidates finishes every candidate,
+// making the chunk the last one the client receives.
+func (s *streamSession) completesSession(accepted []acceptedCandidate) bool {
+	finishing := make(map[*candidateState]bool, len(accepted))
+	for _, a := range accepted {
+		if endsCandidate(a.content.FinishReason) {
+			finishing[a.state] = true
+		}
+	}
+	for _, state := range s.candidates.ordered() {
+		if !state.finished && !finishing[state] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergedUsage sums the usage of all earlier attempts and the current one.
+func (s *streamSession) mergedUsage() usageCounts {
+	total := s.attemptUsage
+	for _, usage := range s.usageHistory {
+		total = total.add(usage)
+	}
+	return total
+}
+
+// usageBreakdown is the antiblockUsage extension field: the usage of every attempt.
+func (s *streamSession) usageBreakdown() map[string]interface{} {
+	attempts := make([]attemptUsage, 0, len(s.usageHistory)+1)
+	for i, usage := range append(append([]usageCounts{}, s.usageHistory...), s.attemptUsage) {
+		attempts = append(attempts, attemptUsage{Attempt: i + 1, usageCounts: usage})
+	}
+	return map[string]interface{}{
+		"attempts": attempts,
+		"total":    s.mergedUsage(),
+	}
+}
+
+// chargeAttemptTokens closes the usage of the finished attempt and attributes its output
+// tokens. Usage is reported per response, so an initial attempt's tokens are split evenly
+// across candidates.
+func (s *streamSession) chargeAttemptTokens() {
+	s.usageHistory = append(s.usageHistory, s.attemptUsage)
+	tokens := s.attemptUsage.output()
+	s.attemptUsage = usageCounts{}
+	if tokens == 0 {
+		return
+	}
+	if s.resumed != nil {
+		s.resumed.tokensUsed += tokens
+		return
+	}
+	states := s.candidates.ordered()
+	for _, state := range states {
+		state.tokensUsed += tokens / len(states)
+	}
+}
+
+// remainingTokens returns the output budget left for a candidate; ok is false when the
+// client set no budget.
+func (s *streamSession) remainingTokens(state *candidateState) (remaining int, ok bool) {
+	if s.maxOutputTokens <= 0 {
+		return 0, false
+	}
+	return s.maxOutputTokens - state.tokensUsed, true
+}
+
+// finishLine is the chunk that ends a candidate's turn when the upstream did not. It is
+// written between attempts, so it carries the usage of every attempt so far.
+func (s *streamSession) finishLine(index int, finishReason string) string {
+	data := map[string]interface{}{
+		"candidates": []interface{}{
+			map[string]interface{}{
+				"index":        index,
+				"content":      map[string]interface{}{"role": "model", "parts": []interface{}{}},
+				"finishReason": finishReason,
+			},
+		},
+	}
+	if len(s.usageHistory) > 0 {
+		usage := map[string]interface{}{}
+		s.mergedUsage().applyTo(usage)
+		data["usageMetadata"] = usage
+		if s.cfg.UsageBreakdown {
+			data["antiblockUsage"] = s.usageBreakdown()
+		}
+	}
+	line, _ := encodeDataLine("data: ", data)
+	return line
+}
+
+// singleCandidateLine encodes a chunk that carries only the given candidate.
+func singleCandidateLine(prefix string, data map[string]interface{}, candidate map[string]interface{}) string {
+	chunk := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		chunk[k] = v
+	}
+	chunk["candidates"] = []interface{}{candidate}
+	line, err := encodeDataLine(prefix, chunk)
+	if err != nil {
+		return ""
+	}
+	return line
+}
+
+// ProcessStreamAndRetryInternally handles streaming with internal retry logic.
+// Every candidate of the response is tracked separately; when some are interrupted, each
+// is resumed in turn with a single-candidate retry whose output is mapped back to its index.
+// Cancelling ctx (e.g. the downstream client disconnecting) aborts the current upstream
+// read and any pending retry, and the function returns ErrClientCancelled.
+func ProcessStreamAndRetryInternally(ctx context.Context, cfg *config.Config, initialReader io.Reader, writer io.Writer, req StreamRequest) error {
+	writer, stopKeepAlive := startKeepAlive(ctx, writer, cfg.KeepAliveInterval)
+	defer stopKeepAlive()
+
+	originalRequestBody := req.Body
+	requestID := req.RequestID
+	currentBase := req.UpstreamBase
+
+	consecutiveRetryCount := 0
+	currentReader := initialReader
+	// Retry responses are owned by this function; the initial body is closed by the caller.
+	var activeRetryBody io.Closer
+	// lastRetryBody is the request body of the current retry, reused by hedged attempts.
+	var lastRetryBody map[string]interface{}
+	defer func() {
+		if activeRetryBody != nil {
+			activeRetryBody.Close()
+		}
+	}()
+	totalLinesProcessed := 0
+	sessionStartTime := time.Now()
+
+	// Counts consecutive resume attempts (after at least one retry) whose last formal text ends with sentence punctuation
+	resumePunctStreak := 0
+
+	expectedCandidates := requestedCandidateCount(originalRequestBody)
+	retryRequestBody := originalRequestBody
+	if expectedCandidates > 1 {
+		retryRequestBody = singleCandidateBody(originalRequestBody)
+	}
+
+	session := &streamSession{
+		ctx:             ctx,
+		cfg:             cfg,
+		writer:          writer,
+		detector:        req.Detector,
+		candidates:      newCandidateSet(expectedCandidates),
+		thoughtHistory:  ResolveThoughtHistory(cfg, req.Model),
+		continuation:    ResolveContinuationStrategy(cfg, req.Model),
+		maxOutputTokens: requestedMaxOutputTokens(originalRequestBody),
+		progress:        req.ProgressEvents,
+		requestID:       requestID,
+	}
+	if session.maxOutputTokens > 0 {
+		logger.LogInfo(fmt.Sprintf("Client-specified maxOutputTokens found, output token budget set to: %d", session.maxOutputTokens))
+	}
+
+	retries := newRetryTracker(cfg)
+
+	logger.LogInfo(fmt.Sprintf("Starting stream processing session. Max retries: %d, completion detector: %s, candidates: %d, thought history: %s, continuation: %s", cfg.MaxConsecutiveRetries, session.detector.Name(), expectedCandidates, session.thoughtHistory, session.continuation))
+
+	for {
+		streamStartTime := time.Now()
+		linesInThisStream := 0
+		textBeforeStream := session.candidates.totalChars()
 
-			// Flush the response to ensure data is sent immediately to the client
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
+		logger.LogDebug(fmt.Sprintf("=== Starting stream attempt %d/%d ===", consecutiveRetryCount+1, cfg.MaxConsecutiveRetries+1))
+
+		// Read the attempt's SSE events
+		watchdog := newStallWatchdog(currentReader, cfg.StallFirstByteTimeout, cfg.StallIdleTimeout)
+		stream := startSSEStream(ctx, watchdog, cfg.SSEMaxEventBytes)
+		var lines <-chan string = stream.lines
+		var race *hedgeRace
+		if session.resumed != nil && cfg.HedgeDelay > 0 && cfg.HedgeMaxParallel > 1 {
+			primary := &hedgeContestant{base: currentBase, body: activeRetryBody, watchdog: watchdog, stream: stream}
+			bases := hedgeBases(req.Upstreams, currentBase, cfg.HedgeMaxParallel-1)
+			hedgeBody := lastRetryBody
+			race = startHedgeRace(ctx, primary, cfg.HedgeDelay, cfg.HedgeMaxParallel, func(ctx context.Context, id int) (*hedgeContestant, error) {
+				return launchHedge(ctx, cfg, req, hedgeBody, bases[id-1])
+			})
+			lines = race.lines()
+		}
+		if resumed := session.resumed; resumed != nil && resumed.text != "" {
+			if session.continuation == ContinuationRestart {
+				lines = SkipReplayedText(ctx, lines, resumed.text)
+			} else if cfg.EnableSeamDedup {
+				lines = DedupSeam(ctx, lines, resumed.text, cfg.SeamDedupWindow, cfg.SeamDedupMinOverlap)
 			}
+		}
 
-			if textChunk != "" && !isThought {
-				isOutputtingFormalText = true
-				accumulatedText += textChunk
-				textInThisStream += textChunk
-				attemptLastFormalTextFlushed = true
+		// Track the last formal text chunk seen in this attempt
+		session.attemptUsage = usageCounts{}
+		session.attemptBlocks = map[string]bool{}
+		session.lastFormalText = ""
+		session.lastFormalLine = ""
+		session.lastFormalFlushed = false
+
+		// Process lines. exhausted is set when the stream ended rather than the session
+		// completing, after which the stream's read error is safe to inspect.
+		exhausted := true
+		for line := range lines {
+			totalLinesProcessed++
+			linesInThisStream++
+			if race != nil {
+				// Usage of aborted hedges is added before the winner's chunks report the
+				// session's merged usage.
+				session.usageHistory = append(session.usageHistory, race.takeLoserUsage()...)
 			}
 
-			// Check for total output character limit
-			if maxOutputChars > 0 && len(accumulatedText) >= maxOutputChars {
-				logger.LogInfo(fmt.Sprintf("Total output character limit (%d) reached. Treating as a clean exit.", maxOutputChars))
-				cleanExit = true
+			done, err := session.processLine(line)
+			if err != nil {
+				if race != nil {
+					race.finish()
+				}
+				watchdog.stop()
+				return err
+			}
+			if done {
+				exhausted = false
 				break
 			}
+		}
+		if race != nil {
+			// Continue with whichever attempt won; the losers, the primary included, are
+			// closed by finish.
+			winner := race.finish()
+			session.usageHistory = append(session.usageHistory, race.takeLoserUsage()...)
+			activeRetryBody = winner.body
+			currentBase = winner.base
+			watchdog = winner.watchdog
+			stream = winner.stream
+		}
+		watchdog.stop()
+		var readErr error
+		if exhausted {
+			readErr = stream.err
+		}
 
-			if finishReason == "STOP" || finishReason == "MAX_TOKENS" {
-				logger.LogInfo(fmt.Sprintf("Finish reason '%s' accepted as final. Stream complete.", finishReason))
-				cleanExit = true
-				break
+		if ctx.Err() != nil {
+			logger.LogInfo("Client disconnected during stream attempt. Aborting without retry.")
+			return ErrClientCancelled
+		}
+
+		// Only stalls and transport errors count against the upstream's breaker: a DROP is
+		// a clean end of stream, usually the model's doing rather than the upstream's.
+		upstreamFailed := false
+		for _, state := range session.candidates.ordered() {
+			if session.active(state) && state.streaming() {
+				if watchdog.tripped() || errors.Is(readErr, ErrUpstreamStalled) {
+					logger.LogError(fmt.Sprintf("Stream stalled without finish reason for candidate %d - detected as STALL", state.index))
+					state.interruption = ReasonStall
+					upstreamFailed = true
+				} else if readErr != nil {
+					state.interruption = ReasonNetworkError
+					if errors.Is(readErr, ErrSSEEventTooLarge) {
+						state.interruption = ReasonEventTooLarge
+					} else {
+						upstreamFailed = true
+					}
+					logger.LogError(fmt.Sprintf("Stream read failed for candidate %d (%v) - detected as %s", state.index, readErr, state.interruption))
+				} else {
+					logger.LogError(fmt.Sprintf("Stream ended without finish reason for candidate %d - detected as DROP", state.index))
+					state.interruption = ReasonDrop
+				}
 			}
 		}
+		if upstreamFailed && req.Upstreams != nil {
+			req.Upstreams.ReportFailure(currentBase)
+		}
+		session.chargeAttemptTokens()
 
-		if !cleanExit && interruptionReason == "" {
-			logger.LogError("Stream ended without finish reason - detected as DROP")
-			interruptionReason = "DROP"
+		if session.failedBlock != "" {
+			return session.failBlocked(session.failedBlock, consecutiveRetryCount, sessionStartTime)
 		}
 
 		streamDuration := time.Since(streamStartTime)
 		logger.LogDebug("Stream attempt summary:")
 		logger.LogDebug(fmt.Sprintf("  Duration: %v", streamDuration))
 		logger.LogDebug(fmt.Sprintf("  Lines processed: %d", linesInThisStream))
-		logger.LogDebug(fmt.Sprintf("  Text generated this stream: %d chars", len(textInThisStream)))
-		logger.LogDebug(fmt.Sprintf("  Total accumulated text: %d chars", len(accumulatedText)))
+		logger.LogDebug(fmt.Sprintf("  Text generated this stream: %d chars", session.candidates.totalChars()-textBeforeStream))
+		logger.LogDebug(fmt.Sprintf("  Total accumulated text: %d chars", session.candidates.totalChars()))
 
 		// Cross-attempt heuristic (optional): if we are in a resumed attempt (after at least one retry)
 		// and the last formal text of this attempt ends with sentence punctuation, count streak.
 		// If we reach 3 such consecutive resume attempts, treat as success and finish.
-		if cfg.EnablePunctuationHeuristic && !cleanExit && consecutiveRetryCount > 0 {
-			if attemptLastFormalText != "" && endsWithSentencePunctuation(attemptLastFormalText) {
+		if resumed := session.resumed; cfg.EnablePunctuationHeuristic && resumed != nil && !resumed.finished {
+			if session.lastFormalText != "" && endsWithSentencePunctuation(session.lastFormalText) {
 				resumePunctStreak++
 				logger.LogInfo(fmt.Sprintf("Resume punctuation streak incremented to %d (last formal text ends with sentence punctuation)", resumePunctStreak))
 			} else {
-				if attemptLastFormalText == "" {
+				if session.lastFormalText == "" {
 					logger.LogDebug("No formal text in this attempt; resetting resume punctuation streak to 0")
 				} else {
 					logger.LogDebug("Last formal text does not end with sentence punctuation; resetting resume punctuation streak to 0")
@@ -287,160 +743,308 @@ func ProcessStreamAndRetryInternally(cfg *config.Config, initialReader io.Reader
 				logger.LogInfo("Treating stream as successful due to 3 consecutive resume attempts ending with sentence punctuation.")
 				// If the last formal text of this attempt was not flushed due to early interruption,
 				// flush it now so the client receives the most recent block.
-				if !attemptLastFormalTextFlushed && attemptLastFormalDataLine != "" {
-					isEnd := ExtractFinishReason(attemptLastFormalDataLine)
+				if !session.lastFormalFlushed && session.lastFormalLine != "" {
+					isEnd := ExtractFinishReason(session.lastFormalLine)
 					shouldRemove := isEnd == "STOP" || isEnd == "MAX_TOKENS"
-					processed := RemoveDoneTokenFromLine(attemptLastFormalDataLine, shouldRemove)
-					if _, err := writer.Write([]byte(processed + "\n\n")); err == nil {
-						if flusher, ok := writer.(http.Flusher); ok {
-							flusher.Flush()
-						}
+					processed := RemoveCompletionMarkerFromLine(session.lastFormalLine, session.detector, shouldRemove)
+					if err := session.write(processed); err == nil {
 						// Keep accounting consistent
-						accumulatedText += attemptLastFormalText
-						textInThisStream += attemptLastFormalText
-						isOutputtingFormalText = true
+						resumed.text += session.lastFormalText
+						resumed.outputFormalText = true
 					}
 				}
-				cleanExit = true
+				resumed.finished = true
+				resumed.interruption = ""
+			}
+		}
+
+		// Never ask the model to continue past a function call: the turn is over and the
+		// client has to run the tool, so end the candidate with a synthetic STOP instead.
+		for _, state := range session.candidates.ordered() {
+			if state.finished || state.functionCalls == 0 {
+				continue
+			}
+			logger.LogInfo(fmt.Sprintf("Candidate %d was interrupted (%s) after a function call. Ending the turn instead of continuing.", state.index, state.interruption))
+			if err := session.write(session.finishLine(state.index, "STOP")); err != nil {
+				return err
+			}
+			state.finished = true
+			state.interruption = ""
+		}
+
+		// A candidate that has used up the client's output budget ends as MAX_TOKENS, as
+		// it would have without the interruption.
+		for _, state := range session.candidates.ordered() {
+			if remaining, ok := session.remainingTokens(state); ok && !state.finished && remaining <= 0 {
+				logger.LogInfo(fmt.Sprintf("Candidate %d exhausted the output token budget (%d/%d) at %s. Finishing with MAX_TOKENS.", state.index, state.tokensUsed, session.maxOutputTokens, state.interruption))
+				if err := session.write(session.finishLine(state.index, "MAX_TOKENS")); err != nil {
+					return err
+				}
+				state.finished = true
+				state.interruption = ""
 			}
 		}
 
-		if cleanExit {
+		next := session.candidates.nextUnfinished()
+		if next == nil {
 			sessionDuration := time.Since(sessionStartTime)
 			logger.LogInfo("=== STREAM COMPLETED SUCCESSFULLY ===")
 			logger.LogInfo(fmt.Sprintf("Total session duration: %v", sessionDuration))
 			logger.LogInfo(fmt.Sprintf("Total lines processed: %d", totalLinesProcessed))
-			logger.LogInfo(fmt.Sprintf("Total text generated: %d characters", len(accumulatedText)))
+			logger.LogInfo(fmt.Sprintf("Total text generated: %d characters", session.candidates.totalChars()))
 			logger.LogInfo(fmt.Sprintf("Total retries needed: %d", consecutiveRetryCount))
-			return nil
+			return session.emitSummary(ProgressStatusCompleted, consecutiveRetryCount, sessionStartTime)
 		}
 
 		// Interruption & Retry Activation
 		logger.LogError("=== STREAM INTERRUPTED ===")
-		logger.LogError(fmt.Sprintf("Reason: %s", interruptionReason))
+		logger.LogError(fmt.Sprintf("Reason: %s (candidate %d)", next.interruption, next.index))
+		if err := session.emitInterrupted(consecutiveRetryCount+1, next); err != nil {
+			return err
+		}
 
-		if cfg.SwallowThoughtsAfterRetry && isOutputtingFormalText {
+		if session.resumed != next {
+			resumePunctStreak = 0
+		}
+
+		if cfg.SwallowThoughtsAfterRetry && next.outputFormalText {
 			logger.LogInfo("Retry triggered after formal text output. Will swallow subsequent thought chunks until formal text resumes.")
-			swallowModeActive = true
+			next.swallowing = true
 		}
 
 		logger.LogError(fmt.Sprintf("Current retry count: %d", consecutiveRetryCount))
 		logger.LogError(fmt.Sprintf("Max retries allowed: %d", cfg.MaxConsecutiveRetries))
-		logger.LogError(fmt.Sprintf("Text accumulated so far: %d characters", len(accumulatedText)))
-
-		if consecutiveRetryCount >= cfg.MaxConsecutiveRetries {
-			errorPayload := map[string]interface{}{
-				"error": map[string]interface{}{
-					"code":    504,
-					"status":  "DEADLINE_EXCEEDED",
-					"message": fmt.Sprintf("Retry limit (%d) exceeded after stream interruption. Last reason: %s.", cfg.MaxConsecutiveRetries, interruptionReason),
-					"details": []interface{}{
-						map[string]interface{}{
-							"@type":                  "proxy.debug",
-							"accumulated_text_chars": len(accumulatedText),
+		logger.LogError(fmt.Sprintf("Text accumulated so far: %d characters", len(next.text)))
+
+		// Keep retrying until an attempt yields a new stream. Connection failures and
+		// retryable upstream statuses are retried under their own policies.
+		retryReason := next.interruption
+		for {
+			delay, limit, allowed := retries.next(retryReason, consecutiveRetryCount)
+			if category, blocked := strings.CutPrefix(retryReason, ReasonBlock+"_"); blocked && !allowed {
+				logger.LogError(fmt.Sprintf("Block retries exhausted (limit %d)", limit))
+				return session.failBlocked(category, consecutiveRetryCount, sessionStartTime)
+			}
+			if !allowed {
+				errorPayload := map[string]interface{}{
+					"error": map[string]interface{}{
+						"code":    504,
+						"status":  "DEADLINE_EXCEEDED",
+						"message": fmt.Sprintf("Retry limit (%d) exceeded after stream interruption. Last reason: %s.", limit, retryReason),
+						"details": []interface{}{
+							map[string]interface{}{
+								"@type":                  "proxy.debug",
+								"accumulated_text_chars": session.candidates.totalChars(),
+							},
 						},
 					},
-				},
+				}
+
+				session.emitSummary(ProgressStatusRetryLimitExceeded, consecutiveRetryCount, sessionStartTime)
+				errorBytes, _ := json.Marshal(errorPayload)
+				writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
+
+				// Flush the error response to ensure it's sent immediately
+				if flusher, ok := writer.(http.Flusher); ok {
+					flusher.Flush()
+				}
+
+				return ErrRetryLimitExceeded
+			}
+
+			if delay > 0 {
+				logger.LogInfo(fmt.Sprintf("Backing off %v before retrying after %s", delay, retryReason))
+			}
+			if err := sleepWithContext(ctx, delay); err != nil {
+				logger.LogInfo("Client disconnected before retry. Aborting.")
+				return err
+			}
+
+			consecutiveRetryCount++
+			if requestID != "" {
+				metrics.IncRetry(requestID)
+			}
+			logger.LogInfo(fmt.Sprintf("=== STARTING RETRY %d/%d (%s) ===", consecutiveRetryCount, cfg.MaxConsecutiveRetries, retryReason))
+			if err := session.emitProgress(ProgressRetrying, map[string]interface{}{
+				"attempt":   consecutiveRetryCount + 1,
+				"candidate": next.index,
+				"reason":    retryReason,
+				"delayMs":   delay.Milliseconds(),
+			}); err != nil {
+				return err
 			}
 
-			errorBytes, _ := json.Marshal(errorPayload)
-			writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
+			if req.Upstreams != nil {
+				if next := req.Upstreams.Pick(cfg.RetryUpstreamStrategy, currentBase); next != currentBase {
+					logger.LogInfo(fmt.Sprintf("Failing over retry from %s to %s (strategy: %s)", currentBase, next, cfg.RetryUpstreamStrategy))
+					currentBase = next
+				}
+			}
+			if requestID != "" {
+				metrics.RecordAttempt(requestID, currentBase, retryReason)
+			}
 
-			// Flush the error response to ensure it's sent immediately
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
+			attemptBody := retryRequestBody
+			// A restarted attempt regenerates the skipped text too, so it keeps the full budget.
+			if remaining, ok := session.remainingTokens(next); ok && session.continuation != ContinuationRestart {
+				logger.LogInfo(fmt.Sprintf("Lowering maxOutputTokens to the remaining budget: %d (used %d of %d)", remaining, next.tokensUsed, session.maxOutputTokens))
+				attemptBody = withGenerationConfig(retryRequestBody, "maxOutputTokens", remaining)
 			}
 
-            return ErrRetryLimitExceeded
-        }
+			continuation := Continuation{
+				Strategy: session.continuation,
+				Prompt:   ContinuationPrompt(cfg, req.Model, originalRequestBody, next.text),
+			}
+			retryBody := BuildContinuationBody(attemptBody, next.historyParts(session.thoughtHistory), continuation)
+			lastRetryBody = retryBody
+
+			requestStart := time.Now()
+			attemptCtx, cancelAttempt := context.WithCancel(ctx)
+			headersStalled := HeaderDeadline(cfg.StallFirstByteTimeout, cancelAttempt)
+			retryResponse, err := sendRetryRequest(attemptCtx, req.Clients, retryBody, currentBase+req.UpstreamPath, req.Headers)
+			stalled := headersStalled()
+			if err != nil {
+				cancelAttempt()
+				if ctx.Err() != nil {
+					logger.LogInfo("Client disconnected while waiting for retry response. Aborting.")
+					return ErrClientCancelled
+				}
+				if req.Upstreams != nil {
+					req.Upstreams.ReportFailure(currentBase)
+				}
+				logger.LogError(fmt.Sprintf("=== RETRY ATTEMPT %d FAILED ===", consecutiveRetryCount))
+				if stalled {
+					logger.LogError(fmt.Sprintf("No response headers within the first byte timeout (%v)", cfg.StallFirstByteTimeout))
+					retryReason = ReasonStall
+					continue
+				}
+				logger.LogError("Exception during retry:", err)
+				retryReason = ReasonNetworkError
+				continue
+			}
+			retryResponse.Body = NewCancelOnClose(retryResponse.Body, cancelAttempt)
+
+			logger.LogInfo(fmt.Sprintf("Retry request completed. Status: %d %s", retryResponse.StatusCode, retryResponse.Status))
+
+			if nonRetryableStatuses[retryResponse.StatusCode] {
+				errorBytes, _ := io.ReadAll(retryResponse.Body)
+				retryResponse.Body.Close()
+
+				// A quota error is retryable when the pool has another key to offer.
+				if req.Keys != nil {
+					if exceeded, retryAfter := apikeys.QuotaExceeded(retryResponse.StatusCode, retryResponse.Header, errorBytes); exceeded {
+						if key, ok := req.Keys.Rotate(req.Headers.Get("X-Goog-Api-Key"), req.Client, retryAfter); ok {
+							req.Headers = apikeys.WithKey(req.Headers, key)
+							if requestID != "" {
+								metrics.RecordAPIKey(requestID, apikeys.Mask(key))
+							}
+							retryReason = HTTPStatusReason(retryResponse.StatusCode)
+							continue
+						}
+					}
+				}
 
-        consecutiveRetryCount++
-        if requestID != "" {
-            metrics.IncRetry(requestID)
-        }
-        logger.LogInfo(fmt.Sprintf("=== STARTING RETRY %d/%d ===", consecutiveRetryCount, cfg.MaxConsecutiveRetries))
+				logger.LogError("=== FATAL ERROR DURING RETRY ===")
+				logger.LogError(fmt.Sprintf("Received non-retryable status %d during retry attempt %d", retryResponse.StatusCode, consecutiveRetryCount))
 
-		// Build retry request
-		retryBody := BuildRetryRequestBody(originalRequestBody, accumulatedText)
+				// Write SSE error from upstream
+				session.emitSummary(ProgressStatusFailed, consecutiveRetryCount, sessionStartTime)
 
-		// Log the retry request body for debugging
-		prettyBodyBytes, _ := json.MarshalIndent(retryBody, "  ", "  ")
-		f, err := os.OpenFile("debug.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err == nil {
-			f.WriteString("\n--- RETRY REQUEST ---")
-			f.Write(prettyBodyBytes)
-			f.Close()
-		}
+				writer.Write([]byte(upstreamErrorEvent(retryResponse.StatusCode, errorBytes)))
 
-		retryBodyBytes, err := json.Marshal(retryBody)
-		if err != nil {
-			logger.LogError("Failed to marshal retry body:", err)
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+				// Flush the error response to ensure it's sent immediately
+				if flusher, ok := writer.(http.Flusher); ok {
+					flusher.Flush()
+				}
 
-		// Create retry request
-		retryReq, err := http.NewRequest("POST", upstreamURL, bytes.NewReader(retryBodyBytes))
-		if err != nil {
-			logger.LogError("Failed to create retry request:", err)
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+				return fmt.Errorf("non-retryable error: %d", retryResponse.StatusCode)
+			}
 
-		// Copy headers
-		for name, values := range originalHeaders {
-			if name == "Authorization" || name == "X-Goog-Api-Key" || name == "Content-Type" || name == "Accept" {
-				for _, value := range values {
-					retryReq.Header.Add(name, value)
+			if retryResponse.StatusCode != http.StatusOK {
+				if req.Upstreams != nil && retryResponse.StatusCode >= 500 {
+					req.Upstreams.ReportFailure(currentBase)
 				}
+				logger.LogError(fmt.Sprintf("Retry attempt %d failed with status %d", consecutiveRetryCount, retryResponse.StatusCode))
+				logger.LogError("This is considered a retryable error - will try again if retries remain")
+				retryResponse.Body.Close()
+				retryReason = HTTPStatusReason(retryResponse.StatusCode)
+				continue
 			}
-		}
 
-		logger.LogDebug(fmt.Sprintf("Making retry request to: %s", upstreamURL))
-		logger.LogDebug(fmt.Sprintf("Retry request body size: %d bytes", len(retryBodyBytes)))
+			if req.Upstreams != nil {
+				req.Upstreams.ReportSuccess(currentBase, time.Since(requestStart))
+			}
+			logger.LogInfo(fmt.Sprintf("✓ Retry attempt %d successful - got new stream", consecutiveRetryCount))
+			logger.LogInfo(fmt.Sprintf("Continuing candidate %d with accumulated context (%d chars)", next.index, len(next.text)))
 
-		// Make retry request
-		client := &http.Client{}
-		retryResponse, err := client.Do(retryReq)
-		if err != nil {
-			logger.LogError(fmt.Sprintf("=== RETRY ATTEMPT %d FAILED ===", consecutiveRetryCount))
-			logger.LogError("Exception during retry:", err)
-			logger.LogError(fmt.Sprintf("Will wait %v before next attempt (if any)", cfg.RetryDelayMs))
-			time.Sleep(cfg.RetryDelayMs)
-			continue
+			if activeRetryBody != nil {
+				activeRetryBody.Close()
+			}
+			activeRetryBody = retryResponse.Body
+			currentReader = retryResponse.Body
+			next.interruption = ""
+			session.resumed = next
+			if err := session.emitProgress(ProgressResumed, map[string]interface{}{
+				"attempt":   consecutiveRetryCount + 1,
+				"candidate": next.index,
+			}); err != nil {
+				return err
+			}
+			break
 		}
+	}
+}
 
-		logger.LogInfo(fmt.Sprintf("Retry request completed. Status: %d %s", retryResponse.StatusCode, retryResponse.Status))
+// upstreamErrorEvent renders an upstream error body as an SSE error event. Google error
+// bodies are pretty-printed over several lines, so JSON is compacted onto a single data
+// line; anything else is wrapped in a Google-style error.
+func upstreamErrorEvent(status int, body []byte) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, body); err != nil {
+		payload, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    status,
+				"message": strings.TrimSpace(string(body)),
+			},
+		})
+		compact.Reset()
+		compact.Write(payload)
+	}
+	return "event: error\ndata: " + compact.String() + "\n\n"
+}
 
-		if nonRetryableStatuses[retryResponse.StatusCode] {
-			logger.LogError("=== FATAL ERROR DURING RETRY ===")
-			logger.LogError(fmt.Sprintf("Received non-retryable status %d during retry attempt %d", retryResponse.StatusCode, consecutiveRetryCount))
+// sendRetryRequest performs one upstream retry request with the continuation body.
+func sendRetryRequest(ctx context.Context, clients *transport.Clients, retryBody map[string]interface{}, upstreamURL string, originalHeaders http.Header) (*http.Response, error) {
+	// Log the retry request body for debugging
+	prettyBodyBytes, _ := json.MarshalIndent(retryBody, "  ", "  ")
+	f, err := os.OpenFile("debug.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		f.WriteString("\n--- RETRY REQUEST ---")
+		f.Write(prettyBodyBytes)
+		f.Close()
+	}
 
-			// Write SSE error from upstream
-			errorBytes, _ := io.ReadAll(retryResponse.Body)
-			retryResponse.Body.Close()
+	retryBodyBytes, err := json.Marshal(retryBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal retry body: %w", err)
+	}
 
-			writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
+	retryReq, err := http.NewRequestWithContext(ctx, "POST", upstreamURL, bytes.NewReader(retryBodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retry request: %w", err)
+	}
 
-			// Flush the error response to ensure it's sent immediately
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
+	// Copy headers
+	for name, values := range originalHeaders {
+		if name == "Authorization" || name == "X-Goog-Api-Key" || name == "Content-Type" || name == "Accept" {
+			for _, value := range values {
+				retryReq.Header.Add(name, value)
 			}
-
-			return fmt.Errorf("non-retryable error: %d", retryResponse.StatusCode)
-		}
-
-		if retryResponse.StatusCode != http.StatusOK {
-			logger.LogError(fmt.Sprintf("Retry attempt %d failed with status %d", consecutiveRetryCount, retryResponse.StatusCode))
-			logger.LogError("This is considered a retryable error - will try again if retries remain")
-			retryResponse.Body.Close()
-			time.Sleep(cfg.RetryDelayMs)
-			continue
 		}
+	}
 
-		logger.LogInfo(fmt.Sprintf("✓ Retry attempt %d successful - got new stream", consecutiveRetryCount))
-		logger.LogInfo(fmt.Sprintf("Continuing with accumulated context (%d chars)", len(accumulatedText)))
+	logger.LogDebug(fmt.Sprintf("Making retry request to: %s", upstreamURL))
+	logger.LogDebug(fmt.Sprintf("Retry request body size: %d bytes", len(retryBodyBytes)))
 
-		currentReader = retryResponse.Body
-	}
+	return clients.For(upstreamURL).Do(retryReq)
 }
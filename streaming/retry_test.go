@@ -0,0 +1,163 @@
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/upstream"
+)
+
+// newTestSession returns a session of one candidate writing its output to out.
+func newTestSession(cfg *config.Config, detector CompletionDetector, out *bytes.Buffer) *streamSession {
+	return &streamSession{
+		ctx:        context.Background(),
+		cfg:        cfg,
+		writer:     out,
+		detector:   detector,
+		candidates: newCandidateSet(1),
+	}
+}
+
+func TestProcessLineFinishReason(t *testing.T) {
+	tests := []struct {
+		name             string
+		detector         CompletionDetector
+		lines            []string
+		wantInterruption string
+		wantFinished     bool
+		wantText         string
+	}{
+		{
+			name:         "STOP with the sentinel token",
+			detector:     NewSentinelDetector(""),
+			lines:        []string{textChunkLine(t, "All done.[done]", "STOP")},
+			wantFinished: true,
+			wantText:     "All done.",
+		},
+		{
+			name:         "STOP with a custom marker",
+			detector:     NewSentinelDetector("<<END>>"),
+			lines:        []string{textChunkLine(t, "All ", ""), textChunkLine(t, "done.<<END>>", "STOP")},
+			wantFinished: true,
+			wantText:     "All done.",
+		},
+		{
+			name:             "STOP without the sentinel token",
+			detector:         NewSentinelDetector(""),
+			lines:            []string{textChunkLine(t, "All done", "STOP")},
+			wantInterruption: ReasonFinishIncomplete,
+		},
+		{
+			name:             "STOP without text",
+			detector:         NewSentinelDetector(""),
+			lines:            []string{textChunkLine(t, "", "STOP")},
+			wantInterruption: ReasonFinishEmpty,
+		},
+		{
+			name:         "STOP accepted by the punctuation detector",
+			detector:     PunctuationDetector{},
+			lines:        []string{textChunkLine(t, "All done.", "STOP")},
+			wantFinished: true,
+			wantText:     "All done.",
+		},
+		{
+			name:         "MAX_TOKENS is final without a marker",
+			detector:     NewSentinelDetector(""),
+			lines:        []string{textChunkLine(t, "Cut off", "MAX_TOKENS")},
+			wantFinished: true,
+			wantText:     "Cut off",
+		},
+		{
+			name:             "abnormal finish reason",
+			detector:         NewSentinelDetector(""),
+			lines:            []string{textChunkLine(t, "Some text", "OTHER")},
+			wantInterruption: ReasonFinishAbnormal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			session := newTestSession(&config.Config{}, tt.detector, &out)
+			for _, line := range tt.lines {
+				if _, err := session.processLine(line); err != nil {
+					t.Fatalf("processLine: %v", err)
+				}
+			}
+
+			state := session.candidates.get(0)
+			if state.interruption != tt.wantInterruption {
+				t.Errorf("interruption = %q; want %q", state.interruption, tt.wantInterruption)
+			}
+			if state.finished != tt.wantFinished {
+				t.Errorf("finished = %t; want %t", state.finished, tt.wantFinished)
+			}
+
+			text := ""
+			reader := NewSSEReader(&out, 0)
+			for event, err := reader.Next(); err == nil; event, err = reader.Next() {
+				text += ParseLineContent(event.Line()).Text
+			}
+			if text != tt.wantText {
+				t.Errorf("forwarded text = %q; want %q", text, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestInterruptionBreakerReport(t *testing.T) {
+	const base = "https://upstream.example"
+
+	tests := []struct {
+		name      string
+		body      func(t *testing.T) io.Reader
+		wantState string
+	}{
+		{
+			name: "DROP leaves the upstream closed",
+			body: func(t *testing.T) io.Reader {
+				return strings.NewReader(textChunkLine(t, "Partial", "") + "\n\n")
+			},
+			wantState: upstream.StateClosed,
+		},
+		{
+			name: "STALL opens the upstream",
+			body: func(t *testing.T) io.Reader {
+				return StalledBody()
+			},
+			wantState: upstream.StateOpen,
+		},
+		{
+			name: "transport error opens the upstream",
+			body: func(t *testing.T) io.Reader {
+				return io.MultiReader(strings.NewReader(textChunkLine(t, "Partial", "")+"\n\n"), iotest.ErrReader(errors.New("connection reset")))
+			},
+			wantState: upstream.StateOpen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := upstream.NewPool("default", []upstream.Member{{Base: base}}, upstream.Breaker{Threshold: 1, Cooldown: time.Minute})
+			req := StreamRequest{
+				Body:         map[string]interface{}{},
+				Detector:     NewSentinelDetector(""),
+				UpstreamBase: base,
+				Upstreams:    pool,
+			}
+			// Without retries the session ends after the interrupted initial attempt.
+			ProcessStreamAndRetryInternally(context.Background(), &config.Config{}, tt.body(t), io.Discard, req)
+
+			if got := pool.Snapshot()[0].State; got != tt.wantState {
+				t.Errorf("breaker state = %q; want %q", got, tt.wantState)
+			}
+		})
+	}
+}
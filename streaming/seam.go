@@ -0,0 +1,344 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gemini-antiblock/logger"
+)
+
+// seamDeduper removes text a resumed attempt repeats from the end of the output
+// already sent to the client, and restores a missing space at the seam.
+type seamDeduper struct {
+	tail       string
+	window     int
+	minOverlap int
+	// inCode is set when the previous output ends inside a code fence or inline code,
+	// where no space is ever inserted at the seam.
+	inCode bool
+
+	buffered     []string
+	bufferedText string
+	resolved     bool
+}
+
+// DedupSeam wraps the line channel of a resumed attempt. It holds back the first
+// window characters of formal text, strips any prefix that overlaps the tail of
+// accumulatedText (exactly, or ignoring case, whitespace and punctuation on word
+// boundaries) and then forwards the rewritten lines followed by the rest of the stream
+// unchanged.
+func DedupSeam(ctx context.Context, in <-chan string, accumulatedText string, window, minOverlap int) <-chan string {
+	out := make(chan string, 100)
+	d := &seamDeduper{
+		tail:       tailRunes(accumulatedText, 2*window),
+		window:     window,
+		minOverlap: minOverlap,
+		inCode:     insideCode(accumulatedText),
+	}
+
+	go func() {
+		defer close(out)
+		send := func(lines ...string) bool {
+			for _, line := range lines {
+				select {
+				case out <- line:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		}
+
+		for line := range in {
+			if d.resolved {
+				if !send(line) {
+					return
+				}
+				continue
+			}
+
+			content := ParseLineContent(line)
+			isFormal := content.Text != "" && !content.IsThought
+			if len(d.buffered) == 0 && !isFormal {
+				// Nothing held back yet; thoughts and metadata flow straight through.
+				if !send(line) {
+					return
+				}
+				continue
+			}
+
+			d.buffered = append(d.buffered, line)
+			if isFormal {
+				d.bufferedText += content.Text
+			}
+			if utf8.RuneCountInString(d.bufferedText) >= d.window || ExtractFinishReason(line) != "" || IsBlockedLine(line) {
+				if !send(d.flush()...) {
+					return
+				}
+			}
+		}
+
+		if !d.resolved && len(d.buffered) > 0 {
+			send(d.flush()...)
+		}
+	}()
+
+	return out
+}
+
+// flush resolves the overlap and returns the held-back lines with their text rewritten.
+func (d *seamDeduper) flush() []string {
+	d.resolved = true
+
+	cut, mode := seamOverlap(d.tail, d.bufferedText, d.minOverlap)
+	if cut > 0 {
+		logger.LogInfo(fmt.Sprintf("Seam de-duplication (%s) removed %d repeated characters: %q", mode, utf8.RuneCountInString(d.bufferedText[:cut]), previewText(d.bufferedText[:cut], 80)))
+	}
+	prefix := ""
+	if !d.inCode && needsSeamSpace(d.tail, d.bufferedText[cut:]) {
+		logger.LogDebug("Inserting missing space at retry seam")
+		prefix = " "
+	}
+	if cut == 0 && prefix == "" {
+		return d.buffered
+	}
+
+	lines := make([]string, 0, len(d.buffered))
+	remaining := cut
+	for _, line := range d.buffered {
+		content := ParseLineContent(line)
+		if content.Text == "" || content.IsThought || (remaining == 0 && prefix == "") {
+			lines = append(lines, line)
+			continue
+		}
+
+		rewritten, empty := trimLeadingText(line, &remaining, &prefix)
+		if empty && ExtractFinishReason(line) == "" {
+			// The whole chunk was a repeat; the client never needs to see it.
+			continue
+		}
+		lines = append(lines, rewritten)
+	}
+	return lines
+}
+
+// trimLeadingText removes *remaining bytes from the start of the formal text of the
+// first candidate of line, prepends *prefix to the first text left over, and reports
+// whether the chunk has no formal text afterwards.
+func trimLeadingText(line string, remaining *int, prefix *string) (string, bool) {
+	linePrefix, data, ok := parseDataLine(line)
+	if !ok {
+		return line, false
+	}
+	candidates, _ := data["candidates"].([]interface{})
+	if len(candidates) == 0 {
+		return line, false
+	}
+	candidate, ok := candidates[0].(map[string]interface{})
+	if !ok {
+		return line, false
+	}
+
+	empty := true
+	for _, part := range candidateParts(candidate) {
+		text, hasText := part["text"].(string)
+		if thought, _ := part["thought"].(bool); !hasText || thought {
+			continue
+		}
+		drop := *remaining
+		if drop > len(text) {
+			drop = len(text)
+		}
+		text = text[drop:]
+		*remaining -= drop
+		if text != "" && *prefix != "" {
+			text = *prefix + text
+			*prefix = ""
+		}
+		if text != "" {
+			empty = false
+		}
+		part["text"] = text
+	}
+
+	rewritten, err := encodeDataLine(linePrefix, data)
+	if err != nil {
+		return line, false
+	}
+	return rewritten, empty
+}
+
+// normalizedOverlapFactor scales the minimum overlap of normalised matches. Ignoring
+// case and punctuation makes text repeat by chance far more often, e.g. "the function"
+// followed by "Function pointers".
+const normalizedOverlapFactor = 3
+
+// seamOverlap returns the number of bytes at the start of next that repeat the end
+// of tail, trying an exact match first and a normalised match second.
+func seamOverlap(tail, next string, minOverlap int) (int, string) {
+	if tail == "" || next == "" {
+		return 0, ""
+	}
+	if n := exactOverlap(tail, next, minOverlap); n > 0 {
+		return n, "exact"
+	}
+	if n := normalizedOverlap(tail, next, minOverlap*normalizedOverlapFactor); n > 0 {
+		return n, "normalized"
+	}
+	return 0, ""
+}
+
+// exactOverlap finds the longest prefix of next, on a rune boundary, that tail ends with.
+func exactOverlap(tail, next string, minOverlap int) int {
+	limit := len(next)
+	if len(tail) < limit {
+		limit = len(tail)
+	}
+	for n := limit; n > 0; n-- {
+		if n < len(next) && !utf8.RuneStart(next[n]) {
+			continue
+		}
+		if utf8.RuneCountInString(next[:n]) < minOverlap {
+			return 0
+		}
+		if strings.HasSuffix(tail, next[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// normalizedOverlap compares tail and next with case folded and whitespace and
+// punctuation ignored, and maps the match back to a byte offset in next. The match must
+// start and end on word boundaries, so a word is never cut in half. Punctuation
+// directly after the match is dropped too when tail already ends with punctuation.
+func normalizedOverlap(tail, next string, minOverlap int) int {
+	tailNorm, tailStarts, _ := normalizeSeamText(tail)
+	nextNorm, _, nextEnds := normalizeSeamText(next)
+
+	limit := len(nextNorm)
+	if len(tailNorm) < limit {
+		limit = len(tailNorm)
+	}
+	for n := limit; n >= minOverlap && n > 0; n-- {
+		if string(tailNorm[len(tailNorm)-n:]) != string(nextNorm[:n]) {
+			continue
+		}
+		if start := tailStarts[len(tailNorm)-n]; start > 0 {
+			before, _ := utf8.DecodeLastRuneInString(tail[:start])
+			after, _ := utf8.DecodeRuneInString(tail[start:])
+			if !wordBoundary(before, after) {
+				continue
+			}
+		}
+		cut := nextEnds[n-1]
+		if cut < len(next) {
+			before, _ := utf8.DecodeLastRuneInString(next[:cut])
+			after, _ := utf8.DecodeRuneInString(next[cut:])
+			if !wordBoundary(before, after) {
+				continue
+			}
+		}
+		if last, _ := utf8.DecodeLastRuneInString(strings.TrimRightFunc(tail, unicode.IsSpace)); unicode.IsPunct(last) {
+			for cut < len(next) {
+				r, size := utf8.DecodeRuneInString(next[cut:])
+				if !unicode.IsPunct(r) {
+					break
+				}
+				cut += size
+			}
+		}
+		return cut
+	}
+	return 0
+}
+
+// normalizeSeamText lowercases text and drops whitespace and punctuation. starts[i] and
+// ends[i] are the byte offsets in text of the i-th kept rune and just past it.
+func normalizeSeamText(text string) (norm []rune, starts, ends []int) {
+	for i, r := range text {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) {
+			continue
+		}
+		norm = append(norm, unicode.ToLower(r))
+		starts = append(starts, i)
+		ends = append(ends, i+utf8.RuneLen(r))
+	}
+	return norm, starts, ends
+}
+
+// wordBoundary reports whether a word may end between before and after. Han, kana and
+// Hangul are written without spaces, so every such character counts as a word.
+func wordBoundary(before, after rune) bool {
+	if isSpacelessScript(before) || isSpacelessScript(after) {
+		return true
+	}
+	return !isWordRune(before) || !isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func isSpacelessScript(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// needsSeamSpace reports whether a space went missing between the previous attempt's
+// output and the resumed text, e.g. "first sentence." followed by "Second". Only a
+// sentence end followed by a capitalised word that is itself followed by a space or
+// punctuation counts, so decimals ("3."+"14"), code ("fmt."+"Println(") and file names
+// ("main."+"go") are left alone.
+func needsSeamSpace(tail, next string) bool {
+	if tail == "" || next == "" {
+		return false
+	}
+	last, size := utf8.DecodeLastRuneInString(tail)
+	if !strings.ContainsRune(".!?", last) {
+		return false
+	}
+	if before, _ := utf8.DecodeLastRuneInString(tail[:len(tail)-size]); unicode.IsDigit(before) {
+		return false
+	}
+	first, _ := utf8.DecodeRuneInString(next)
+	if first >= unicode.MaxASCII || !unicode.IsUpper(first) {
+		return false
+	}
+	end := strings.IndexFunc(next, func(r rune) bool { return !isWordRune(r) })
+	if end == -1 {
+		return false
+	}
+	after, _ := utf8.DecodeRuneInString(next[end:])
+	return unicode.IsSpace(after) || strings.ContainsRune(",;:!?", after)
+}
+
+// insideCode reports whether text ends inside a fenced code block or an inline code span.
+func insideCode(text string) bool {
+	if strings.Count(text, "```")%2 == 1 {
+		return true
+	}
+	lastLine := text[strings.LastIndex(text, "\n")+1:]
+	return strings.Count(strings.ReplaceAll(lastLine, "```", ""), "`")%2 == 1
+}
+
+func tailRunes(text string, n int) string {
+	if n <= 0 {
+		return text
+	}
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[len(runes)-n:])
+}
+
+func previewText(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "..."
+}
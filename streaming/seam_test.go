@@ -0,0 +1,208 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestSeamOverlap(t *testing.T) {
+	tests := []struct {
+		name     string
+		tail     string
+		next     string
+		wantCut  int
+		wantMode string
+	}{
+		{
+			name:     "exact repeat",
+			tail:     "Hello world, this is a test",
+			next:     "this is a test of the seam",
+			wantCut:  len("this is a test"),
+			wantMode: "exact",
+		},
+		{
+			name: "exact repeat below the minimum",
+			tail: "abc xyz",
+			next: "xyz more",
+		},
+		{
+			name:     "normalized repeat",
+			tail:     "as shown below. The quick brown fox jumps over the lazy dog",
+			next:     "the Quick-brown fox jumps over the lazy dog, and more",
+			wantCut:  len("the Quick-brown fox jumps over the lazy dog"),
+			wantMode: "normalized",
+		},
+		{
+			name: "single word differing in case is not a repeat",
+			tail: "you call the function",
+			next: "Function pointers are useful",
+		},
+		{
+			name: "normalized match starting inside a word",
+			tail: "xxunderstanding between all the parties",
+			next: "Understanding between all the parties matters",
+		},
+		{
+			name: "normalized match ending inside a word",
+			tail: "see the results of the experiment",
+			next: "The results of the experimental run",
+		},
+		{
+			name:     "normalized repeat in text without spaces drops trailing punctuation",
+			tail:     "我们讨论的主题是人工智能技术的发展历史以及它在未来社会中的趋势。",
+			next:     "人工智能技术的发展历史, 以及它在未来社会中的趋势。接下来我们",
+			wantCut:  len("人工智能技术的发展历史, 以及它在未来社会中的趋势。"),
+			wantMode: "normalized",
+		},
+		{
+			name: "empty tail",
+			next: "anything at all",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cut, mode := seamOverlap(tt.tail, tt.next, 6)
+			if cut != tt.wantCut || mode != tt.wantMode {
+				t.Errorf("seamOverlap(%q, %q) = %d, %q; want %d, %q", tt.tail, tt.next, cut, mode, tt.wantCut, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestNeedsSeamSpace(t *testing.T) {
+	tests := []struct {
+		tail string
+		next string
+		want bool
+	}{
+		{"first sentence.", "Second one", true},
+		{"Really?", "Yes, really", true},
+		{"Stop!", "Now!", true},
+		{"Pi is 3.", "14159", false},
+		{"costs 1,", "000 dollars", false},
+		{"call fmt.", "Println(x)", false},
+		{"call fmt.", "Println", false},
+		{"use os.", "Exit.", false},
+		{"edit main.", "go", false},
+		{"see https://example.", "com", false},
+		{"in version 2.", "Next step", false},
+		{"wait;", "Then", false},
+		{"done.", " Next step", false},
+		{"done.", "Über", false},
+		{"", "Next step", false},
+		{"done.", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := needsSeamSpace(tt.tail, tt.next); got != tt.want {
+			t.Errorf("needsSeamSpace(%q, %q) = %t; want %t", tt.tail, tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestInsideCode(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"plain text.", false},
+		{"```go\nfmt.", true},
+		{"```go\nx := 1\n```\nDone.", false},
+		{"call `fmt.", true},
+		{"call `fmt.Println` now.", false},
+		{"first line with `code`\nsecond `line.", true},
+	}
+
+	for _, tt := range tests {
+		if got := insideCode(tt.text); got != tt.want {
+			t.Errorf("insideCode(%q) = %t; want %t", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestDedupSeam(t *testing.T) {
+	tests := []struct {
+		name        string
+		accumulated string
+		chunks      []string
+		want        string
+	}{
+		{
+			name:        "repeat spanning two chunks",
+			accumulated: "Hello there. This is the first part",
+			chunks:      []string{"is the fi", "rst part and more"},
+			want:        " and more",
+		},
+		{
+			name:        "missing space after a sentence",
+			accumulated: "It works.",
+			chunks:      []string{"Next step"},
+			want:        " Next step",
+		},
+		{
+			name:        "decimal number",
+			accumulated: "Pi is 3.",
+			chunks:      []string{"14159 roughly"},
+			want:        "14159 roughly",
+		},
+		{
+			name:        "inside a code fence",
+			accumulated: "```python\nx = a.",
+			chunks:      []string{"B + 1"},
+			want:        "B + 1",
+		},
+		{
+			name:        "no overlap",
+			accumulated: "Some earlier output",
+			chunks:      []string{" and", " the rest"},
+			want:        " and the rest",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make(chan string, len(tt.chunks)+1)
+			for _, chunk := range tt.chunks {
+				in <- textChunkLine(t, chunk, "")
+			}
+			in <- textChunkLine(t, "", "STOP")
+			close(in)
+
+			got := ""
+			finished := false
+			for line := range DedupSeam(context.Background(), in, tt.accumulated, 200, 6) {
+				got += ParseLineContent(line).Text
+				if ExtractFinishReason(line) == "STOP" {
+					finished = true
+				}
+			}
+			if got != tt.want {
+				t.Errorf("resumed text = %q; want %q", got, tt.want)
+			}
+			if !finished {
+				t.Error("finish chunk was not forwarded")
+			}
+		})
+	}
+}
+
+// textChunkLine encodes a single-candidate SSE data line with one text part.
+func textChunkLine(t *testing.T, text, finishReason string) string {
+	t.Helper()
+	candidate := map[string]interface{}{
+		"content": map[string]interface{}{
+			"role":  "model",
+			"parts": []interface{}{map[string]interface{}{"text": text}},
+		},
+	}
+	if finishReason != "" {
+		candidate["finishReason"] = finishReason
+	}
+	encoded, err := json.Marshal(map[string]interface{}{"candidates": []interface{}{candidate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "data: " + string(encoded)
+}
@@ -2,229 +2,439 @@ package streaming
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"time"
 
 	"gemini-antiblock/logger"
 )
 
-// SSELineIterator reads SSE lines from a reader
-func SSELineIterator(reader io.Reader, ch chan<- string) {
-	defer close(ch)
-
-	scanner := bufio.NewScanner(reader)
-	lineCount := 0
-
-	logger.LogDebug("Starting SSE line iteration")
+// ErrSSEEventTooLarge is returned by SSEReader.Next for an event above the size limit.
+var ErrSSEEventTooLarge = errors.New("SSE event exceeds the size limit")
+
+// SSEEvent is one dispatched event of a text/event-stream.
+type SSEEvent struct {
+	// Event is the event type; empty for the default "message" type.
+	Event string
+	// Data joins the event's data lines with "\n".
+	Data string
+	ID   string
+	// Retry is the reconnection time the stream asked for; zero when not set.
+	Retry time.Duration
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.TrimSpace(line) != "" {
-			lineCount++
-			logger.LogDebug(fmt.Sprintf("SSE Line %d: %s", lineCount,
-				func() string {
-					if len(line) > 200 {
-						return line[:200] + "..."
-					}
-					return line
-				}()))
-			ch <- line
+// Line renders the event as the single line the retry loop processes. Message events
+// become a "data: " line, with multi-line JSON compacted onto one line; other event
+// types keep their "event:" field so they are forwarded as is. The id and retry fields
+// only matter for reconnecting to the upstream, which the proxy does itself, so they
+// are not forwarded.
+func (e *SSEEvent) Line() string {
+	data := e.Data
+	if strings.ContainsAny(data, "\r\n") && json.Valid([]byte(data)) {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(data)); err == nil {
+			data = compact.String()
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		logger.LogError("Error reading SSE stream:", err)
+	var b strings.Builder
+	if e.Event != "" && e.Event != "message" {
+		b.WriteString("event: " + e.Event + "\n")
 	}
-
-	logger.LogDebug(fmt.Sprintf("SSE stream ended. Total lines processed: %d", lineCount))
+	for i, line := range strings.Split(data, "\n") {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString("data: " + line)
+	}
+	return b.String()
 }
 
-// IsDataLine checks if a line is a data line
-func IsDataLine(line string) bool {
-	return strings.HasPrefix(line, "data: ")
+// SSEReader parses a text/event-stream as specified by the HTML standard: lines end in
+// CRLF, LF or CR, "data:" may omit the space, data spans multiple lines, comments are
+// skipped and an event is dispatched at a blank line. Events of any size are read up
+// to maxEventSize bytes.
+type SSEReader struct {
+	r            *bufio.Reader
+	maxEventSize int
+	// skipLF is set after a CR so a CRLF pair ends only one line.
+	skipLF bool
 }
 
-// IsBlockedLine checks if a line contains blocking information
-func IsBlockedLine(line string) bool {
-	return strings.Contains(line, "blockReason")
+// NewSSEReader creates a reader; maxEventSize <= 0 disables the size limit.
+func NewSSEReader(r io.Reader, maxEventSize int) *SSEReader {
+	return &SSEReader{r: bufio.NewReader(r), maxEventSize: maxEventSize}
 }
 
-// ExtractFinishReason extracts finish reason from a line
-func ExtractFinishReason(line string) string {
-	if !strings.Contains(line, "finishReason") {
-		return ""
+// Next returns the next event. It returns io.EOF at the end of the stream. As the
+// standard requires, an event the stream ends in before its blank line is discarded:
+// a missing terminator means the upstream was cut off.
+func (r *SSEReader) Next() (*SSEEvent, error) {
+	event := &SSEEvent{}
+	var data strings.Builder
+	hasData := false
+	size := 0
+
+	for {
+		line, err := r.readLine(size)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += len(line) + 1
+
+		if len(line) == 0 {
+			if !hasData {
+				// Blank lines and events without data are not dispatched.
+				event, size = &SSEEvent{}, 0
+				continue
+			}
+			event.Data = data.String()
+			return event, nil
+		}
+		if line[0] == ':' {
+			continue
+		}
+
+		name, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(name) {
+		case "event":
+			event.Event = string(value)
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.Write(value)
+			hasData = true
+		case "id":
+			if bytes.IndexByte(value, 0) == -1 {
+				event.ID = string(value)
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(string(value)); err == nil && ms >= 0 {
+				event.Retry = time.Duration(ms) * time.Millisecond
+			}
+		}
 	}
+}
 
-	idx := strings.Index(line, "{")
-	if idx == -1 {
-		return ""
+// readLine reads one line without its terminator. used is the size of the event read
+// so far, for the size limit. A line cut off by the end of the stream is discarded
+// with io.ErrUnexpectedEOF.
+func (r *SSEReader) readLine(used int) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.r.ReadByte()
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.skipLF {
+			r.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+		switch b {
+		case '\n':
+			return line, nil
+		case '\r':
+			r.skipLF = true
+			return line, nil
+		}
+		line = append(line, b)
+		if r.maxEventSize > 0 && used+len(line) > r.maxEventSize {
+			return nil, fmt.Errorf("%w of %d bytes", ErrSSEEventTooLarge, r.maxEventSize)
+		}
 	}
+}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
-		logger.LogDebug("Failed to extract finishReason from line:", err)
-		return ""
+// sseStream reads the events of an upstream body in the background and yields each as
+// one SSE line. err is set before lines is closed when reading stopped for any reason other
+// than the end of the stream or the client going away.
+type sseStream struct {
+	lines chan string
+	err   error
+}
+
+// startSSEStream starts reading reader, which may use either SSE or JSON array framing.
+// It stops early, without blocking on the channel, once ctx is cancelled.
+func startSSEStream(ctx context.Context, reader io.Reader, maxEventSize int) *sseStream {
+	s := &sseStream{lines: make(chan string, 100)}
+	go s.run(ctx, reader, maxEventSize)
+	return s
+}
+
+func (s *sseStream) run(ctx context.Context, body io.Reader, maxEventSize int) {
+	defer close(s.lines)
+
+	eventCount := 0
+	logger.LogDebug("Starting SSE event iteration")
+
+	reader, err := newEventReader(body, maxEventSize)
+	if err != nil {
+		if err != io.EOF && ctx.Err() == nil {
+			logger.LogError("Error reading SSE stream:", err)
+			s.err = err
+		}
+		return
 	}
 
-	if candidates, ok := data["candidates"].([]interface{}); ok && len(candidates) > 0 {
-		if candidate, ok := candidates[0].(map[string]interface{}); ok {
-			if finishReason, ok := candidate["finishReason"].(string); ok {
-				logger.LogDebug("Extracted finishReason:", finishReason)
-				return finishReason
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				logger.LogError("Error reading SSE stream:", err)
+				s.err = err
 			}
+			logger.LogDebug(fmt.Sprintf("SSE stream ended. Total events processed: %d", eventCount))
+			return
+		}
+
+		line := event.Line()
+		eventCount++
+		logger.LogDebug(fmt.Sprintf("SSE Event %d: %s", eventCount,
+			func() string {
+				if len(line) > 200 {
+					return line[:200] + "..."
+				}
+				return line
+			}()))
+		select {
+		case s.lines <- line:
+		case <-ctx.Done():
+			logger.LogDebug("SSE event iteration cancelled by context")
+			return
 		}
 	}
+}
 
-	return ""
+// IsDataLine checks if a line is a data line
+func IsDataLine(line string) bool {
+	return strings.HasPrefix(line, "data: ")
 }
 
-// LineContent represents parsed content from a data line
-type LineContent struct {
-	Text      string
-	IsThought bool
+// IsBlockedLine reports whether a line reports a block: a blocked prompt, or a candidate
+// that finished with a block finish reason such as SAFETY or RECITATION.
+func IsBlockedLine(line string) bool {
+	if !strings.Contains(line, "blockReason") && !strings.Contains(line, "finishReason") {
+		return false
+	}
+	_, data, ok := parseDataLine(line)
+	return ok && chunkBlocked(data)
 }
 
-// ParseLineContent parses a data line to extract text content and thought status
-func ParseLineContent(line string) LineContent {
+// parseDataLine decodes the JSON payload of an SSE data line. prefix is everything
+// before the payload (normally "data: ").
+func parseDataLine(line string) (prefix string, data map[string]interface{}, ok bool) {
 	if !IsDataLine(line) {
-		return LineContent{}
+		return "", nil, false
 	}
-
 	idx := strings.Index(line, "{")
 	if idx == -1 {
-		return LineContent{}
+		return "", nil, false
 	}
-
-	var data map[string]interface{}
 	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
-		logger.LogDebug("Failed to parse content from data line:", err)
-		return LineContent{}
+		logger.LogDebug("Failed to parse data line:", err)
+		return "", nil, false
 	}
+	return line[:idx], data, true
+}
 
-	candidates, ok := data["candidates"].([]interface{})
-	if !ok || len(candidates) == 0 {
-		return LineContent{}
+// encodeDataLine is the inverse of parseDataLine.
+func encodeDataLine(prefix string, data map[string]interface{}) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
 	}
+	return prefix + string(encoded), nil
+}
 
-	candidate, ok := candidates[0].(map[string]interface{})
-	if !ok {
-		return LineContent{}
+// ExtractFinishReason extracts the first finish reason of any candidate in a line
+func ExtractFinishReason(line string) string {
+	if !strings.Contains(line, "finishReason") {
+		return ""
 	}
 
-	content, ok := candidate["content"].(map[string]interface{})
-	if !ok {
-		return LineContent{}
+	for _, candidate := range ParseCandidates(line) {
+		if candidate.FinishReason != "" {
+			logger.LogDebug("Extracted finishReason:", candidate.FinishReason)
+			return candidate.FinishReason
+		}
 	}
 
-	parts, ok := content["parts"].([]interface{})
-	if !ok || len(parts) == 0 {
-		return LineContent{}
-	}
+	return ""
+}
+
+// CandidateContent is what one candidate contributes to a response chunk.
+type CandidateContent struct {
+	// Index is the candidate index, defaulting to its position in the chunk.
+	Index int
+	// Text joins the text of all non-thought parts; ThoughtText the text of thought parts.
+	Text         string
+	ThoughtText  string
+	HasThought   bool
+	FinishReason string
+	// FunctionCalls counts the functionCall parts of the chunk.
+	FunctionCalls int
+}
+
+// IsThoughtOnly reports whether the candidate carried thought parts but no formal text
+// or function calls.
+func (c CandidateContent) IsThoughtOnly() bool {
+	return c.HasThought && c.Text == "" && c.FunctionCalls == 0
+}
 
-	part, ok := parts[0].(map[string]interface{})
+// ParseCandidates parses every candidate of an SSE data line.
+func ParseCandidates(line string) []CandidateContent {
+	_, data, ok := parseDataLine(line)
 	if !ok {
-		return LineContent{}
+		return nil
 	}
 
-	text, _ := part["text"].(string)
-	thought, _ := part["thought"].(bool)
+	rawCandidates, _ := data["candidates"].([]interface{})
+	candidates := make([]CandidateContent, 0, len(rawCandidates))
+	for pos, raw := range rawCandidates {
+		candidate, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, candidateContent(pos, candidate))
+	}
+	return candidates
+}
 
-	if thought {
-		logger.LogDebug("Extracted thought chunk. This will be tracked.")
-	} else if text != "" {
-		logger.LogDebug(fmt.Sprintf("Extracted text chunk (%d chars): %s", len(text),
-			func() string {
-				if len(text) > 100 {
-					return text[:100] + "..."
-				}
-				return text
-			}()))
+// candidateContent extracts the text and finish state of one candidate object.
+func candidateContent(pos int, candidate map[string]interface{}) CandidateContent {
+	result := CandidateContent{Index: pos}
+	if idx, ok := candidate["index"].(float64); ok {
+		result.Index = int(idx)
 	}
+	result.FinishReason, _ = candidate["finishReason"].(string)
 
-	return LineContent{
-		Text:      text,
-		IsThought: thought,
+	for _, part := range candidateParts(candidate) {
+		if _, ok := part["functionCall"]; ok {
+			result.FunctionCalls++
+			continue
+		}
+		text, _ := part["text"].(string)
+		if thought, _ := part["thought"].(bool); thought {
+			result.HasThought = true
+			result.ThoughtText += text
+			continue
+		}
+		result.Text += text
 	}
+	return result
 }
 
-// RemoveDoneTokenFromLine removes [done] token from SSE data line if present
-func RemoveDoneTokenFromLine(line string, shouldRemove bool) string {
-	if !IsDataLine(line) || !shouldRemove {
-		return line
+// candidateParts returns the parts of a candidate that are JSON objects.
+func candidateParts(candidate map[string]interface{}) []map[string]interface{} {
+	content, ok := candidate["content"].(map[string]interface{})
+	if !ok {
+		return nil
 	}
+	rawParts, _ := content["parts"].([]interface{})
+	parts := make([]map[string]interface{}, 0, len(rawParts))
+	for _, raw := range rawParts {
+		if part, ok := raw.(map[string]interface{}); ok {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
 
-	idx := strings.Index(line, "{")
-	if idx == -1 {
-		return line
+// LineContent represents parsed content from a data line
+type LineContent struct {
+	Text            string
+	IsThought       bool
+	HasFunctionCall bool
+}
+
+// ParseLineContent parses a data line to extract the text of its first candidate.
+// Formal text from all parts takes precedence; a chunk that only carries thoughts
+// returns the thought text with IsThought set.
+func ParseLineContent(line string) LineContent {
+	candidates := ParseCandidates(line)
+	if len(candidates) == 0 {
+		return LineContent{}
 	}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
-		logger.LogDebug("Failed to process line for [done] token removal:", err)
-		return line
+	candidate := candidates[0]
+	if candidate.IsThoughtOnly() {
+		logger.LogDebug("Extracted thought chunk. This will be tracked.")
+		return LineContent{Text: candidate.ThoughtText, IsThought: true}
 	}
 
-	candidates, ok := data["candidates"].([]interface{})
-	if !ok || len(candidates) == 0 {
-		return line
+	if candidate.Text != "" {
+		logger.LogDebug(fmt.Sprintf("Extracted text chunk (%d chars): %s", len(candidate.Text), previewText(candidate.Text, 100)))
 	}
+	if candidate.FunctionCalls > 0 {
+		logger.LogDebug(fmt.Sprintf("Extracted %d function call part(s)", candidate.FunctionCalls))
+	}
+	return LineContent{Text: candidate.Text, HasFunctionCall: candidate.FunctionCalls > 0}
+}
 
-	candidate, ok := candidates[0].(map[string]interface{})
-	if !ok {
+// RemoveCompletionMarkerFromLine strips the detector's completion marker from the text of
+// every candidate in an SSE data line. It is only applied to the final chunk of a response.
+func RemoveCompletionMarkerFromLine(line string, detector CompletionDetector, shouldRemove bool) string {
+	if !shouldRemove {
 		return line
 	}
 
-	content, ok := candidate["content"].(map[string]interface{})
+	prefix, data, ok := parseDataLine(line)
 	if !ok {
 		return line
 	}
 
-	parts, ok := content["parts"].([]interface{})
-	if !ok || len(parts) == 0 {
-		return line
+	candidates, _ := data["candidates"].([]interface{})
+	modified := false
+	for _, raw := range candidates {
+		if candidate, ok := raw.(map[string]interface{}); ok && stripCandidateMarker(candidate, detector) {
+			modified = true
+		}
 	}
-
-	part, ok := parts[0].(map[string]interface{})
-	if !ok {
+	if !modified {
 		return line
 	}
 
-	text, hasText := part["text"].(string)
-	thought, _ := part["thought"].(bool)
-
-	if !hasText || thought {
+	processed, err := encodeDataLine(prefix, data)
+	if err != nil {
+		logger.LogDebug("Failed to marshal modified data:", err)
 		return line
 	}
+	return processed
+}
 
-	// Remove the longest suffix of "[done]" from the text
-	// This handles cases where [done] is split across chunks
-	originalText := strings.TrimSpace(text)
-	modifiedText := originalText
-
-	// Try to remove each possible suffix of "[done]"
-	doneToken := "[done]"
-	for i := len(doneToken); i > 0; i-- {
-		suffix := doneToken[len(doneToken)-i:]
-		if strings.HasSuffix(originalText, suffix) {
-			modifiedText = strings.TrimSuffix(originalText, suffix)
-			logger.LogDebug(fmt.Sprintf("Removed [done] token suffix '%s' from text content. Original length: %d, Modified length: %d", suffix, len(originalText), len(modifiedText)))
-			break
+// stripCandidateMarker removes the completion marker from the last formal text part of
+// a candidate, reporting whether anything changed.
+func stripCandidateMarker(candidate map[string]interface{}, detector CompletionDetector) bool {
+	parts := candidateParts(candidate)
+	for i := len(parts) - 1; i >= 0; i-- {
+		part := parts[i]
+		text, hasText := part["text"].(string)
+		if thought, _ := part["thought"].(bool); !hasText || thought {
+			continue
 		}
-	}
-
-	if originalText != modifiedText {
-		part["text"] = modifiedText
 
-		modifiedData, err := json.Marshal(data)
-		if err != nil {
-			logger.LogDebug("Failed to marshal modified data:", err)
-			return line
+		modifiedText := detector.StripMarker(text)
+		if modifiedText == text {
+			return false
 		}
-
-		return line[:idx] + string(modifiedData)
+		logger.LogDebug(fmt.Sprintf("Removed completion marker (%s) from text content. Original length: %d, Modified length: %d", detector.Name(), len(text), len(modifiedText)))
+		part["text"] = modifiedText
+		return true
 	}
-
-	return line
+	return false
 }
@@ -0,0 +1,157 @@
+package streaming
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		maxSize int
+		want    []SSEEvent
+		wantErr error
+	}{
+		{
+			name:  "LF line endings",
+			input: "data: {\"a\":1}\n\ndata: {\"b\":2}\n\n",
+			want:  []SSEEvent{{Data: `{"a":1}`}, {Data: `{"b":2}`}},
+		},
+		{
+			name:  "CRLF line endings",
+			input: "data: one\r\n\r\ndata: two\r\n\r\n",
+			want:  []SSEEvent{{Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:  "CR line endings",
+			input: "data: one\r\rdata: two\r\r",
+			want:  []SSEEvent{{Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:  "multi-line data",
+			input: "data: {\ndata:   \"a\": 1\ndata: }\n\n",
+			want:  []SSEEvent{{Data: "{\n  \"a\": 1\n}"}},
+		},
+		{
+			name:  "data without a space and empty data lines",
+			input: "data:x\ndata:\ndata:y\n\n",
+			want:  []SSEEvent{{Data: "x\n\ny"}},
+		},
+		{
+			name:  "comments and blank lines are skipped",
+			input: ": keep-alive\n\n\n: another\ndata: payload\n: inside\n\n",
+			want:  []SSEEvent{{Data: "payload"}},
+		},
+		{
+			name:  "event, id and retry fields",
+			input: "event: error\nid: 7\nretry: 1500\ndata: {}\n\n",
+			want:  []SSEEvent{{Event: "error", ID: "7", Retry: 1500 * time.Millisecond, Data: "{}"}},
+		},
+		{
+			name:  "invalid retry and unknown fields are ignored",
+			input: "retry: soon\nfoo: bar\ndata: ok\n\n",
+			want:  []SSEEvent{{Data: "ok"}},
+		},
+		{
+			name:  "event without data is not dispatched",
+			input: "event: ping\n\ndata: after\n\n",
+			want:  []SSEEvent{{Data: "after"}},
+		},
+		{
+			name:  "last event without its blank line",
+			input: "data: first\n\ndata: last\n",
+			want:  []SSEEvent{{Data: "first"}},
+		},
+		{
+			name:  "last line cut off mid-line",
+			input: "data: first\n\ndata: cut",
+			want:  []SSEEvent{{Data: "first"}},
+		},
+		{
+			name:    "event above the size limit",
+			input:   "data: " + strings.Repeat("x", 64) + "\n\n",
+			maxSize: 32,
+			wantErr: ErrSSEEventTooLarge,
+		},
+		{
+			name:    "size limit applies to the whole event",
+			input:   "data: aaaaaaaaaa\ndata: bbbbbbbbbb\ndata: cccccccccc\n\n",
+			maxSize: 40,
+			wantErr: ErrSSEEventTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewSSEReader(strings.NewReader(tt.input), tt.maxSize)
+			var got []SSEEvent
+			var err error
+			for {
+				var event *SSEEvent
+				if event, err = reader.Next(); err != nil {
+					break
+				}
+				got = append(got, *event)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v; want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != io.EOF {
+				t.Fatalf("error = %v; want io.EOF", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSEEventLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		event SSEEvent
+		want  string
+	}{
+		{
+			name:  "message event",
+			event: SSEEvent{Data: `{"a":1}`},
+			want:  `data: {"a":1}`,
+		},
+		{
+			name:  "pretty-printed JSON is compacted",
+			event: SSEEvent{Data: "{\n  \"a\": 1,\n  \"b\": [1, 2]\n}"},
+			want:  `data: {"a":1,"b":[1,2]}`,
+		},
+		{
+			name:  "multi-line text keeps one data line per line",
+			event: SSEEvent{Data: "first\nsecond"},
+			want:  "data: first\ndata: second",
+		},
+		{
+			name:  "other event types keep their event field",
+			event: SSEEvent{Event: "error", Data: "{\n\"code\": 500\n}"},
+			want:  "event: error\ndata: {\"code\":500}",
+		},
+		{
+			name:  "explicit message type is dropped",
+			event: SSEEvent{Event: "message", Data: "x"},
+			want:  "data: x",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.event.Line(); got != tt.want {
+				t.Errorf("Line() = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
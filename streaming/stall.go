@@ -0,0 +1,164 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// ErrUpstreamStalled is the read error of StalledBody.
+var ErrUpstreamStalled = errors.New("upstream sent no response headers within the first byte timeout")
+
+// stalledBody stands in for the body of an initial request that stalled before its
+// response headers arrived.
+type stalledBody struct{}
+
+func (stalledBody) Read([]byte) (int, error) { return 0, ErrUpstreamStalled }
+func (stalledBody) Close() error             { return nil }
+
+// StalledBody returns a body whose first read fails with ErrUpstreamStalled, so the
+// stream processor treats the initial attempt as a STALL and retries it.
+func StalledBody() io.ReadCloser {
+	return stalledBody{}
+}
+
+// stallWatchdog wraps an upstream body and closes it when the upstream keeps the
+// connection open but stops sending data: no first byte within firstByte, or no data
+// for idle after that. Closing the body ends the attempt, which is then retried as a
+// STALL instead of hanging the client.
+type stallWatchdog struct {
+	reader    io.Reader
+	closer    io.Closer
+	firstByte time.Duration
+	idle      time.Duration
+
+	activity chan struct{}
+	done     chan struct{}
+	stalled  atomic.Bool
+}
+
+// newStallWatchdog starts watching reader. With both timeouts disabled, or a reader that
+// cannot be closed, reads pass straight through and nothing is watched.
+func newStallWatchdog(reader io.Reader, firstByte, idle time.Duration) *stallWatchdog {
+	w := &stallWatchdog{
+		reader:    reader,
+		firstByte: firstByte,
+		idle:      idle,
+		activity:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	closer, ok := reader.(io.Closer)
+	if !ok || (firstByte <= 0 && idle <= 0) {
+		return w
+	}
+	w.closer = closer
+	go w.run()
+	return w
+}
+
+func (w *stallWatchdog) Read(p []byte) (int, error) {
+	n, err := w.reader.Read(p)
+	if n > 0 {
+		select {
+		case w.activity <- struct{}{}:
+		default:
+		}
+	}
+	return n, err
+}
+
+func (w *stallWatchdog) run() {
+	timeout, phase := w.firstByte, "first byte"
+	for {
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if timeout > 0 {
+			timer = time.NewTimer(timeout)
+			expired = timer.C
+		}
+
+		select {
+		case <-w.activity:
+			timeout, phase = w.idle, "idle"
+		case <-w.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-expired:
+			w.stalled.Store(true)
+			logger.LogError(fmt.Sprintf("Upstream stream stalled: no data within the %s timeout (%v). Closing the connection.", phase, timeout))
+			w.closer.Close()
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// stop ends the watch; it must be called once the attempt is over.
+func (w *stallWatchdog) stop() {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+}
+
+// tripped reports whether the watchdog closed the body.
+func (w *stallWatchdog) tripped() bool {
+	return w.stalled.Load()
+}
+
+// cancelOnClose releases an attempt's context together with its body. Close cancels the
+// context first, which aborts a read in progress, and closes the body only once that
+// read has returned: closing an HTTP/1 body while another goroutine's read is reaching
+// EOF can deadlock the transport.
+type cancelOnClose struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+// NewCancelOnClose wraps an upstream response body so that closing it also cancels
+// the request's context.
+func NewCancelOnClose(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	return &cancelOnClose{body: body, cancel: cancel}
+}
+
+func (c *cancelOnClose) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.body.Read(p)
+}
+
+func (c *cancelOnClose) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.body.Close()
+}
+
+// HeaderDeadline cancels an upstream request whose response headers do not arrive within
+// timeout. stalled reports, once the request returned, whether that is why it failed.
+func HeaderDeadline(timeout time.Duration, cancel context.CancelFunc) (stalled func() bool) {
+	if timeout <= 0 {
+		return func() bool { return false }
+	}
+	var fired atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		fired.Store(true)
+		cancel()
+	})
+	return func() bool {
+		timer.Stop()
+		return fired.Load()
+	}
+}
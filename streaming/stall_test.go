@@ -0,0 +1,133 @@
+package streaming
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStallWatchdog(t *testing.T) {
+	tests := []struct {
+		name        string
+		firstByte   time.Duration
+		idle        time.Duration
+		chunks      int
+		wantTripped bool
+	}{
+		{"first byte timeout", 20 * time.Millisecond, 0, 0, true},
+		{"idle timeout after the first byte", 0, 20 * time.Millisecond, 1, true},
+		{"first byte in time with idle disabled", 200 * time.Millisecond, 0, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, upstream := io.Pipe()
+			defer upstream.Close()
+			w := newStallWatchdog(body, tt.firstByte, tt.idle)
+			defer w.stop()
+
+			go func(chunks int) {
+				for i := 0; i < chunks; i++ {
+					upstream.Write([]byte("data: {}\n"))
+				}
+			}(tt.chunks)
+			buf := make([]byte, 64)
+			for i := 0; i < tt.chunks; i++ {
+				if _, err := w.Read(buf); err != nil {
+					t.Fatalf("read %d: %v", i, err)
+				}
+			}
+
+			if !tt.wantTripped {
+				time.Sleep(300 * time.Millisecond)
+				if w.tripped() {
+					t.Error("watchdog tripped")
+				}
+				return
+			}
+			if _, err := w.Read(buf); !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("read after the stall = %v; want %v", err, io.ErrClosedPipe)
+			}
+			if !w.tripped() {
+				t.Error("tripped() = false after the body was closed")
+			}
+		})
+	}
+}
+
+func TestStallWatchdogStop(t *testing.T) {
+	body, upstream := io.Pipe()
+	defer upstream.Close()
+	w := newStallWatchdog(body, 20*time.Millisecond, 20*time.Millisecond)
+	w.stop()
+	w.stop()
+
+	time.Sleep(60 * time.Millisecond)
+	if w.tripped() {
+		t.Error("watchdog tripped after stop()")
+	}
+	go upstream.Write([]byte("data"))
+	if _, err := w.Read(make([]byte, 4)); err != nil {
+		t.Errorf("body was closed after stop(): %v", err)
+	}
+}
+
+func TestStallWatchdogPassThrough(t *testing.T) {
+	// A reader without Close cannot be aborted, so nothing is watched.
+	w := newStallWatchdog(strings.NewReader("data"), time.Millisecond, time.Millisecond)
+	defer w.stop()
+	time.Sleep(10 * time.Millisecond)
+	got, err := io.ReadAll(w)
+	if err != nil || string(got) != "data" {
+		t.Errorf("ReadAll() = %q, %v; want %q", got, err, "data")
+	}
+	if w.tripped() {
+		t.Error("watchdog tripped without a closer")
+	}
+}
+
+func TestHeaderDeadline(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		wait        time.Duration
+		wantStalled bool
+	}{
+		{"headers in time", 200 * time.Millisecond, 0, false},
+		{"headers too late", 10 * time.Millisecond, 50 * time.Millisecond, true},
+		{"disabled", 0, 10 * time.Millisecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancelled := make(chan struct{})
+			stalled := HeaderDeadline(tt.timeout, func() { close(cancelled) })
+			time.Sleep(tt.wait)
+			if got := stalled(); got != tt.wantStalled {
+				t.Errorf("stalled() = %v; want %v", got, tt.wantStalled)
+			}
+			select {
+			case <-cancelled:
+				if !tt.wantStalled {
+					t.Error("request was cancelled")
+				}
+			default:
+				if tt.wantStalled {
+					t.Error("request was not cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestStalledBody(t *testing.T) {
+	body := StalledBody()
+	if _, err := body.Read(make([]byte, 8)); !errors.Is(err, ErrUpstreamStalled) {
+		t.Errorf("Read() error = %v; want %v", err, ErrUpstreamStalled)
+	}
+	if err := body.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+}
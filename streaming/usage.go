@@ -0,0 +1,91 @@
+package streaming
+
+// Token accounting helpers. Gemini reports usageMetadata cumulatively within one
+// response, so the latest value seen in an attempt is that attempt's total; the totals
+// of all attempts are summed to report what the session really cost.
+
+// usageCounts holds the token counters of one usageMetadata block.
+type usageCounts struct {
+	Prompt     int `json:"promptTokenCount"`
+	Candidates int `json:"candidatesTokenCount"`
+	Thoughts   int `json:"thoughtsTokenCount,omitempty"`
+	Total      int `json:"totalTokenCount"`
+}
+
+// parseUsage reads the token counters from the usageMetadata of a chunk.
+func parseUsage(data map[string]interface{}) (usageCounts, bool) {
+	usage, ok := data["usageMetadata"].(map[string]interface{})
+	if !ok {
+		return usageCounts{}, false
+	}
+	count := func(key string) int {
+		v, _ := usage[key].(float64)
+		return int(v)
+	}
+	return usageCounts{
+		Prompt:     count("promptTokenCount"),
+		Candidates: count("candidatesTokenCount"),
+		Thoughts:   count("thoughtsTokenCount"),
+		Total:      count("totalTokenCount"),
+	}, true
+}
+
+// output returns the tokens that count against maxOutputTokens: candidate tokens plus
+// thinking tokens.
+func (u usageCounts) output() int {
+	return u.Candidates + u.Thoughts
+}
+
+func (u usageCounts) add(other usageCounts) usageCounts {
+	return usageCounts{
+		Prompt:     u.Prompt + other.Prompt,
+		Candidates: u.Candidates + other.Candidates,
+		Thoughts:   u.Thoughts + other.Thoughts,
+		Total:      u.Total + other.Total,
+	}
+}
+
+// applyTo overwrites the counters of a usageMetadata object, keeping any other fields
+// (such as per-modality details) as reported by the last attempt.
+func (u usageCounts) applyTo(usage map[string]interface{}) {
+	usage["promptTokenCount"] = u.Prompt
+	usage["candidatesTokenCount"] = u.Candidates
+	usage["totalTokenCount"] = u.Total
+	if u.Thoughts > 0 {
+		usage["thoughtsTokenCount"] = u.Thoughts
+	}
+}
+
+// attemptUsage is one entry of the optional per-attempt usage breakdown.
+type attemptUsage struct {
+	Attempt int `json:"attempt"`
+	usageCounts
+}
+
+// requestedMaxOutputTokens returns generationConfig.maxOutputTokens, or 0 when unset.
+func requestedMaxOutputTokens(body map[string]interface{}) int {
+	if genConfig, ok := body["generationConfig"].(map[string]interface{}); ok {
+		if maxTokens, ok := genConfig["maxOutputTokens"].(float64); ok && maxTokens > 0 {
+			return int(maxTokens)
+		}
+	}
+	return 0
+}
+
+// withGenerationConfig copies body with one generationConfig field replaced, leaving
+// the original request untouched.
+func withGenerationConfig(body map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(body))
+	for k, v := range body {
+		copied[k] = v
+	}
+	genConfig := map[string]interface{}{}
+	if existing, ok := body["generationConfig"].(map[string]interface{}); ok {
+		for k, v := range existing {
+			genConfig[k] = v
+		}
+	}
+	genConfig[key] = value
+	copied["generationConfig"] = genConfig
+	return copied
+}
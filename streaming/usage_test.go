@@ -0,0 +1,162 @@
+package streaming
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gemini-antiblock/config"
+)
+
+// usageChunkLine encodes a text chunk carrying usageMetadata.
+func usageChunkLine(t *testing.T, text, finishReason string, prompt, candidates, thoughts int) string {
+	t.Helper()
+	_, data, _ := parseDataLine(textChunkLine(t, text, finishReason))
+	data["usageMetadata"] = map[string]interface{}{
+		"promptTokenCount":     prompt,
+		"candidatesTokenCount": candidates,
+		"thoughtsTokenCount":   thoughts,
+		"totalTokenCount":      prompt + candidates + thoughts,
+		"promptTokensDetails":  []interface{}{map[string]interface{}{"modality": "TEXT"}},
+	}
+	line, err := encodeDataLine("data: ", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestParseUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		want   usageCounts
+		wantOK bool
+	}{
+		{
+			name:   "all counters",
+			data:   `{"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5,"thoughtsTokenCount":3,"totalTokenCount":18}}`,
+			want:   usageCounts{Prompt: 10, Candidates: 5, Thoughts: 3, Total: 18},
+			wantOK: true,
+		},
+		{
+			name:   "missing counters are zero",
+			data:   `{"usageMetadata":{"promptTokenCount":10,"totalTokenCount":10}}`,
+			want:   usageCounts{Prompt: 10, Total: 10},
+			wantOK: true,
+		},
+		{
+			name: "no usage",
+			data: `{"candidates":[]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.data), &data); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := parseUsage(data)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseUsage() = %+v, %t; want %+v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMergedUsageAcrossAttempts(t *testing.T) {
+	tests := []struct {
+		name string
+		// attempts are the chunks of each attempt; every attempt but the last is charged
+		// before the next one starts, as the retry loop does.
+		attempts  [][]string
+		breakdown bool
+		want      usageCounts
+		wantParts int
+	}{
+		{
+			name:     "single attempt is forwarded as reported",
+			attempts: [][]string{{usageChunkLine(t, "Done.[done]", "STOP", 10, 4, 2)}},
+			want:     usageCounts{Prompt: 10, Candidates: 4, Thoughts: 2, Total: 16},
+		},
+		{
+			name: "prompt and candidate tokens are summed over retries",
+			attempts: [][]string{
+				{usageChunkLine(t, "Part one", "", 10, 3, 1), usageChunkLine(t, " cut", "", 10, 5, 1)},
+				{usageChunkLine(t, " and done.[done]", "STOP", 14, 4, 0)},
+			},
+			want: usageCounts{Prompt: 24, Candidates: 9, Thoughts: 1, Total: 34},
+		},
+		{
+			name: "an attempt without usage adds nothing",
+			attempts: [][]string{
+				{usageChunkLine(t, "Part one", "", 10, 3, 0)},
+				{textChunkLine(t, "lost", "")},
+				{usageChunkLine(t, " done.[done]", "STOP", 12, 2, 0)},
+			},
+			want: usageCounts{Prompt: 22, Candidates: 5, Total: 27},
+		},
+		{
+			name: "breakdown lists every attempt",
+			attempts: [][]string{
+				{usageChunkLine(t, "Part one", "", 10, 3, 0)},
+				{usageChunkLine(t, " done.[done]", "STOP", 12, 2, 0)},
+			},
+			breakdown: true,
+			want:      usageCounts{Prompt: 22, Candidates: 5, Total: 27},
+			wantParts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			session := newTestSession(&config.Config{UsageBreakdown: tt.breakdown}, NewSentinelDetector(""), &out)
+			for i, lines := range tt.attempts {
+				if i > 0 {
+					session.chargeAttemptTokens()
+					out.Reset()
+				}
+				for _, line := range lines {
+					if _, err := session.processLine(line); err != nil {
+						t.Fatalf("processLine: %v", err)
+					}
+				}
+			}
+
+			// The last usageMetadata forwarded is what the client is billed.
+			var last map[string]interface{}
+			reader := NewSSEReader(&out, 0)
+			for event, err := reader.Next(); err == nil; event, err = reader.Next() {
+				var data map[string]interface{}
+				if json.Unmarshal([]byte(event.Data), &data) == nil && data["usageMetadata"] != nil {
+					last = data
+				}
+			}
+			if last == nil {
+				t.Fatal("no usageMetadata was forwarded")
+			}
+			got, _ := parseUsage(last)
+			if got != tt.want {
+				t.Errorf("forwarded usage = %+v; want %+v", got, tt.want)
+			}
+			details := last["usageMetadata"].(map[string]interface{})["promptTokensDetails"]
+			if !reflect.DeepEqual(details, []interface{}{map[string]interface{}{"modality": "TEXT"}}) {
+				t.Errorf("promptTokensDetails = %v; want the last attempt's details kept", details)
+			}
+
+			breakdown, _ := last["antiblockUsage"].(map[string]interface{})
+			if tt.wantParts == 0 {
+				if breakdown != nil {
+					t.Errorf("antiblockUsage = %v; want none", breakdown)
+				}
+				return
+			}
+			if attempts, _ := breakdown["attempts"].([]interface{}); len(attempts) != tt.wantParts {
+				t.Errorf("antiblockUsage attempts = %v; want %d", breakdown["attempts"], tt.wantParts)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// Options tunes the upstream transports. A zero timeout leaves that step unbounded.
+type Options struct {
+	// DialTimeout bounds establishing the TCP connection and KeepAlive is the TCP
+	// keep-alive probe interval of open connections.
+	DialTimeout time.Duration
+	KeepAlive   time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for response headers once the request has
+	// been written. Non-streaming upstream calls only send headers after generating the
+	// whole response, so it must cover the slowest generation.
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout closes pooled connections left idle this long. MaxIdleConns is
+	// the number of idle connections kept per upstream (Go's default of 2 when zero)
+	// and MaxConns caps the open connections per upstream (unlimited when zero).
+	IdleConnTimeout time.Duration
+	MaxIdleConns    int
+	MaxConns        int
+	// HTTP2 negotiates HTTP/2 with TLS upstreams; when false every upstream is spoken
+	// to over HTTP/1.1.
+	HTTP2 bool
+}
+
+// Clients hands out the HTTP clients for upstream calls. Each upstream (scheme and
+// host) gets its own transport, so one slow or saturated upstream cannot exhaust the
+// connection pool of the others, and connections are reused across the initial
+// request, retries and hedges of a stream.
+type Clients struct {
+	options Options
+
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+// shared serves a nil *Clients, so callers without a configured set still reuse
+// connections.
+var shared = &http.Client{}
+
+// NewClients creates an empty set of upstream clients; transports are built on first use.
+func NewClients(options Options) *Clients {
+	return &Clients{options: options, clients: make(map[string]*http.Client)}
+}
+
+// For returns the client for the upstream of target, a full URL or a base.
+func (c *Clients) For(target string) *http.Client {
+	if c == nil {
+		return shared
+	}
+	key := target
+	if parsed, err := url.Parse(target); err == nil && parsed.Host != "" {
+		key = parsed.Scheme + "://" + parsed.Host
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[key]; ok {
+		return client
+	}
+	client := &http.Client{Transport: c.newTransport()}
+	c.clients[key] = client
+	logger.LogDebug(fmt.Sprintf("Created upstream transport for %s", key))
+	return client
+}
+
+func (c *Clients) newTransport() *http.Transport {
+	o := c.options
+	dialer := &net.Dialer{Timeout: o.DialTimeout, KeepAlive: o.KeepAlive}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   o.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		MaxIdleConns:          o.MaxIdleConns,
+		MaxIdleConnsPerHost:   o.MaxIdleConns,
+		MaxConnsPerHost:       o.MaxConns,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     o.HTTP2,
+	}
+	if !o.HTTP2 {
+		// A non-nil empty map turns off the transport's automatic HTTP/2 upgrade.
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
@@ -0,0 +1,143 @@
+package upstream
+
+import (
+	"fmt"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// Circuit breaker states of an upstream base.
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+// Breaker configures the per-base circuit breaker. A base opens after Threshold
+// consecutive failures and stays out of rotation for Cooldown; it then half-opens and
+// the next request or health probe decides whether it closes again. A zero Threshold
+// disables the breaker.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// available reports whether s may be handed out now. An open breaker whose cooldown
+// has passed moves to half-open, which admits one trial request per cooldown.
+// The caller holds r.mu.
+func (r *registry) available(s *Stats, now time.Time) bool {
+	switch s.State {
+	case StateOpen:
+		if now.Sub(s.OpenedAt) < r.breaker.Cooldown {
+			return false
+		}
+		s.State = StateHalfOpen
+		s.trialAt = time.Time{}
+		logger.LogInfo(fmt.Sprintf("Upstream %s circuit half-open; allowing a trial request", s.Base))
+		return true
+	case StateHalfOpen:
+		return s.trialAt.IsZero() || now.Sub(s.trialAt) >= r.breaker.Cooldown
+	}
+	return true
+}
+
+// claim records that s was handed out. The caller holds r.mu.
+func (r *registry) claim(s *Stats, now time.Time) {
+	if s.State == StateHalfOpen {
+		s.trialAt = now
+	}
+}
+
+// close closes the breaker of s after a success. The caller holds r.mu.
+func (r *registry) close(s *Stats) {
+	if s.State != StateClosed {
+		logger.LogInfo(fmt.Sprintf("Upstream %s recovered; circuit closed", s.Base))
+	}
+	s.State = StateClosed
+	s.trialAt = time.Time{}
+}
+
+// fail records a failure of s and opens its breaker once the threshold is reached, or
+// immediately when a half-open trial fails. A failure of an open base restarts its
+// cooldown. The caller holds r.mu.
+func (r *registry) fail(s *Stats) {
+	now := time.Now().UTC()
+	s.Failures++
+	s.ConsecutiveFailures++
+	s.LastFailure = now
+
+	if r.breaker.Threshold <= 0 {
+		return
+	}
+	if s.State == StateOpen {
+		// Still failing, e.g. a health probe: restart the cooldown.
+		s.OpenedAt = now
+		return
+	}
+	if s.State == StateHalfOpen || (s.State == StateClosed && s.ConsecutiveFailures >= int64(r.breaker.Threshold)) {
+		logger.LogError(fmt.Sprintf("Upstream %s circuit opened after %d consecutive failures; retesting in %v", s.Base, s.ConsecutiveFailures, r.breaker.Cooldown))
+		s.State = StateOpen
+		s.OpenedAt = now
+	}
+}
+
+// Status is the JSON view of one base, as shown on /health and the logs dashboard.
+// Groups lists the upstream groups the base belongs to.
+type Status struct {
+	Index               int        `json:"index"`
+	Upstream            string     `json:"upstream"`
+	Groups              []string   `json:"groups"`
+	State               string     `json:"state"`
+	Successes           int64      `json:"successes"`
+	Failures            int64      `json:"failures"`
+	ConsecutiveFailures int64      `json:"consecutiveFailures"`
+	LastLatencyMs       int64      `json:"lastLatencyMs"`
+	LastFailure         *time.Time `json:"lastFailure,omitempty"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	LastProbe           *time.Time `json:"lastProbe,omitempty"`
+	ProbeError          string     `json:"probeError,omitempty"`
+}
+
+// Snapshot returns the state of every base of every group, in the order the bases were
+// first configured. Bases are shown as scheme and host only, so worker paths or keys in
+// the URL are not exposed.
+func (p *Pool) Snapshot() []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	result := make([]Status, 0, len(p.all))
+	for i, base := range p.all {
+		s := p.stats[base]
+		var groups []string
+		for _, name := range p.names {
+			for _, member := range p.groups[name].bases {
+				if member == base {
+					groups = append(groups, name)
+					break
+				}
+			}
+		}
+		result = append(result, Status{
+			Index:               i,
+			Upstream:            displayBase(base),
+			Groups:              groups,
+			State:               s.State,
+			Successes:           s.Successes,
+			Failures:            s.Failures,
+			ConsecutiveFailures: s.ConsecutiveFailures,
+			LastLatencyMs:       s.LastLatency.Milliseconds(),
+			LastFailure:         optional(s.LastFailure),
+			OpenedAt:            optional(s.OpenedAt),
+			LastProbe:           optional(s.LastProbe),
+			ProbeError:          s.ProbeError,
+		})
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/transport"
+)
+
+// HealthCheck configures the active health probes: every Interval, each base is sent
+// a GET for Path and counts as reachable when it answers with a status below 500
+// within Timeout. Probes go through Clients, so they share the connections of the
+// traffic to the base. A zero Interval disables probing.
+type HealthCheck struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Path     string
+	Clients  *transport.Clients
+}
+
+// StartHealthChecks probes every base of every group in the background until ctx is done. A failed
+// probe counts as a failure of the base, so a dead upstream is taken out of rotation
+// even while it receives no traffic; a successful probe of a half-open base closes it.
+func (p *Pool) StartHealthChecks(ctx context.Context, check HealthCheck) {
+	if check.Interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(check.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.mu.Lock()
+				bases := append([]string(nil), p.all...)
+				p.mu.Unlock()
+				for _, base := range bases {
+					client := *check.Clients.For(base)
+					client.Timeout = check.Timeout
+					p.probe(ctx, &client, base, check.Path)
+				}
+			}
+		}
+	}()
+}
+
+func (r *registry) probe(ctx context.Context, client *http.Client, base, path string) {
+	err := probeBase(ctx, client, strings.TrimRight(base, "/")+"/"+strings.TrimLeft(path, "/"))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats[base]
+	now := time.Now()
+	s.LastProbe = now.UTC()
+	if err != nil {
+		logger.LogError(fmt.Sprintf("Health probe of upstream %s failed: %v", base, err))
+		s.ProbeError = err.Error()
+		r.fail(s)
+		return
+	}
+	s.ProbeError = ""
+	logger.LogDebug(fmt.Sprintf("Health probe of upstream %s succeeded", base))
+	if s.State == StateHalfOpen || (s.State == StateOpen && now.Sub(s.OpenedAt) >= r.breaker.Cooldown) {
+		s.ConsecutiveFailures = 0
+		r.close(s)
+	}
+}
+
+func probeBase(ctx context.Context, client *http.Client, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// displayBase reduces a base URL to its scheme and host.
+func displayBase(base string) string {
+	parsed, err := url.Parse(base)
+	if err != nil || parsed.Host == "" {
+		return base
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
@@ -0,0 +1,272 @@
+package upstream
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retry upstream selection strategies.
+const (
+	StrategySame       = "same"
+	StrategyNext       = "next"
+	StrategyHealthiest = "healthiest"
+)
+
+// Stats holds the observed health of one upstream base.
+type Stats struct {
+	Base                string
+	Successes           int64
+	Failures            int64
+	ConsecutiveFailures int64
+	LastLatency         time.Duration
+	LastFailure         time.Time
+
+	// State is the circuit breaker state; OpenedAt is when it last opened.
+	State    string
+	OpenedAt time.Time
+	// LastProbe is the time of the last health probe and ProbeError its error, if any.
+	LastProbe  time.Time
+	ProbeError string
+
+	// trialAt is when a half-open base was last handed out for a trial request.
+	trialAt time.Time
+}
+
+// Member is one base of an upstream group with its share of the group's traffic.
+type Member struct {
+	Base   string
+	Weight int
+}
+
+// registry holds what the groups of a pool share: every base's stats and breaker
+// state, so a base in several groups is tracked and probed once.
+type registry struct {
+	breaker Breaker
+
+	mu     sync.Mutex
+	stats  map[string]*Stats
+	all    []string
+	groups map[string]*Pool
+	names  []string
+}
+
+// Pool is one upstream group. It hands out its bases by smooth weighted round robin and
+// tracks per-base outcomes so retries can fail over to a different base. A circuit
+// breaker keeps bases that keep failing out of rotation until a cooldown has passed.
+type Pool struct {
+	*registry
+	name    string
+	bases   []string
+	weights []int
+	// current holds the smooth weighted round robin state; guarded by mu.
+	current []int
+}
+
+// NewPool creates a pool whose first group, the one requests use unless routed
+// elsewhere, is named name and holds members. Members must not be empty.
+func NewPool(name string, members []Member, breaker Breaker) *Pool {
+	r := &registry{
+		breaker: breaker,
+		stats:   make(map[string]*Stats),
+		groups:  make(map[string]*Pool),
+	}
+	return r.add(name, members)
+}
+
+// AddGroup registers another named group sharing this pool's stats. Members must not be
+// empty; registering an existing name replaces that group.
+func (p *Pool) AddGroup(name string, members []Member) *Pool {
+	return p.add(name, members)
+}
+
+func (r *registry) add(name string, members []Member) *Pool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g := &Pool{registry: r, name: name}
+	for _, m := range members {
+		weight := m.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		g.bases = append(g.bases, m.Base)
+		g.weights = append(g.weights, weight)
+		if _, ok := r.stats[m.Base]; !ok {
+			r.stats[m.Base] = &Stats{Base: m.Base, State: StateClosed}
+			r.all = append(r.all, m.Base)
+		}
+	}
+	g.current = make([]int, len(g.bases))
+	if _, ok := r.groups[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.groups[name] = g
+	return g
+}
+
+// Group returns the named group of the pool.
+func (p *Pool) Group(name string) (*Pool, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	g, ok := p.groups[name]
+	return g, ok
+}
+
+// Name returns the group's name.
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Next returns the next available base by smooth weighted round robin along with its
+// index in the group. When every breaker is open it falls back to the unavailable bases
+// rather than failing requests.
+func (p *Pool) Next() (string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	idx := p.weighted(func(s *Stats) bool { return p.available(s, now) })
+	if idx == -1 {
+		idx = p.weighted(func(*Stats) bool { return true })
+	} else {
+		p.claim(p.stats[p.bases[idx]], now)
+	}
+	return p.bases[idx], idx
+}
+
+// weighted runs one round of smooth weighted round robin over the eligible bases and
+// returns the chosen index, or -1 when none is eligible. The caller holds p.mu.
+func (p *Pool) weighted(eligible func(*Stats) bool) int {
+	best, total := -1, 0
+	for i, base := range p.bases {
+		if !eligible(p.stats[base]) {
+			continue
+		}
+		p.current[i] += p.weights[i]
+		total += p.weights[i]
+		if best == -1 || p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	if best != -1 {
+		p.current[best] -= total
+	}
+	return best
+}
+
+// Pick chooses the base for a retry attempt after current was used.
+func (p *Pool) Pick(strategy, current string) string {
+	if len(p.bases) < 2 {
+		return current
+	}
+	switch strings.ToLower(strategy) {
+	case StrategyNext:
+		return p.after(current)
+	case StrategyHealthiest:
+		return p.healthiest(current)
+	default:
+		return current
+	}
+}
+
+// after returns the first available base following current in configuration order.
+func (p *Pool) after(current string) string {
+	pos := -1
+	for i, base := range p.bases {
+		if base == current {
+			pos = i
+		}
+	}
+	if pos == -1 {
+		base, _ := p.Next()
+		return base
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for i := 1; i <= len(p.bases); i++ {
+		base := p.bases[(pos+i)%len(p.bases)]
+		if s := p.stats[base]; p.available(s, now) {
+			p.claim(s, now)
+			return base
+		}
+	}
+	return p.bases[(pos+1)%len(p.bases)]
+}
+
+// healthiest prefers the base with the fewest consecutive failures, then the lowest
+// failure ratio, then the lowest last latency. The current base only wins ties when
+// it is strictly healthier than every alternative.
+func (p *Pool) healthiest(current string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	best := ""
+	var bestStats *Stats
+	for _, base := range p.bases {
+		if base == current {
+			continue
+		}
+		s := p.stats[base]
+		if !p.available(s, now) {
+			continue
+		}
+		if bestStats == nil || healthier(s, bestStats) {
+			best, bestStats = base, s
+		}
+	}
+	if cur, ok := p.stats[current]; ok && bestStats != nil && healthier(cur, bestStats) && p.available(cur, now) {
+		return current
+	}
+	if best == "" {
+		return current
+	}
+	p.claim(bestStats, now)
+	return best
+}
+
+func healthier(a, b *Stats) bool {
+	if a.ConsecutiveFailures != b.ConsecutiveFailures {
+		return a.ConsecutiveFailures < b.ConsecutiveFailures
+	}
+	ra, rb := failureRatio(a), failureRatio(b)
+	if ra != rb {
+		return ra < rb
+	}
+	if a.LastLatency == 0 || b.LastLatency == 0 {
+		return a.LastLatency == 0 && b.LastLatency != 0
+	}
+	return a.LastLatency < b.LastLatency
+}
+
+func failureRatio(s *Stats) float64 {
+	total := s.Successes + s.Failures
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(total)
+}
+
+// ReportSuccess records a successful response from base.
+func (p *Pool) ReportSuccess(base string, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.stats[base]; ok {
+		s.Successes++
+		s.ConsecutiveFailures = 0
+		s.LastLatency = latency
+		p.close(s)
+	}
+}
+
+// ReportFailure records a connection error, 5xx or dropped stream from base.
+func (p *Pool) ReportFailure(base string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.stats[base]; ok {
+		p.fail(s)
+	}
+}
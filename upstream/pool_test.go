@@ -0,0 +1,80 @@
+package upstream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNextSmoothWeightedRoundRobin(t *testing.T) {
+	pool := NewPool("default", []Member{
+		{Base: "a", Weight: 5},
+		{Base: "b", Weight: 1},
+		{Base: "c", Weight: 1},
+	}, Breaker{})
+
+	// Smooth weighted round robin spreads the light bases between the heavy one's turns.
+	var got []string
+	for i := 0; i < 7; i++ {
+		base, _ := pool.Next()
+		got = append(got, base)
+	}
+	want := []string{"a", "a", "b", "a", "c", "a", "a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("first round = %v; want %v", got, want)
+	}
+}
+
+func TestNextDistribution(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []Member
+		want    map[string]int
+	}{
+		{"equal weights", []Member{{Base: "a", Weight: 1}, {Base: "b", Weight: 1}}, map[string]int{"a": 50, "b": 50}},
+		{"weighted", []Member{{Base: "a", Weight: 3}, {Base: "b", Weight: 1}}, map[string]int{"a": 75, "b": 25}},
+		{"zero weight counts as 1", []Member{{Base: "a", Weight: 0}, {Base: "b", Weight: 4}}, map[string]int{"a": 20, "b": 80}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewPool("default", tt.members, Breaker{})
+			got := map[string]int{}
+			for i := 0; i < 100; i++ {
+				base, idx := pool.Next()
+				if tt.members[idx].Base != base {
+					t.Fatalf("Next() index %d does not match base %q", idx, base)
+				}
+				got[base]++
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("distribution = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextSkipsOpenBreakers(t *testing.T) {
+	pool := NewPool("default", []Member{
+		{Base: "a", Weight: 3},
+		{Base: "b", Weight: 1},
+	}, Breaker{Threshold: 1, Cooldown: time.Minute})
+
+	pool.ReportFailure("a")
+	for i := 0; i < 4; i++ {
+		if base, _ := pool.Next(); base != "b" {
+			t.Fatalf("Next() = %q while a is open; want b", base)
+		}
+	}
+
+	// With every breaker open, requests still go out rather than failing.
+	pool.ReportFailure("b")
+	got := map[string]int{}
+	for i := 0; i < 4; i++ {
+		base, _ := pool.Next()
+		got[base]++
+	}
+	if want := map[string]int{"a": 3, "b": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("distribution with every breaker open = %v; want %v", got, want)
+	}
+}